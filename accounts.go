@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/karl-gustav/power_price/apikey"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+// maxKeysPerAccount is how many keys that hasn't expired an account can have
+const maxKeysPerAccount = 10
+
+var (
+	ErrorTooManyKeys = fmt.Errorf("an account can't have more than %d API keys that hasn't expired, revoke one of them first", maxKeysPerAccount)
+	// ErrorKeyExpires is returned when rotating a key that was already
+	// rotated or revoked, or was created with an expiry, since the new key
+	// doesn't expire
+	ErrorKeyExpires = errors.New("the key already expires, create a new key instead of rotating it")
+)
+
+// keyRotationGracePeriod is how long the old key keeps working after it is
+// rotated, so the new key can be rolled out
+var keyRotationGracePeriod = getEnvDuration("KEY_ROTATION_GRACE_PERIOD", 24*time.Hour)
+
+// accountApiKey is an API key as it is shown to the user, without the ID
+// since that is the hash of the key
+type accountApiKey struct {
+	Prefix  string         `json:"prefix"`
+	Name    string         `json:"name"`
+	Created time.Time      `json:"created"`
+	Expires *time.Time     `json:"expires,omitempty"`
+	Expired bool           `json:"expired"`
+	Scopes  storage.Scopes `json:"scopes"`
+	// Current is the key the request was made with
+	Current bool `json:"current"`
+}
+
+// newAccountApiKey is the only time the key is shown
+type newAccountApiKey struct {
+	Key string `json:"key"`
+	accountApiKey
+}
+
+type createAccountApiKeyRequest struct {
+	Name string `json:"name"`
+	// Expires is optional, the key never expires if it isn't set
+	Expires *time.Time     `json:"expires"`
+	Scopes  storage.Scopes `json:"scopes"`
+}
+
+func toAccountApiKey(entry storage.ApiKeyEntry, currentID string, now time.Time) accountApiKey {
+	key := accountApiKey{
+		Prefix:  entry.Prefix,
+		Name:    entry.Name,
+		Created: entry.Created,
+		Expired: entry.Expired(now),
+		Scopes:  entry.Scopes,
+		Current: entry.ID == currentID,
+	}
+	if !entry.Expires.IsZero() {
+		key.Expires = &entry.Expires
+	}
+	return key
+}
+
+// listKeysHandler lists the keys of the account, with the expired keys
+func listKeysHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	c := callerFrom(ctx)
+	apiKeys, err := listAccountApiKeys(ctx, c.accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing API keys for key %s: %v", c.prefix, err))
+		http.Error(res, "error when listing api keys", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	keys := make([]accountApiKey, 0, len(apiKeys))
+	for _, entry := range apiKeys {
+		keys = append(keys, toAccountApiKey(entry, c.id, now))
+	}
+	writeJSON(res, req, http.StatusOK, keys)
+}
+
+// createKeyHandler adds a named key to the account, it shares the quota with
+// the other keys. Keys with scopes can't create keys, since the new key could
+// have more access.
+func createKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	c := callerFrom(ctx)
+	if !c.apiKey.Scopes.IsZero() {
+		http.Error(res, "keys with scopes can't create other keys", http.StatusForbidden)
+		return
+	}
+	var body createAccountApiKeyRequest
+	if req.ContentLength != 0 && !readJSON(res, req, &body) {
+		return
+	}
+	template, ok := newApiKeyFromRequest(res, body, false)
+	if !ok {
+		return
+	}
+	active, err := countActiveApiKeys(ctx, c.accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing API keys for key %s: %v", c.prefix, err))
+		http.Error(res, "error when creating api key", http.StatusInternalServerError)
+		return
+	}
+	if active >= maxKeysPerAccount {
+		http.Error(res, fmt.Sprintf("you already have %d API keys, revoke one of them first", active), http.StatusConflict)
+		return
+	}
+	if c.apiKey.Account == "" {
+		if err = storeAccount(ctx, c.id, *c.account, c.apiKey); err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when creating account for key %s: %v", c.prefix, err))
+			http.Error(res, "error when creating api key", http.StatusInternalServerError)
+			return
+		}
+	}
+	key, entry, err := createApiKey(ctx, c.accountID, *c.account, template)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when creating API key for key %s: %v", c.prefix, err))
+		http.Error(res, "error when creating api key", http.StatusInternalServerError)
+		return
+	}
+	addAuditLogEntry(ctx, c.prefix, "create", entry.ID, map[string]string{
+		"prefix":  entry.Prefix,
+		"account": c.accountID,
+		"name":    entry.Name,
+	})
+	writeJSON(res, req, http.StatusCreated, newAccountApiKey{Key: key, accountApiKey: toAccountApiKey(entry, "", time.Now())})
+}
+
+// rotateKeyHandler replaces the key the request is made with by a new key,
+// the old key keeps working for keyRotationGracePeriod
+func rotateKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	c := callerFrom(ctx)
+	key, entry, err := rotateApiKey(ctx, c.id, c.apiKey, c.account)
+	if errors.Is(err, ErrorTooManyKeys) || errors.Is(err, ErrorKeyExpires) {
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when rotating API key %s: %v", c.prefix, err))
+		http.Error(res, "error when rotating api key: "+c.prefix, http.StatusInternalServerError)
+		return
+	}
+	addAuditLogEntry(ctx, c.prefix, "rotate", c.id, rotateDetails(c.apiKey, entry))
+	writeJSON(res, req, http.StatusCreated, newAccountApiKey{Key: key, accountApiKey: toAccountApiKey(entry, "", time.Now())})
+}
+
+// revokeKeyHandler makes a key in the account expire now, keys are never
+// deleted so the audit log and the usage can be traced back to them. Keys
+// with scopes can only revoke themselves.
+func revokeKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	c := callerFrom(ctx)
+	prefix := chi.URLParam(req, "prefix")
+	apiKeys, err := listAccountApiKeys(ctx, c.accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing API keys for key %s: %v", c.prefix, err))
+		http.Error(res, "error when revoking api key", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	for _, entry := range apiKeys {
+		if entry.Prefix != prefix || entry.Expired(now) {
+			continue
+		}
+		if entry.ID != c.id && !c.apiKey.Scopes.IsZero() {
+			http.Error(res, "keys with scopes can only revoke themselves", http.StatusForbidden)
+			return
+		}
+		entry.Expires = now
+		if err = store.PutApiKey(ctx, entry.ID, entry.ApiKey); err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when revoking API key %s: %v", prefix, err))
+			http.Error(res, "error when revoking api key: "+prefix, http.StatusInternalServerError)
+			return
+		}
+		addAuditLogEntry(ctx, c.prefix, "revoke", entry.ID, map[string]string{"prefix": prefix})
+		writeJSON(res, req, http.StatusOK, toAccountApiKey(entry, c.id, now))
+		return
+	}
+	http.Error(res, "there is no api key with the prefix "+prefix+" in your account", http.StatusNotFound)
+}
+
+// newApiKeyFromRequest returns the name, expiry and scopes of a new key for
+// createApiKey. It writes the response and returns ok=false if they aren't
+// valid.
+func newApiKeyFromRequest(res http.ResponseWriter, body createAccountApiKeyRequest, allowAdmin bool) (template storage.ApiKey, ok bool) {
+	if len(body.Name) > maxNameLength {
+		http.Error(res, fmt.Sprintf("the name can't be longer than %d characters", maxNameLength), http.StatusBadRequest)
+		return template, false
+	}
+	template.Name = body.Name
+	if body.Expires != nil {
+		if !body.Expires.After(time.Now()) {
+			http.Error(res, "expires must be in the future", http.StatusBadRequest)
+			return template, false
+		}
+		template.Expires = *body.Expires
+	}
+	scopes, err := validateScopes(body.Scopes, allowAdmin)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return template, false
+	}
+	template.Scopes = scopes
+	return template, true
+}
+
+// getAccount returns the account of the key with the ID id. Keys created
+// before there were accounts are an account of their own, with the settings
+// stored on the key.
+func getAccount(ctx context.Context, id string, apiKey *storage.ApiKey) (accountID string, account *storage.Account, err error) {
+	if apiKey.Account == "" {
+		legacy := apiKey.LegacyAccount()
+		return id, &legacy, nil
+	}
+	ok, account, err := store.GetAccount(ctx, apiKey.Account)
+	if err != nil {
+		return "", nil, err
+	} else if !ok {
+		return "", nil, fmt.Errorf("the account %s doesn't exist", apiKey.Account)
+	}
+	return apiKey.Account, account, nil
+}
+
+// listAccountApiKeys returns the keys of the account. A key created before
+// there were accounts is the only key in its account.
+func listAccountApiKeys(ctx context.Context, accountID string) ([]storage.ApiKeyEntry, error) {
+	apiKeys, err := store.ListAccountApiKeys(ctx, accountID)
+	if err != nil || len(apiKeys) > 0 {
+		return apiKeys, err
+	}
+	ok, apiKey, err := store.GetApiKey(ctx, accountID)
+	if err != nil {
+		return nil, err
+	} else if ok && apiKey.Account == "" {
+		return []storage.ApiKeyEntry{{ID: accountID, ApiKey: *apiKey}}, nil
+	}
+	return nil, nil
+}
+
+// countActiveApiKeys counts the keys in the account that hasn't expired
+func countActiveApiKeys(ctx context.Context, accountID string) (int, error) {
+	apiKeys, err := listAccountApiKeys(ctx, accountID)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	active := 0
+	for _, entry := range apiKeys {
+		if !entry.Expired(now) {
+			active++
+		}
+	}
+	return active, nil
+}
+
+// storeAccount stores the account, and moves legacyKey to it if it is the
+// account of a key created before there were accounts. The account has the
+// ID of that key, so the usage of the key becomes the usage of the account.
+func storeAccount(ctx context.Context, id string, account storage.Account, legacyKey *storage.ApiKey) error {
+	if err := store.PutAccount(ctx, id, account); err != nil || legacyKey == nil {
+		return err
+	}
+	legacyKey.Account = id
+	legacyKey.Quota, legacyKey.RequestsPerMinute, legacyKey.Burst = 0, 0, 0
+	return store.PutApiKey(ctx, id, *legacyKey)
+}
+
+// createApiKey generates a key in the account with the name, expiry and
+// scopes of template, and stores it. If accountID is empty a new account is
+// created with the ID of the key. The key is only returned here, only the
+// hash is stored.
+func createApiKey(ctx context.Context, accountID string, account storage.Account, template storage.ApiKey) (key string, entry storage.ApiKeyEntry, err error) {
+	key, err = apikey.Generate()
+	if err != nil {
+		return "", entry, err
+	}
+	id := apikey.Hash(key)
+	if accountID == "" {
+		accountID = id
+		if err = store.PutAccount(ctx, accountID, account); err != nil {
+			return "", entry, err
+		}
+	}
+	apiKey := storage.ApiKey{
+		Email:   account.Email,
+		Name:    template.Name,
+		Created: time.Now(),
+		Prefix:  apikey.Prefix(key),
+		Account: accountID,
+		Expires: template.Expires,
+		Scopes:  template.Scopes,
+	}
+	if err = store.PutApiKey(ctx, id, apiKey); err != nil {
+		return "", entry, err
+	}
+	return key, storage.ApiKeyEntry{ID: id, ApiKey: apiKey}, nil
+}
+
+// rotateApiKey creates a key with the same name and scopes in the account of
+// apiKey, and makes apiKey expire after keyRotationGracePeriod. Keys that
+// already expire can't be rotated, that would replace them with a key that
+// never expires.
+func rotateApiKey(ctx context.Context, id string, apiKey *storage.ApiKey, account *storage.Account) (key string, entry storage.ApiKeyEntry, err error) {
+	if !apiKey.Expires.IsZero() {
+		return "", entry, ErrorKeyExpires
+	}
+	active, err := countActiveApiKeys(ctx, apiKey.AccountID(id))
+	if err != nil {
+		return "", entry, err
+	} else if active >= maxKeysPerAccount {
+		return "", entry, ErrorTooManyKeys
+	}
+	if apiKey.Account == "" {
+		if err = storeAccount(ctx, id, *account, apiKey); err != nil {
+			return "", entry, err
+		}
+	}
+	key, entry, err = createApiKey(ctx, apiKey.Account, *account, storage.ApiKey{Name: apiKey.Name, Scopes: apiKey.Scopes})
+	if err != nil {
+		return "", entry, err
+	}
+	apiKey.Expires = time.Now().Add(keyRotationGracePeriod)
+	return key, entry, store.PutApiKey(ctx, id, *apiKey)
+}
+
+// rotateDetails is what is stored in the audit log when old is rotated
+func rotateDetails(old *storage.ApiKey, rotated storage.ApiKeyEntry) map[string]string {
+	return map[string]string{
+		"prefix":     old.Prefix,
+		"expires":    old.Expires.Format(time.RFC3339),
+		"new_key":    rotated.ID,
+		"new_prefix": rotated.Prefix,
+	}
+}
@@ -0,0 +1,637 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/karl-gustav/power_price/apikey"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+const (
+	defaultAuditLogLimit = 100
+	maxAuditLogLimit     = 1000
+	// actorAdminToken is the actor in the audit log for changes made with
+	// ADMIN_TOKEN
+	actorAdminToken = "admin-token"
+)
+
+// ADMIN_TOKEN is the bearer token for the /admin endpoints, they are disabled
+// when it isn't set
+var ADMIN_TOKEN = os.Getenv("ADMIN_TOKEN")
+
+// defaultQuota is the daily quota per zone of the free plan
+var defaultQuota = getEnvInt("DEFAULT_QUOTA", 100)
+
+func adminRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(requireAdmin)
+	r.Get("/usage", adminUsageReportHandler)
+	r.Get("/usage/monthly", adminMonthlyUsageHandler)
+	r.Get("/plans", adminListPlansHandler)
+	r.Put("/plans/{name}", adminPutPlanHandler)
+	r.Get("/keys", adminListApiKeysHandler)
+	r.Post("/keys", adminCreateApiKeyHandler)
+	r.Get("/keys/{id}", adminGetApiKeyHandler)
+	r.Patch("/keys/{id}", adminUpdateApiKeyHandler)
+	r.Post("/keys/{id}/block", adminBlockApiKeyHandler)
+	r.Post("/keys/{id}/unblock", adminUnblockApiKeyHandler)
+	r.Post("/keys/{id}/rotate", adminRotateApiKeyHandler)
+	r.Get("/accounts/{id}", adminGetAccountHandler)
+	r.Patch("/accounts/{id}", adminUpdateAccountHandler)
+	r.Post("/accounts/{id}/block", adminBlockAccountHandler)
+	r.Post("/accounts/{id}/unblock", adminUnblockAccountHandler)
+	r.Post("/accounts/{id}/keys", adminCreateAccountApiKeyHandler)
+	r.Get("/audit-log", adminAuditLogHandler)
+	r.Post("/migrate-keys", adminMigrateApiKeysHandler)
+	r.Post("/revisions/check", adminCheckRevisionsHandler)
+	// the metrics tell how well the auth throttling works, so they are not
+	// for everyone
+	r.Handle("/debug/vars", expvar.Handler())
+	return r
+}
+
+// requireAdmin only lets requests with "Authorization: Bearer <ADMIN_TOKEN>"
+// through
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if ADMIN_TOKEN == "" {
+			http.Error(res, "the admin API is disabled", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(ADMIN_TOKEN)) == 1 {
+			next.ServeHTTP(res, req)
+			return
+		} else if ok && token != "" {
+			// API keys with the admin endpoint in their scopes can use the
+			// admin API too
+			requireApiKey(endpointAdmin)(next).ServeHTTP(res, req)
+			return
+		}
+		slog.WarnContext(req.Context(), "denied access to "+req.URL.Path+" because of invalid admin token")
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(res, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+	})
+}
+
+// createApiKeyRequest creates an account with one key, Name is the name of
+// both
+type createApiKeyRequest struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	// Plan is DEFAULT_PLAN if neither it nor Quota is set. An account with a
+	// quota and no plan has the quota and the rate limit that is set here.
+	Plan              string         `json:"plan"`
+	Quota             *int           `json:"quota"`
+	RequestsPerMinute int            `json:"requests_per_minute"`
+	Burst             int            `json:"burst"`
+	Expires           *time.Time     `json:"expires"`
+	Scopes            storage.Scopes `json:"scopes"`
+}
+
+// updateApiKeyRequest only changes the fields that are set, an expires of
+// 0001-01-01T00:00:00Z makes the key never expire
+type updateApiKeyRequest struct {
+	Name    *string         `json:"name"`
+	Expires *time.Time      `json:"expires"`
+	Scopes  *storage.Scopes `json:"scopes"`
+}
+
+// updateAccountRequest only changes the fields that are set. Quota,
+// RequestsPerMinute and Burst are only used when the plan is empty.
+type updateAccountRequest struct {
+	Name              *string `json:"name"`
+	Plan              *string `json:"plan"`
+	Quota             *int    `json:"quota"`
+	RequestsPerMinute *int    `json:"requests_per_minute"`
+	Burst             *int    `json:"burst"`
+}
+
+// createdApiKey is the only time the key is shown, only the hash is stored
+type createdApiKey struct {
+	Key string `json:"key"`
+	storage.ApiKeyEntry
+	Account *storage.Account `json:"account,omitempty"`
+}
+
+type accountEntry struct {
+	ID string `json:"id"`
+	storage.Account
+	Keys []storage.ApiKeyEntry `json:"keys"`
+}
+
+type blockApiKeyRequest struct {
+	Reason string `json:"reason"`
+}
+
+// adminListApiKeysHandler searches by the start of the email, and by the
+// prefix of the key for helping users that only has the prefix in an error
+// message
+func adminListApiKeysHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	apiKeys, err := store.ListApiKeys(ctx, normalizeEmail(req.URL.Query().Get("email")))
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing API keys: %v", err))
+		http.Error(res, "error when listing api keys", http.StatusInternalServerError)
+		return
+	}
+	found := []storage.ApiKeyEntry{}
+	prefix := req.URL.Query().Get("prefix")
+	for _, apiKey := range apiKeys {
+		if prefix == "" || apiKey.Prefix == prefix {
+			found = append(found, apiKey)
+		}
+	}
+	writeJSON(res, req, http.StatusOK, found)
+}
+
+// adminCreateApiKeyHandler creates an account with one key, more keys can be
+// added with adminCreateAccountApiKeyHandler
+func adminCreateApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	var body createApiKeyRequest
+	if !readJSON(res, req, &body) {
+		return
+	}
+	address, err := mail.ParseAddress(body.Email)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("%q is not a valid email", body.Email), http.StatusBadRequest)
+		return
+	}
+	body.Email = normalizeEmail(address.Address)
+	quota := 0
+	if body.Quota != nil {
+		quota = *body.Quota
+	} else if body.Plan == "" {
+		body.Plan = defaultPlan
+	}
+	if quota < 0 || body.RequestsPerMinute < 0 || body.Burst < 0 {
+		http.Error(res, "quota, requests_per_minute and burst can't be negative", http.StatusBadRequest)
+		return
+	} else if body.Plan != "" && (body.Quota != nil || body.RequestsPerMinute != 0 || body.Burst != 0) {
+		http.Error(res, "quota, requests_per_minute and burst can't be set for an account with a plan", http.StatusBadRequest)
+		return
+	}
+	if body.Plan != "" {
+		if err := validatePlanName(ctx, body.Plan); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	template, ok := newApiKeyFromRequest(res, createAccountApiKeyRequest{Name: body.Name, Expires: body.Expires, Scopes: body.Scopes}, true)
+	if !ok {
+		return
+	}
+	account := storage.Account{
+		Email:             body.Email,
+		Name:              body.Name,
+		Plan:              body.Plan,
+		Quota:             quota,
+		RequestsPerMinute: body.RequestsPerMinute,
+		Burst:             body.Burst,
+		Created:           time.Now(),
+	}
+	key, entry, err := createApiKey(ctx, "", account, template)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when creating API key for %s: %v", body.Email, err))
+		http.Error(res, "error when creating api key", http.StatusInternalServerError)
+		return
+	}
+	audit(req, "create", entry.ID, map[string]string{
+		"prefix": entry.Prefix,
+		"email":  account.Email,
+		"name":   account.Name,
+		"plan":   account.Plan,
+		"quota":  strconv.Itoa(account.Quota),
+		"scopes": fmt.Sprintf("%+v", entry.Scopes),
+	})
+	writeJSON(res, req, http.StatusCreated, createdApiKey{Key: key, ApiKeyEntry: entry, Account: &account})
+}
+
+func adminGetApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	id := chi.URLParam(req, "id")
+	apiKey, ok := getApiKeyForAdmin(res, req, id)
+	if !ok {
+		return
+	}
+	writeJSON(res, req, http.StatusOK, storage.ApiKeyEntry{ID: id, ApiKey: *apiKey})
+}
+
+func adminUpdateApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	var body updateApiKeyRequest
+	if !readJSON(res, req, &body) {
+		return
+	}
+	if body.Scopes != nil {
+		scopes, err := validateScopes(*body.Scopes, true)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body.Scopes = &scopes
+	}
+	updateApiKey(res, req, "update", func(apiKey *storage.ApiKey, details map[string]string) {
+		if body.Name != nil {
+			details["name"] = fmt.Sprintf("%s -> %s", apiKey.Name, *body.Name)
+			apiKey.Name = *body.Name
+		}
+		if body.Expires != nil {
+			details["expires"] = fmt.Sprintf("%s -> %s", apiKey.Expires.Format(time.RFC3339), body.Expires.Format(time.RFC3339))
+			apiKey.Expires = *body.Expires
+		}
+		if body.Scopes != nil {
+			details["scopes"] = fmt.Sprintf("%+v -> %+v", apiKey.Scopes, *body.Scopes)
+			apiKey.Scopes = *body.Scopes
+		}
+	})
+}
+
+// adminRotateApiKeyHandler creates a new key in the account of the key, the
+// old key keeps working for KEY_ROTATION_GRACE_PERIOD
+func adminRotateApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	apiKey, ok := getApiKeyForAdmin(res, req, id)
+	if !ok {
+		return
+	}
+	_, account, err := getAccount(ctx, id, apiKey)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting account for API key `%s`: %v", id, err))
+		http.Error(res, "error when rotating api key: "+id, http.StatusInternalServerError)
+		return
+	}
+	key, entry, err := rotateApiKey(ctx, id, apiKey, account)
+	if errors.Is(err, ErrorTooManyKeys) || errors.Is(err, ErrorKeyExpires) {
+		http.Error(res, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when rotating API key `%s`: %v", id, err))
+		http.Error(res, "error when rotating api key: "+id, http.StatusInternalServerError)
+		return
+	}
+	audit(req, "rotate", id, rotateDetails(apiKey, entry))
+	writeJSON(res, req, http.StatusCreated, createdApiKey{Key: key, ApiKeyEntry: entry})
+}
+
+// adminBlockApiKeyHandler blocks the key, the reason is shown to the user of
+// the key
+func adminBlockApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	var body blockApiKeyRequest
+	if !readJSON(res, req, &body) {
+		return
+	}
+	if strings.TrimSpace(body.Reason) == "" {
+		http.Error(res, "reason is a required field", http.StatusBadRequest)
+		return
+	}
+	updateApiKey(res, req, "block", func(apiKey *storage.ApiKey, details map[string]string) {
+		apiKey.Blocked = true
+		apiKey.Reason = body.Reason
+		details["reason"] = body.Reason
+	})
+}
+
+// adminUnblockApiKeyHandler takes an optional reason, it is only stored in
+// the audit log
+func adminUnblockApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	var body blockApiKeyRequest
+	if req.ContentLength != 0 && !readJSON(res, req, &body) {
+		return
+	}
+	updateApiKey(res, req, "unblock", func(apiKey *storage.ApiKey, details map[string]string) {
+		details["previous_reason"] = apiKey.Reason
+		if body.Reason != "" {
+			details["reason"] = body.Reason
+		}
+		apiKey.Blocked = false
+		apiKey.Reason = ""
+	})
+}
+
+func adminGetAccountHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	account, _, ok := getAccountForAdmin(res, req, id)
+	if !ok {
+		return
+	}
+	apiKeys, err := listAccountApiKeys(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing API keys for account `%s`: %v", id, err))
+		http.Error(res, "error when listing api keys for account: "+id, http.StatusInternalServerError)
+		return
+	}
+	writeJSON(res, req, http.StatusOK, accountEntry{ID: id, Account: *account, Keys: apiKeys})
+}
+
+func adminUpdateAccountHandler(res http.ResponseWriter, req *http.Request) {
+	var body updateAccountRequest
+	if !readJSON(res, req, &body) {
+		return
+	}
+	if body.Plan != nil && *body.Plan != "" {
+		if err := validatePlanName(req.Context(), *body.Plan); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, value := range []*int{body.Quota, body.RequestsPerMinute, body.Burst} {
+		if value != nil && *value < 0 {
+			http.Error(res, "quota, requests_per_minute and burst can't be negative", http.StatusBadRequest)
+			return
+		}
+	}
+	updateAccount(res, req, "update", func(account *storage.Account, details map[string]string) {
+		if body.Name != nil {
+			details["name"] = fmt.Sprintf("%s -> %s", account.Name, *body.Name)
+			account.Name = *body.Name
+		}
+		if body.Plan != nil {
+			details["plan"] = fmt.Sprintf("%s -> %s", account.Plan, *body.Plan)
+			account.Plan = *body.Plan
+		}
+		if body.Quota != nil {
+			details["quota"] = fmt.Sprintf("%d -> %d", account.Quota, *body.Quota)
+			account.Quota = *body.Quota
+		}
+		if body.RequestsPerMinute != nil {
+			details["requests_per_minute"] = fmt.Sprintf("%d -> %d", account.RequestsPerMinute, *body.RequestsPerMinute)
+			account.RequestsPerMinute = *body.RequestsPerMinute
+		}
+		if body.Burst != nil {
+			details["burst"] = fmt.Sprintf("%d -> %d", account.Burst, *body.Burst)
+			account.Burst = *body.Burst
+		}
+	})
+}
+
+// adminBlockAccountHandler blocks all keys of the account, the reason is
+// shown to the users of the keys
+func adminBlockAccountHandler(res http.ResponseWriter, req *http.Request) {
+	var body blockApiKeyRequest
+	if !readJSON(res, req, &body) {
+		return
+	}
+	if strings.TrimSpace(body.Reason) == "" {
+		http.Error(res, "reason is a required field", http.StatusBadRequest)
+		return
+	}
+	updateAccount(res, req, "block", func(account *storage.Account, details map[string]string) {
+		account.Blocked = true
+		account.Reason = body.Reason
+		details["reason"] = body.Reason
+	})
+}
+
+func adminUnblockAccountHandler(res http.ResponseWriter, req *http.Request) {
+	var body blockApiKeyRequest
+	if req.ContentLength != 0 && !readJSON(res, req, &body) {
+		return
+	}
+	updateAccount(res, req, "unblock", func(account *storage.Account, details map[string]string) {
+		details["previous_reason"] = account.Reason
+		if body.Reason != "" {
+			details["reason"] = body.Reason
+		}
+		account.Blocked = false
+		account.Reason = ""
+	})
+}
+
+// adminCreateAccountApiKeyHandler adds a key to an account, the key gets the
+// quota and the rate limit of the account
+func adminCreateAccountApiKeyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	var body createAccountApiKeyRequest
+	if !readJSON(res, req, &body) {
+		return
+	}
+	template, ok := newApiKeyFromRequest(res, body, true)
+	if !ok {
+		return
+	}
+	id := chi.URLParam(req, "id")
+	account, legacyKey, ok := getAccountForAdmin(res, req, id)
+	if !ok {
+		return
+	}
+	if legacyKey != nil {
+		if err := storeAccount(ctx, id, *account, legacyKey); err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when creating account `%s`: %v", id, err))
+			http.Error(res, "error when creating api key for account: "+id, http.StatusInternalServerError)
+			return
+		}
+	}
+	key, entry, err := createApiKey(ctx, id, *account, template)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when creating API key for account `%s`: %v", id, err))
+		http.Error(res, "error when creating api key for account: "+id, http.StatusInternalServerError)
+		return
+	}
+	audit(req, "create", entry.ID, map[string]string{
+		"prefix":  entry.Prefix,
+		"account": id,
+		"name":    entry.Name,
+	})
+	writeJSON(res, req, http.StatusCreated, createdApiKey{Key: key, ApiKeyEntry: entry})
+}
+
+func adminAuditLogHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	limit := defaultAuditLogLimit
+	if queryLimit := req.URL.Query().Get("limit"); queryLimit != "" {
+		var err error
+		if limit, err = strconv.Atoi(queryLimit); err != nil || limit < 1 || limit > maxAuditLogLimit {
+			http.Error(res, fmt.Sprintf("limit must be a number from 1 to %d", maxAuditLogLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := store.ListAuditLog(ctx, req.URL.Query().Get("key"), limit)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing the audit log: %v", err))
+		http.Error(res, "error when listing the audit log", http.StatusInternalServerError)
+		return
+	}
+	if entries == nil {
+		entries = []storage.AuditLogEntry{}
+	}
+	writeJSON(res, req, http.StatusOK, entries)
+}
+
+// updateApiKey runs update on the key with the ID in the URL and stores it.
+// update adds what was changed to details, it is stored in the audit log.
+func updateApiKey(res http.ResponseWriter, req *http.Request, action string, update func(apiKey *storage.ApiKey, details map[string]string)) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	apiKey, ok := getApiKeyForAdmin(res, req, id)
+	if !ok {
+		return
+	}
+	details := map[string]string{}
+	update(apiKey, details)
+	if err := store.PutApiKey(ctx, id, *apiKey); err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when updating API key `%s`: %v", id, err))
+		http.Error(res, "error when updating api key: "+id, http.StatusInternalServerError)
+		return
+	}
+	audit(req, action, id, details)
+	writeJSON(res, req, http.StatusOK, storage.ApiKeyEntry{ID: id, ApiKey: *apiKey})
+}
+
+// updateAccount runs update on the account with the ID in the URL and stores
+// it, like updateApiKey
+func updateAccount(res http.ResponseWriter, req *http.Request, action string, update func(account *storage.Account, details map[string]string)) {
+	ctx := req.Context()
+	id := chi.URLParam(req, "id")
+	account, legacyKey, ok := getAccountForAdmin(res, req, id)
+	if !ok {
+		return
+	}
+	details := map[string]string{}
+	update(account, details)
+	if err := storeAccount(ctx, id, *account, legacyKey); err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when updating account `%s`: %v", id, err))
+		http.Error(res, "error when updating account: "+id, http.StatusInternalServerError)
+		return
+	}
+	audit(req, action+"_account", id, details)
+	writeJSON(res, req, http.StatusOK, accountEntry{ID: id, Account: *account})
+}
+
+// getAccountForAdmin writes the response and returns ok=false if the account
+// doesn't exist. legacyKey is set if it is the account of a key created
+// before there were accounts, it isn't stored yet.
+func getAccountForAdmin(res http.ResponseWriter, req *http.Request, id string) (account *storage.Account, legacyKey *storage.ApiKey, ok bool) {
+	ctx := req.Context()
+	found, account, legacyKey, err := findAccount(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting account `%s`: %v", id, err))
+		http.Error(res, "error when getting account: "+id, http.StatusInternalServerError)
+		return nil, nil, false
+	} else if !found {
+		http.Error(res, "there is no account with the ID "+id, http.StatusNotFound)
+		return nil, nil, false
+	}
+	return account, legacyKey, true
+}
+
+// findAccount finds the account with the ID, legacyKey is set if it is the
+// account of a key created before there were accounts
+func findAccount(ctx context.Context, id string) (found bool, account *storage.Account, legacyKey *storage.ApiKey, err error) {
+	found, account, err = store.GetAccount(ctx, id)
+	if err != nil || found {
+		return found, account, nil, err
+	}
+	found, legacyKey, err = store.GetApiKey(ctx, id)
+	if err != nil || !found || legacyKey.Account != "" {
+		return false, nil, nil, err
+	}
+	legacy := legacyKey.LegacyAccount()
+	return true, &legacy, legacyKey, nil
+}
+
+// getApiKeyForAdmin writes the response and returns ok=false if the key
+// doesn't exist
+func getApiKeyForAdmin(res http.ResponseWriter, req *http.Request, id string) (apiKey *storage.ApiKey, ok bool) {
+	ctx := req.Context()
+	found, apiKey, err := store.GetApiKey(ctx, id)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting API key `%s`: %v", id, err))
+		http.Error(res, "error when getting api key: "+id, http.StatusInternalServerError)
+		return nil, false
+	} else if !found {
+		http.Error(res, "there is no api key with the ID "+id, http.StatusNotFound)
+		return nil, false
+	}
+	return apiKey, true
+}
+
+// adminMigrateApiKeysHandler moves all keys that are stored in plain text,
+// and their usage, to being stored by their hash. It can be run again if it
+// fails, and when it is done MIGRATE_LEGACY_API_KEYS can be set to false.
+func adminMigrateApiKeysHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	legacyKeys, err := store.ListLegacyApiKeys(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing legacy API keys: %v", err))
+		http.Error(res, "error when listing legacy api keys", http.StatusInternalServerError)
+		return
+	}
+	migrated := 0
+	for _, key := range legacyKeys {
+		id, prefix := apikey.Hash(key), apikey.Prefix(key)
+		ok, err := store.MigrateApiKey(ctx, key, id, prefix)
+		if err == nil {
+			forgetUnknownKey(id)
+			err = store.MigrateUsage(ctx, key, id)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when migrating API key %s: %v", prefix, err))
+			http.Error(res, fmt.Sprintf("error when migrating api key %s, %d keys was migrated", prefix, migrated), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			audit(req, "migrate", id, map[string]string{"prefix": prefix})
+		}
+		migrated++
+	}
+	writeJSON(res, req, http.StatusOK, map[string]int{"migrated": migrated})
+}
+
+// adminCheckRevisionsHandler checks for corrected prices once, it is meant to
+// be called by a scheduler such as Cloud Scheduler
+func adminCheckRevisionsHandler(res http.ResponseWriter, req *http.Request) {
+	replaced := checkRecentRevisions(req.Context(), revisionCheckDays)
+	writeJSON(res, req, http.StatusOK, map[string]int{"replaced": replaced})
+}
+
+// audit stores what an admin did in the audit log. The actor is the prefix of
+// the API key that was used, or admin-token for ADMIN_TOKEN. Everyone shares
+// ADMIN_TOKEN, so the X-Admin-User header is stored as claimed_admin_user, but
+// anyone with the token can claim to be anyone. Admins that must be told apart
+// should use API keys with the admin scope.
+func audit(req *http.Request, action, key string, details map[string]string) {
+	actor := actorAdminToken
+	if c := callerFrom(req.Context()); c.apiKey != nil {
+		actor = c.prefix
+	}
+	if claimed := req.Header.Get("X-Admin-User"); claimed != "" {
+		details = maps.Clone(details)
+		if details == nil {
+			details = map[string]string{}
+		}
+		details["claimed_admin_user"] = claimed
+	}
+	addAuditLogEntry(req.Context(), actor, action, key, details)
+}
+
+// addAuditLogEntry is called after the change is made, so if the audit log
+// can't be stored the entry is logged instead
+func addAuditLogEntry(ctx context.Context, actor, action, key string, details map[string]string) {
+	entry := storage.AuditLogEntry{
+		Time:    time.Now(),
+		Actor:   actor,
+		Action:  action,
+		Key:     key,
+		Details: details,
+	}
+	if err := store.AddAuditLogEntry(ctx, entry); err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when storing audit log entry %+v: %v", entry, err))
+		return
+	}
+	slog.InfoContext(ctx, fmt.Sprintf("%s did %s on API key %s: %v", actor, action, key, details))
+}
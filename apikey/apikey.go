@@ -0,0 +1,68 @@
+// Package apikey generates API keys and hashes them, so the keys can't be
+// read from the database. Only the prefix of a key is meant to be logged.
+package apikey
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"regexp"
+	"strings"
+)
+
+// A key is "<prefix>.<secret>", the prefix isn't secret and is used to
+// find the key in logs and when helping users
+const (
+	prefixLength = 8
+	separator    = "."
+)
+
+var secret []byte
+
+// legacyKeyRegexp matches the keys from before they had a prefix. They are
+// looked up as Firestore document IDs when they are migrated, so nothing else
+// may get that far.
+var legacyKeyRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{7,63}$`)
+
+var prefixEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// SetSecret sets the secret for the HMAC in Hash. Changing it makes all
+// stored keys invalid, so it is meant to be called once on startup.
+func SetSecret(s []byte) {
+	secret = s
+}
+
+// Generate returns a new key with 192 secret bits
+func Generate() (string, error) {
+	random := make([]byte, 5+24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return prefixEncoding.EncodeToString(random[:5]) + separator + base64.RawURLEncoding.EncodeToString(random[5:]), nil
+}
+
+// Prefix returns the part of the key that can be logged. Keys from before
+// they had a prefix gets the first 4 characters, so they can still be
+// recognized.
+func Prefix(key string) string {
+	if prefix, _, ok := strings.Cut(key, separator); ok && len(prefix) == prefixLength {
+		return prefix
+	}
+	return key[:min(len(key), 4)] + "…"
+}
+
+// IsLegacy returns true if the key can be a key from before they had a
+// prefix, 8 to 64 letters, digits, dashes and underscores
+func IsLegacy(key string) bool {
+	return legacyKeyRegexp.MatchString(key)
+}
+
+// Hash is what the key is stored as, a hex encoded HMAC-SHA256
+func Hash(key string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,66 @@
+package apikey
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	key, err := Generate()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	other, _ := Generate()
+	if key == other {
+		t.Errorf("expected two different keys, got %s twice", key)
+	}
+	prefix := Prefix(key)
+	if len(prefix) != prefixLength || !strings.HasPrefix(key, prefix+".") {
+		t.Errorf("expected %s to start with an %d character prefix, got %s", key, prefixLength, prefix)
+	}
+	if len(key) != prefixLength+1+32 {
+		t.Errorf("expected a key of %d characters, got %s", prefixLength+1+32, key)
+	}
+}
+
+func TestPrefixOfLegacyKeys(t *testing.T) {
+	for key, expected := range map[string]string{
+		"0123456789abcdef": "0123…",
+		"abc":              "abc…",
+		"a.b":              "a.b…",
+	} {
+		if prefix := Prefix(key); prefix != expected {
+			t.Errorf("expected the prefix of %s to be %s, got %s", key, expected, prefix)
+		}
+	}
+}
+
+func TestIsLegacy(t *testing.T) {
+	for key, expected := range map[string]bool{
+		"0123456789abcdef":      true,
+		"legacy_key-1":          true,
+		"short":                 false,
+		"api-keys/users":        false,
+		"../legacy":             false,
+		"__legacy__":            false,
+		"abcdefgh.secretsecret": false,
+		strings.Repeat("a", 65): false,
+	} {
+		if IsLegacy(key) != expected {
+			t.Errorf("expected IsLegacy(%q) to be %t", key, expected)
+		}
+	}
+}
+
+func TestHash(t *testing.T) {
+	SetSecret([]byte("secret"))
+	t.Cleanup(func() { SetSecret(nil) })
+	hash := Hash("key")
+	if len(hash) != 64 || hash != Hash("key") {
+		t.Errorf("expected the same 64 character hash every time, got %s", hash)
+	}
+	SetSecret([]byte("other secret"))
+	if Hash("key") == hash {
+		t.Errorf("expected the hash to depend on the secret")
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karl-gustav/power_price/apikey"
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/ratelimit"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+// caller is the API key a request is made with
+type caller struct {
+	// id is the hash of the key, it is what the key is stored as
+	id string
+	// prefix is the part of the key that can be logged
+	prefix string
+	apiKey *storage.ApiKey
+	// accountID is what the usage is stored as, the quota is per account
+	accountID string
+	account   *storage.Account
+	// plan is the quota and the limits of the account
+	plan storage.Plan
+	// rateLimit is per key
+	rateLimit ratelimit.Result
+}
+
+// migrateLegacyApiKeys makes keys that are stored in plain text work, they
+// are migrated to being stored by their hash the first time they are used. It
+// is off unless MIGRATE_LEGACY_API_KEYS is true, POST /admin/migrate-keys
+// migrates all of them at once.
+var migrateLegacyApiKeys = os.Getenv("MIGRATE_LEGACY_API_KEYS") == "true"
+
+// authenticate checks the API key and the rate limit for the key. If the
+// request isn't allowed the response is written and ok is false.
+func authenticate(res http.ResponseWriter, req *http.Request) (c caller, ok bool) {
+	ctx := req.Context()
+	ip := clientIP(req)
+	if retryAfter, banned := bannedIPs.expiresIn(ip); banned {
+		authBannedRequests.Add(1)
+		res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		p := newProblem(http.StatusTooManyRequests, codeTooManyAuthFailures, "too many requests without a valid API key, try again later")
+		p.RetryAfter = int(math.Ceil(retryAfter.Seconds()))
+		writeProblem(res, req, p)
+		return c, false
+	}
+	key, source, err := apiKeyFromRequest(req)
+	if err != nil {
+		authFailed(ctx, ip)
+		writeProblem(res, req, newProblem(http.StatusUnauthorized, codeInvalidApiKey, err.Error()))
+		return c, false
+	} else if key == "" {
+		authFailed(ctx, ip)
+		m := "an API key is required, send it in the \"Authorization: Bearer <key>\" header\n" + missingKeyMessage
+		writeProblem(res, req, missingKeyProblem(codeMissingApiKey, m))
+		return c, false
+	}
+	if source == keySourceQuery {
+		res.Header().Set("Deprecation", "true")
+		res.Header().Set("Warning", `299 - "the key query parameter is deprecated, use the Authorization: Bearer <key> header"`)
+	}
+	c.id, c.prefix = apikey.Hash(key), apikey.Prefix(key)
+	// unknown keys are checked before the rate limit, so random keys don't
+	// fill up keyRateLimits
+	if isUnknownKey(c.id) {
+		authFailed(ctx, ip)
+		m := fmt.Sprintf("the key you supplied is not in our systems: %s\n%s", c.prefix, missingKeyMessage)
+		writeProblem(res, req, missingKeyProblem(codeInvalidApiKey, m))
+		return c, false
+	}
+	c.rateLimit = keyRateLimits.Allow(c.id)
+	if !c.rateLimit.Allowed {
+		slog.WarnContext(ctx, fmt.Sprintf("rate limited %s to %d requests per minute", c.prefix, c.rateLimit.RequestsPerMinute))
+		c.rateLimit.SetHeaders(res.Header())
+		m := fmt.Sprintf(
+			"too many requests, the limit is %d requests per minute (with bursts of %d requests)",
+			c.rateLimit.RequestsPerMinute,
+			c.rateLimit.Burst,
+		)
+		p := newProblem(http.StatusTooManyRequests, codeRateLimited, m)
+		p.RetryAfter = int(math.Ceil(c.rateLimit.RetryAfter.Seconds()))
+		writeProblem(res, req, p)
+		return c, false
+	}
+	found, apiKey, err := getApiKey(ctx, key, c.id, c.prefix)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting API key for key %s: %v", c.prefix, err))
+		writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when verifying api key: "+c.prefix))
+		return c, false
+	} else if !found {
+		rememberUnknownKey(c.id)
+		authFailed(ctx, ip)
+		slog.WarnContext(ctx, fmt.Sprintf("denied %s access to server because of key was not found", c.prefix))
+		m := fmt.Sprintf("the key you supplied is not in our systems: %s\n%s", c.prefix, missingKeyMessage)
+		writeProblem(res, req, missingKeyProblem(codeInvalidApiKey, m))
+		return c, false
+	} else if apiKey.Expired(time.Now()) {
+		slog.WarnContext(ctx, fmt.Sprintf("denied %s (%s) access to server because the key expired at %s", apiKey.Email, c.prefix, apiKey.Expires))
+		m := fmt.Sprintf("the key %s expired at %s", c.prefix, apiKey.Expires.In(common.Loc).Format(time.RFC3339))
+		writeProblem(res, req, newProblem(http.StatusUnauthorized, codeKeyExpired, m))
+		return c, false
+	}
+	c.accountID, c.account, err = getAccount(ctx, c.id, apiKey)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting account for key %s: %v", c.prefix, err))
+		writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when verifying api key: "+c.prefix))
+		return c, false
+	}
+	for _, blocked := range []struct {
+		blocked bool
+		reason  string
+	}{{apiKey.Blocked, apiKey.Reason}, {c.account.Blocked, c.account.Reason}} {
+		if blocked.blocked {
+			slog.WarnContext(ctx, fmt.Sprintf("denied %s (%s) access to server because of %s", apiKey.Email, c.prefix, blocked.reason))
+			writeProblem(res, req, newProblem(http.StatusForbidden, codeKeyBlocked, "You have lost access to server: "+blocked.reason))
+			return c, false
+		}
+	}
+	if c.plan, err = accountPlan(ctx, c.account); err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting the plan for key %s: %v", c.prefix, err))
+		writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when verifying api key: "+c.prefix))
+		return c, false
+	}
+	keyRateLimits.SetLimit(c.id, c.plan.RequestsPerMinute, c.plan.Burst)
+	c.apiKey = apiKey
+	return c, true
+}
+
+// missingKeyProblem is a 401 with a link to the signup
+func missingKeyProblem(code, detail string) problem {
+	p := newProblem(http.StatusUnauthorized, code, detail)
+	p.SignupURL = strings.TrimSuffix(PUBLIC_URL, "/") + "/signup"
+	return p
+}
+
+const (
+	keySourceAuthorization = "Authorization"
+	keySourceHeader        = "X-API-Key"
+	keySourceQuery         = "key"
+)
+
+// ErrorUnsupportedAuthorization is returned for an Authorization header that
+// isn't a bearer token
+var ErrorUnsupportedAuthorization = errors.New("the Authorization header must be \"Bearer <key>\"")
+
+// apiKeyFromRequest gets the API key from the first of the Authorization
+// header, the X-API-Key header and the key query parameter that is set, and
+// where it was found
+func apiKeyFromRequest(req *http.Request) (key, source string, err error) {
+	if authorization := req.Header.Get("Authorization"); authorization != "" {
+		scheme, token, _ := strings.Cut(authorization, " ")
+		token = strings.TrimSpace(token)
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			return "", keySourceAuthorization, ErrorUnsupportedAuthorization
+		}
+		return token, keySourceAuthorization, nil
+	}
+	if key := req.Header.Get("X-API-Key"); key != "" {
+		return key, keySourceHeader, nil
+	}
+	return req.URL.Query().Get("key"), keySourceQuery, nil
+}
+
+// allowCORS lets browsers on other sites call the API and read the headers
+// that the responses have. allowOrigins narrows it for keys with origins.
+func allowCORS(header http.Header) {
+	header.Set("Access-Control-Allow-Origin", "*")
+	header.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+}
+
+var exposedHeaders = []string{
+	"RateLimit-Limit",
+	"RateLimit-Remaining",
+	"RateLimit-Reset",
+	"RateLimit-Policy",
+	"Retry-After",
+	"X-Provisional",
+	"X-Playground",
+	"X-Price-Revision",
+	"X-Price-Created",
+	"Deprecation",
+	"Warning",
+}
+
+// cors is allowCORS for all responses, including the errors from
+// requireApiKey
+func cors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		allowCORS(res.Header())
+		next.ServeHTTP(res, req)
+	})
+}
+
+// corsPreflightHandler answers the OPTIONS request browsers send before
+// requests with the Authorization or X-API-Key header. The key isn't a
+// cookie, so it is fine to allow all origins, and the preflight doesn't have
+// the key so the origins of the key aren't known yet.
+func corsPreflightHandler(res http.ResponseWriter, req *http.Request) {
+	header := res.Header()
+	allowCORS(header)
+	header.Set("Access-Control-Allow-Methods", "GET, OPTIONS")
+	header.Set("Access-Control-Allow-Headers", "Authorization, X-API-Key")
+	header.Set("Access-Control-Max-Age", "86400")
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// getApiKey gets the key by its hash, and migrates it if it is stored in
+// plain text. The key is the ID of the legacy document, so only keys that
+// look like legacy keys are looked up.
+func getApiKey(ctx context.Context, key, id, prefix string) (ok bool, apiKey *storage.ApiKey, err error) {
+	ok, apiKey, err = store.GetApiKey(ctx, id)
+	if ok || err != nil || !migrateLegacyApiKeys || !apikey.IsLegacy(key) {
+		return ok, apiKey, err
+	}
+	migrated, err := store.MigrateApiKey(ctx, key, id, prefix)
+	if err != nil {
+		return false, nil, err
+	} else if migrated {
+		slog.InfoContext(ctx, fmt.Sprintf("migrated API key %s to be stored by its hash", prefix))
+	}
+	// another request might have migrated it
+	return store.GetApiKey(ctx, id)
+}
+
+// randomToken returns 192 random bits, URL safe
+func randomToken() (string, error) {
+	random := make([]byte, 24)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(random), nil
+}
+
+// trustedProxyHops is how many proxies in front of us add to X-Forwarded-For.
+// The default is Cloud Run without a load balancer, where the Google Front
+// End adds the client. Behind a Google external Application Load Balancer it
+// is 2, since the load balancer adds "<client>, <load balancer>". 0 ignores
+// the header and uses the address of the connection.
+var trustedProxyHops = getEnvInt("TRUSTED_PROXY_HOPS", 1)
+
+// clientIP is the address in X-Forwarded-For that is trustedProxyHops from
+// the right, the one our outermost proxy added. The addresses before it are
+// set by the client, so they can't be used for rate limits and bans.
+func clientIP(req *http.Request) string {
+	if forwardedFor := req.Header.Get("X-Forwarded-For"); forwardedFor != "" && trustedProxyHops > 0 {
+		addresses := strings.Split(forwardedFor, ",")
+		// fewer addresses than hops means that the request didn't go through
+		// all the proxies, the first address is as close as we get
+		return strings.TrimSpace(addresses[max(len(addresses)-trustedProxyHops, 0)])
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
@@ -15,10 +15,27 @@ import (
 )
 
 const (
-	priceURL         = "https://web-api.tp.entsoe.eu/api?documentType=A44&in_Domain=%s&out_Domain=%s&periodStart=%s&periodEnd=%s&securityToken=%s"
+	DefaultBaseURL   = "https://web-api.tp.entsoe.eu/api"
+	priceURL         = "%s?documentType=A44&in_Domain=%s&out_Domain=%s&periodStart=%s&periodEnd=%s&securityToken=%s"
 	entsoeDateFormat = "200601021504"
 )
 
+var baseURL = DefaultBaseURL
+
+// SetBaseURL changes where the ENTSO-E API is, e.g. to use a local stand-in.
+// It is meant to be called on startup, before any requests are made.
+func SetBaseURL(url string) {
+	baseURL = url
+}
+
+var entsoeBreaker = common.NewCircuitBreaker("transparency.entsoe.eu", common.DefaultFailureThreshold, common.DefaultOpenTime)
+
+// SetCircuitBreaker replaces the circuit breaker for requests to the ENTSO-E
+// API. It is meant to be called on startup, before any requests are made.
+func SetCircuitBreaker(failureThreshold int, openTime time.Duration) {
+	entsoeBreaker = common.NewCircuitBreaker("transparency.entsoe.eu", failureThreshold, openTime)
+}
+
 var ErrorPricesNotAvialableYet = errors.New(`The prices was not found on the transparency.entsoe.eu server.
 Try again later or check https://transparency.entsoe.eu/news/widget if there are any delays.`)
 
@@ -29,6 +46,9 @@ type PricePoint struct {
 	ExchangeRateDate string    `json:"exchange_rate_date" firestore:"ExchangeRateDate"`
 	From             time.Time `json:"valid_from" firestore:"From"`
 	To               time.Time `json:"valid_to" firestore:"To"`
+	// Provisional is set when the price is calculated with the last known
+	// exchange rate because Norges Bank was unavailable
+	Provisional bool `json:"provisional,omitempty" firestore:"Provisional,omitempty"`
 }
 
 // not using a pointer here because this is used as a value type in a map
@@ -82,6 +102,7 @@ func CalculatePriceForcast(ctx context.Context, powerPrices PublicationMarketDoc
 			ExchangeRateDate: exchangeRate.Date,
 			From:             startOfPeriod,
 			To:               endOfPeriod,
+			Provisional:      exchangeRate.Provisional,
 		}
 	}
 	return priceForecast
@@ -91,13 +112,25 @@ func GetPrice(ctx context.Context, zone Zone, date time.Time, token string) (*Pu
 	endDate := date.Add(24 * time.Hour)
 	url := fmt.Sprintf(
 		priceURL,
+		baseURL,
 		zone,
 		zone,
 		date.In(time.UTC).Format(entsoeDateFormat),
 		endDate.In(time.UTC).Format(entsoeDateFormat),
 		token,
 	)
-	priceBody, err := common.GetUrl(ctx, url, token)
+	// an open circuit fails fast, without waiting for and using up a token
+	if err := entsoeBreaker.Check(); err != nil {
+		return nil, err
+	}
+	if err := waitForToken(ctx); err != nil {
+		return nil, err
+	}
+	var priceBody []byte
+	err := entsoeBreaker.Do(func() (err error) {
+		priceBody, err = common.GetUrl(ctx, url, token)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -3,21 +3,30 @@ package calculator
 import (
 	"context"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/karl-gustav/power_price/common"
 	"github.com/karl-gustav/power_price/currency"
+	"github.com/karl-gustav/power_price/upstreamtest"
 )
 
 var exchangeRate = currency.ExchangeRate{
 	Rate: 1,
 }
 
+// the ENTSO-E documents are the ones the stand-in serves, it can only embed
+// files in its own directory
+const testdata = "../upstreamtest/testdata/entsoe"
+
 func Test60m(t *testing.T) {
 	prices := []float64{47.14, 40.6, 40.64, 40.75, 41.16, 50.12, 122.94, 200.98, 224, 193.92, 173.51, 167.58, 160.22, 165.07, 174.7, 189.99, 193.27, 202.93, 175.19, 162.23, 129.99, 123.82, 103.58, 58.51}
-	xmlData, err := os.ReadFile("./testdata/60m.xml")
+	xmlData, err := os.ReadFile(testdata + "/60m.xml")
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -54,7 +63,7 @@ func Test60m(t *testing.T) {
 
 func Test15m(t *testing.T) {
 	prices := []float64{48.74, 48.66, 48.58, 48.56, 48.64, 48.84, 49.5, 49.92, 50.81, 51.79, 51.25, 50.58, 48.27, 47.41, 47.44, 49.14, 51.15, 55.02, 54.85, 53.46, 51.13, 49.74, 48.83, 47.39}
-	xmlData, err := os.ReadFile("./testdata/15m.xml")
+	xmlData, err := os.ReadFile(testdata + "/15m.xml")
 	if err != nil {
 		t.Errorf("unexpected error %v", err)
 	}
@@ -88,3 +97,33 @@ func Test15m(t *testing.T) {
 		}
 	}
 }
+
+func TestGetPriceFromStandin(t *testing.T) {
+	server := upstreamtest.NewServer()
+	defer server.Close()
+	SetBaseURL(server.EntsoeURL)
+	defer SetBaseURL(DefaultBaseURL)
+
+	date := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	powerPrices, err := GetPrice(context.Background(), Zones["NO2"], date, "token")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(powerPrices.TimeSeries.Period.Point) != 24 {
+		t.Errorf("expected 24 price points, got %d", len(powerPrices.TimeSeries.Period.Point))
+	}
+
+	_, err = GetPrice(context.Background(), Zones["NO2"], date.AddDate(0, 0, 1), "token")
+	if !errors.Is(err, ErrorPricesNotAvialableYet) {
+		t.Errorf("expected ErrorPricesNotAvialableYet, got %v", err)
+	}
+
+	_, err = GetPrice(context.Background(), Zones["NO2"], date, upstreamtest.InvalidToken)
+	var httpErr *common.HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 error, got %v", err)
+	}
+	if strings.Contains(err.Error(), upstreamtest.InvalidToken) {
+		t.Errorf("expected security token to be removed from error: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+package calculator
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ENTSO-E allows 400 requests per minute per security token and bans tokens
+// that go over, so we stay a bit below that by default.
+const (
+	DefaultRequestsPerMinute = 300
+	DefaultBurst             = 10
+	DefaultMaxQueueTime      = 10 * time.Second
+)
+
+var (
+	limiter      = rate.NewLimiter(perMinute(DefaultRequestsPerMinute), DefaultBurst)
+	maxQueueTime = DefaultMaxQueueTime
+)
+
+// RateLimitError is returned by GetPrice when the request budget for the
+// ENTSO-E API is used up and the request could not be queued long enough to
+// get a new token.
+type RateLimitError struct {
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("too many requests to transparency.entsoe.eu, try again in %s", e.RetryAfter.Round(time.Second))
+}
+
+// SetRateLimit replaces the limiter for requests to the ENTSO-E API. Requests
+// that can't get a token within maxQueue fail with a RateLimitError. It is
+// meant to be called on startup, before any requests are made.
+func SetRateLimit(requestsPerMinute, burst int, maxQueue time.Duration) {
+	limiter = rate.NewLimiter(perMinute(requestsPerMinute), burst)
+	maxQueueTime = maxQueue
+}
+
+func perMinute(requests int) rate.Limit {
+	return rate.Limit(float64(requests) / 60)
+}
+
+// waitForToken blocks until the limiter allows another request, or returns a
+// RateLimitError straight away if the wait would exceed the max queue time or
+// the deadline of the context.
+func waitForToken(ctx context.Context) error {
+	reservation := limiter.Reserve()
+	if !reservation.OK() {
+		return &RateLimitError{RetryAfter: time.Minute}
+	}
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	deadline, hasDeadline := ctx.Deadline()
+	if delay > maxQueueTime || (hasDeadline && time.Until(deadline) < delay) {
+		reservation.Cancel()
+		return &RateLimitError{RetryAfter: delay}
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,76 @@
+package calculator
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/karl-gustav/power_price/common"
+)
+
+func TestWaitForTokenQueuesWithinMaxQueueTime(t *testing.T) {
+	SetRateLimit(600, 1, time.Second) // one token every 100ms
+	defer SetRateLimit(DefaultRequestsPerMinute, DefaultBurst, DefaultMaxQueueTime)
+
+	start := time.Now()
+	for range 3 {
+		if err := waitForToken(context.Background()); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("expected requests to be queued, but 3 tokens took only %s", elapsed)
+	}
+}
+
+func TestWaitForTokenFailsWhenQueueIsTooLong(t *testing.T) {
+	SetRateLimit(1, 1, time.Second)
+	defer SetRateLimit(DefaultRequestsPerMinute, DefaultBurst, DefaultMaxQueueTime)
+
+	if err := waitForToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	err := waitForToken(context.Background())
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("expected a RateLimitError, got %v", err)
+	}
+	if rateLimitErr.RetryAfter < 50*time.Second {
+		t.Errorf("expected retry after to be close to a minute, was %s", rateLimitErr.RetryAfter)
+	}
+}
+
+func TestWaitForTokenRespectsContextDeadline(t *testing.T) {
+	SetRateLimit(60, 1, time.Minute)
+	defer SetRateLimit(DefaultRequestsPerMinute, DefaultBurst, DefaultMaxQueueTime)
+
+	if err := waitForToken(context.Background()); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	var rateLimitErr *RateLimitError
+	if err := waitForToken(ctx); !errors.As(err, &rateLimitErr) {
+		t.Fatalf("expected a RateLimitError, got %v", err)
+	}
+}
+
+func TestOpenCircuitDoesNotUseTokens(t *testing.T) {
+	SetRateLimit(1, 1, time.Second)
+	defer SetRateLimit(DefaultRequestsPerMinute, DefaultBurst, DefaultMaxQueueTime)
+	SetCircuitBreaker(1, time.Minute)
+	defer SetCircuitBreaker(common.DefaultFailureThreshold, common.DefaultOpenTime)
+	entsoeBreaker.Do(func() error { return errors.New("upstream error") })
+
+	var circuitOpenErr *common.CircuitOpenError
+	for range 3 {
+		_, err := GetPrice(context.Background(), Zones["NO2"], time.Now(), "token")
+		if !errors.As(err, &circuitOpenErr) {
+			t.Fatalf("expected the circuit to be open, got %v", err)
+		}
+	}
+	if err := waitForToken(context.Background()); err != nil {
+		t.Errorf("expected the token to be left, got %v", err)
+	}
+}
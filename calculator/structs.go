@@ -2,6 +2,7 @@ package calculator
 
 import (
 	"encoding/xml"
+	"strconv"
 	"time"
 )
 
@@ -75,6 +76,13 @@ type PublicationMarketDocument struct {
 	} `xml:"TimeSeries"`
 }
 
+// Revision returns the revisionNumber of the document, ENTSO-E republishes
+// the document with a higher revision when prices are corrected.
+func (p PublicationMarketDocument) Revision() int {
+	revision, _ := strconv.Atoi(p.RevisionNumber)
+	return revision
+}
+
 type AcknowledgementMarketDocument struct {
 	MRID                                    string `json:"mRID"`
 	CreatedDateTime                         string `json:"createdDateTime"`
@@ -0,0 +1,30 @@
+// Command upstream-standin serves the ENTSO-E and Norges Bank stand-ins from
+// the upstreamtest package, so the service can be run without internet access:
+//
+//	go run ./cmd/upstream-standin &
+//	ENTSOE_URL=http://localhost:8081/entsoe/api \
+//	NORGES_BANK_URL=http://localhost:8081/norges-bank/api/data \
+//	SECURITY_TOKEN=standin go run .
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/karl-gustav/power_price/upstreamtest"
+)
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8081"
+	}
+	handler, err := upstreamtest.NewHandler()
+	if err != nil {
+		panic(err)
+	}
+	slog.Info("Serving ENTSO-E at http://localhost:" + port + upstreamtest.EntsoePath)
+	slog.Info("Serving Norges Bank at http://localhost:" + port + upstreamtest.NorgesBankPath)
+	slog.Error(http.ListenAndServe(":"+port, handler).Error())
+}
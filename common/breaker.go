@@ -0,0 +1,137 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultFailureThreshold = 5
+	DefaultOpenTime         = 30 * time.Second
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+// CircuitOpenError is returned by CircuitBreaker.Do when the upstream has
+// failed too many times in a row and isn't called at all.
+type CircuitOpenError struct {
+	Upstream   string
+	RetryAfter time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("%s is not responding, try again in %s", e.Upstream, e.RetryAfter.Round(time.Second))
+}
+
+// CircuitBreaker stops calling an upstream after failureThreshold failures in
+// a row. After openTime it lets one request through (half open), and closes
+// again if that request succeeds.
+type CircuitBreaker struct {
+	upstream         string
+	failureThreshold int
+	openTime         time.Duration
+
+	mu       sync.Mutex
+	state    circuitState
+	failures int
+	openedAt time.Time
+}
+
+func NewCircuitBreaker(upstream string, failureThreshold int, openTime time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		upstream:         upstream,
+		failureThreshold: failureThreshold,
+		openTime:         openTime,
+	}
+}
+
+// Do calls fn unless the circuit is open. Errors from fn that are caused by
+// the request (4xx responses other than 429) doesn't count as failures.
+func (b *CircuitBreaker) Do(fn func() error) error {
+	if err := b.allow(); err != nil {
+		return err
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+// Check returns a CircuitOpenError if Do wouldn't call the upstream right
+// now, without letting a test request through. It is for skipping work that
+// is only needed before a call, e.g. waiting for a rate limit token.
+func (b *CircuitBreaker) Check() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if sinceOpened := time.Since(b.openedAt); sinceOpened < b.openTime {
+			return &CircuitOpenError{Upstream: b.upstream, RetryAfter: b.openTime - sinceOpened}
+		}
+		return nil
+	case circuitHalfOpen:
+		return &CircuitOpenError{Upstream: b.upstream, RetryAfter: time.Second}
+	default:
+		return nil
+	}
+}
+
+func (b *CircuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		sinceOpened := time.Since(b.openedAt)
+		if sinceOpened < b.openTime {
+			return &CircuitOpenError{Upstream: b.upstream, RetryAfter: b.openTime - sinceOpened}
+		}
+		// let this request through to test if the upstream is back
+		b.state = circuitHalfOpen
+		return nil
+	case circuitHalfOpen:
+		return &CircuitOpenError{Upstream: b.upstream, RetryAfter: time.Second}
+	default:
+		return nil
+	}
+}
+
+func (b *CircuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !countsAsFailure(err) {
+		if b.state != circuitClosed {
+			slog.Info(fmt.Sprintf("circuit for %s closed, upstream is responding again", b.upstream))
+		}
+		b.state = circuitClosed
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.state == circuitHalfOpen || b.failures >= b.failureThreshold {
+		if b.state != circuitOpen {
+			slog.Warn(fmt.Sprintf("circuit for %s opened after %d failures in a row: %v", b.upstream, b.failures, err))
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func countsAsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500 || httpErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
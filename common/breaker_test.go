@@ -0,0 +1,88 @@
+package common
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+var errUpstream = errors.New("connection refused")
+
+func TestCircuitBreakerOpensAfterThreshold(t *testing.T) {
+	breaker := NewCircuitBreaker("upstream", 3, time.Minute)
+	calls := 0
+	failing := func() error {
+		calls++
+		return errUpstream
+	}
+	for range 3 {
+		if err := breaker.Do(failing); !errors.Is(err, errUpstream) {
+			t.Errorf("expected upstream error, got %v", err)
+		}
+	}
+	var circuitOpenErr *CircuitOpenError
+	if err := breaker.Do(failing); !errors.As(err, &circuitOpenErr) {
+		t.Fatalf("expected circuit to be open, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected upstream to be called 3 times, was called %d times", calls)
+	}
+}
+
+func TestCircuitBreakerIgnoresClientErrors(t *testing.T) {
+	breaker := NewCircuitBreaker("upstream", 1, time.Minute)
+	notFound := &HTTPError{StatusCode: http.StatusNotFound}
+	for range 3 {
+		if err := breaker.Do(func() error { return notFound }); err != notFound {
+			t.Errorf("expected not found error, got %v", err)
+		}
+	}
+}
+
+func TestCircuitBreakerHalfOpens(t *testing.T) {
+	breaker := NewCircuitBreaker("upstream", 1, 10*time.Millisecond)
+	breaker.Do(func() error { return errUpstream })
+	time.Sleep(20 * time.Millisecond)
+
+	// a failing test request opens the circuit again
+	if err := breaker.Do(func() error { return errUpstream }); !errors.Is(err, errUpstream) {
+		t.Fatalf("expected upstream error, got %v", err)
+	}
+	var circuitOpenErr *CircuitOpenError
+	if err := breaker.Do(func() error { return nil }); !errors.As(err, &circuitOpenErr) {
+		t.Fatalf("expected circuit to be open, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// a successful test request closes it
+	if err := breaker.Do(func() error { return nil }); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if err := breaker.Do(func() error { return nil }); err != nil {
+		t.Fatalf("expected circuit to be closed, got %v", err)
+	}
+}
+
+func TestCircuitBreakerCheck(t *testing.T) {
+	breaker := NewCircuitBreaker("upstream", 1, 10*time.Millisecond)
+	if err := breaker.Check(); err != nil {
+		t.Fatalf("expected a closed circuit, got %v", err)
+	}
+	breaker.Do(func() error { return errUpstream })
+	var circuitOpenErr *CircuitOpenError
+	if err := breaker.Check(); !errors.As(err, &circuitOpenErr) {
+		t.Fatalf("expected circuit to be open, got %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// checking doesn't use up the test request
+	for range 2 {
+		if err := breaker.Check(); err != nil {
+			t.Fatalf("expected a test request to be allowed, got %v", err)
+		}
+	}
+	if err := breaker.Do(func() error { return nil }); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -43,7 +43,18 @@ func GetUrl(ctx context.Context, url string, secrets ...string) ([]byte, error)
 		return nil, err
 	}
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("None 200 response code %v from %s:\n%s", resp.StatusCode, url, body)
+		return nil, &HTTPError{StatusCode: resp.StatusCode, URL: url, Body: body}
 	}
 	return body, nil
 }
+
+// HTTPError is returned by GetUrl when the response code isn't 200.
+type HTTPError struct {
+	StatusCode int
+	URL        string
+	Body       []byte
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("None 200 response code %v from %s:\n%s", e.StatusCode, e.URL, e.Body)
+}
@@ -6,18 +6,91 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/karl-gustav/power_price/common"
 )
 
 const (
-	currencyURL = "https://data.norges-bank.no/api/data/EXR/B.%s.%s.SP?format=sdmx-generic-2.1&startPeriod=%s&endPeriod=%s&locale=en"
+	DefaultBaseURL = "https://data.norges-bank.no/api/data"
+	currencyURL    = "%s/EXR/B.%s.%s.SP?format=sdmx-generic-2.1&startPeriod=%s&endPeriod=%s&locale=en"
+)
+
+var baseURL = DefaultBaseURL
+
+// SetBaseURL changes where the Norges Bank API is, e.g. to use a local
+// stand-in. It is meant to be called on startup, before any requests are made.
+func SetBaseURL(url string) {
+	baseURL = url
+}
+
+// MaxExchangeRateAge is how old the last known exchange rate can be, compared
+// to the date it should be used for, and still be used when Norges Bank is down.
+const MaxExchangeRateAge = 7 * 24 * time.Hour
+
+var norgesBankBreaker = common.NewCircuitBreaker("data.norges-bank.no", common.DefaultFailureThreshold, common.DefaultOpenTime)
+
+var (
+	lastKnownMu    sync.Mutex
+	lastKnownRates = map[string]ExchangeRate{}
 )
 
 type ExchangeRate struct {
 	Rate float64
 	Date string
+	// Provisional is set when the rate is the last known rate and not the
+	// rate Norges Bank would have given for the date
+	Provisional bool
+}
+
+// SetCircuitBreaker replaces the circuit breaker for requests to Norges Bank.
+// It is meant to be called on startup, before any requests are made.
+func SetCircuitBreaker(failureThreshold int, openTime time.Duration) {
+	norgesBankBreaker = common.NewCircuitBreaker("data.norges-bank.no", failureThreshold, openTime)
+}
+
+// RememberExchangeRate stores the rate as the last known rate for the currency
+// pair if it is newer than the one we already have.
+func RememberExchangeRate(fromCurrency, toCurrency string, rate ExchangeRate) {
+	if rate.Provisional || rate.Date == "" {
+		return
+	}
+	lastKnownMu.Lock()
+	defer lastKnownMu.Unlock()
+	pair := fromCurrency + toCurrency
+	if rate.Date > lastKnownRates[pair].Date {
+		lastKnownRates[pair] = rate
+	}
+}
+
+// ForgetExchangeRates forgets the last known rates, like a new instance
+func ForgetExchangeRates() {
+	lastKnownMu.Lock()
+	defer lastKnownMu.Unlock()
+	lastKnownRates = map[string]ExchangeRate{}
+}
+
+// GetLastKnownExchangeRate returns the newest rate we have seen that could
+// have been used for date, if it is no older than MaxExchangeRateAge. The
+// returned rate is marked as provisional.
+func GetLastKnownExchangeRate(fromCurrency, toCurrency string, date time.Time) (*ExchangeRate, bool) {
+	lastKnownMu.Lock()
+	rate, ok := lastKnownRates[fromCurrency+toCurrency]
+	lastKnownMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	rateDate, err := time.ParseInLocation(common.StdDateFormat, rate.Date, common.Loc)
+	if err != nil {
+		return nil, false
+	}
+	// the rate must be from before the day, the same as GetExchangeRate uses
+	if !rateDate.Before(date) || date.Sub(rateDate) > MaxExchangeRateAge {
+		return nil, false
+	}
+	rate.Provisional = true
+	return &rate, true
 }
 
 func GetExchangeRate(ctx context.Context, fromCurrency, toCurrency string, date time.Time) (*ExchangeRate, error) {
@@ -27,12 +100,17 @@ func GetExchangeRate(ctx context.Context, fromCurrency, toCurrency string, date
 	// might be bank holidays, wekends and so on where there are no new exchange rates
 	url := fmt.Sprintf(
 		currencyURL,
+		baseURL,
 		fromCurrency,
 		toCurrency,
 		date.AddDate(0, 0, -7).Format(common.StdDateFormat),
 		date.Format(common.StdDateFormat),
 	)
-	exchangeRateInfoBody, err := common.GetUrl(ctx, url)
+	var exchangeRateInfoBody []byte
+	err := norgesBankBreaker.Do(func() (err error) {
+		exchangeRateInfoBody, err = common.GetUrl(ctx, url)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -49,11 +127,16 @@ func GetExchangeRate(ctx context.Context, fromCurrency, toCurrency string, date
 		}
 	}
 	obs := exchangeRateInfo.DataSet.Series.Obs
+	if len(obs) == 0 {
+		return nil, fmt.Errorf("no exchange rates for %s/%s in response from %s", fromCurrency, toCurrency, url)
+	}
 
-	return &ExchangeRate{
+	exchangeRate := ExchangeRate{
 		Rate: obs[len(obs)-1].ObsValue.Value / math.Pow10(multiplicator),
 		Date: obs[len(obs)-1].ObsDimension.Value,
-	}, nil
+	}
+	RememberExchangeRate(fromCurrency, toCurrency, exchangeRate)
+	return &exchangeRate, nil
 }
 
 type ExchangeRateResponse struct {
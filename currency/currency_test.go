@@ -0,0 +1,54 @@
+package currency
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/upstreamtest"
+)
+
+func TestGetExchangeRateFromStandin(t *testing.T) {
+	server := upstreamtest.NewServer()
+	defer server.Close()
+	SetBaseURL(server.NorgesBankURL)
+	defer SetBaseURL(DefaultBaseURL)
+
+	// 2025-01-20 is a monday, so the rate should be from the friday before
+	date := time.Date(2025, 1, 20, 0, 0, 0, 0, common.Loc)
+	exchangeRate, err := GetExchangeRate(context.Background(), "EUR", "NOK", date)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if exchangeRate.Date != "2025-01-17" {
+		t.Errorf("expected exchange rate from 2025-01-17, got %s", exchangeRate.Date)
+	}
+	if exchangeRate.Rate < 10 || exchangeRate.Rate > 13 {
+		t.Errorf("expected a EUR/NOK rate, got %f", exchangeRate.Rate)
+	}
+
+	_, err = GetExchangeRate(context.Background(), "EUR", "NOK", time.Date(2024, 1, 20, 0, 0, 0, 0, common.Loc))
+	if err == nil {
+		t.Errorf("expected an error for a date without exchange rates")
+	}
+}
+
+func TestGetLastKnownExchangeRate(t *testing.T) {
+	RememberExchangeRate("EUR", "SEK", ExchangeRate{Rate: 11.5, Date: "2025-01-17"})
+
+	date := time.Date(2025, 1, 20, 0, 0, 0, 0, common.Loc)
+	exchangeRate, ok := GetLastKnownExchangeRate("EUR", "SEK", date)
+	if !ok {
+		t.Fatalf("expected last known exchange rate")
+	}
+	if !exchangeRate.Provisional {
+		t.Errorf("expected last known exchange rate to be provisional")
+	}
+	if _, ok = GetLastKnownExchangeRate("EUR", "SEK", date.AddDate(0, 0, 14)); ok {
+		t.Errorf("expected exchange rate to be too old")
+	}
+	if _, ok = GetLastKnownExchangeRate("EUR", "SEK", date.AddDate(0, 0, -3)); ok {
+		t.Errorf("expected exchange rate to be too new")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+)
+
+// The formats of the price endpoints, json is the format of the endpoint
+const (
+	formatJSON  = "json"
+	formatCSV   = "csv"
+	formatTSV   = "tsv"
+	formatTable = "table"
+)
+
+var formats = []string{formatJSON, formatCSV, formatTSV, formatTable}
+
+// tabularFormats are the same for all the price endpoints
+var tabularFormats = map[string]priceFormat{
+	formatCSV:   writePriceCSV,
+	formatTSV:   writePriceTSV,
+	formatTable: writePriceTable,
+}
+
+// rangeFormats are the formats that can have more than one day, the JSON of
+// the endpoints is for one day
+var rangeFormats = []string{formatCSV, formatTSV, formatTable}
+
+// priceColumns are in the same order as the fields of calculator.PricePoint,
+// new columns are added at the end
+var priceColumns = []string{
+	"NOK_per_kWh",
+	"EUR_per_MWh",
+	"exchange_rate",
+	"exchange_rate_date",
+	"valid_from",
+	"valid_to",
+	"provisional",
+}
+
+// formatFromRequest returns the format in the format query parameter, or the
+// format the Accept header prefers to JSON. ok is false if the format isn't
+// one of the formats.
+func formatFromRequest(req *http.Request) (format string, ok bool) {
+	if format = req.URL.Query().Get("format"); format != "" {
+		_, ok = tabularFormats[format]
+		return format, ok || format == formatJSON
+	}
+	if prefersToJSON(req, "text/csv") {
+		return formatCSV, true
+	} else if prefersToJSON(req, "text/tab-separated-values") {
+		return formatTSV, true
+	}
+	return formatJSON, true
+}
+
+func writePriceCSV(res http.ResponseWriter, query priceQuery, forecast *priceForecast, prices map[string]calculator.PricePoint, resolution string) error {
+	res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.csv\"", priceFileName(query)))
+	return writeDelimited(csv.NewWriter(res), prices)
+}
+
+func writePriceTSV(res http.ResponseWriter, query priceQuery, forecast *priceForecast, prices map[string]calculator.PricePoint, resolution string) error {
+	res.Header().Set("Content-Type", "text/tab-separated-values; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tsv\"", priceFileName(query)))
+	writer := csv.NewWriter(res)
+	writer.Comma = '\t'
+	return writeDelimited(writer, prices)
+}
+
+func writeDelimited(writer *csv.Writer, prices map[string]calculator.PricePoint) error {
+	writer.Write(priceColumns)
+	for _, price := range sortedPrices(prices) {
+		writer.Write(priceRow(price))
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// writePriceTable is an aligned table for reading the prices in a terminal
+func writePriceTable(res http.ResponseWriter, query priceQuery, forecast *priceForecast, prices map[string]calculator.PricePoint, resolution string) error {
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	writer := tabwriter.NewWriter(res, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, strings.Join(priceColumns, "\t"))
+	for _, price := range sortedPrices(prices) {
+		fmt.Fprintln(writer, strings.Join(priceRow(price), "\t"))
+	}
+	return writer.Flush()
+}
+
+// priceRow is the price in the columns of priceColumns, the price in NOK is
+// rounded like in the JSON
+func priceRow(price calculator.PricePoint) []string {
+	return []string{
+		strconv.FormatFloat(math.Round(price.PriceKWhNOK*10000)/10000, 'f', -1, 64),
+		strconv.FormatFloat(price.PriceMWhEUR, 'f', -1, 64),
+		strconv.FormatFloat(price.ExchangeRate, 'f', -1, 64),
+		price.ExchangeRateDate,
+		price.From.In(common.Loc).Format(time.RFC3339),
+		price.To.In(common.Loc).Format(time.RFC3339),
+		strconv.FormatBool(price.Provisional),
+	}
+}
+
+func priceFileName(query priceQuery) string {
+	name := fmt.Sprintf("prices-%s-%s", query.shortZone, query.date.Format(common.StdDateFormat))
+	if query.days() > 1 {
+		name += "-to-" + query.to.Format(common.StdDateFormat)
+	}
+	return name
+}
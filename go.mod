@@ -7,7 +7,11 @@ require (
 	cloud.google.com/go/firestore v1.9.0
 	github.com/go-chi/chi/v5 v5.2.1
 	github.com/karl-gustav/slogdriver v0.0.0
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/sync v0.5.0
+	golang.org/x/time v0.1.0
 	google.golang.org/grpc v1.53.0
+	google.golang.org/protobuf v1.28.1
 )
 
 require (
@@ -22,13 +26,10 @@ require (
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/oauth2 v0.4.0 // indirect
-	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/sys v0.25.0 // indirect
 	golang.org/x/text v0.6.0 // indirect
-	golang.org/x/time v0.1.0 // indirect
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
 	google.golang.org/api v0.103.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
 	google.golang.org/genproto v0.0.0-20230110181048-76db0878b65f // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
 )
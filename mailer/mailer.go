@@ -0,0 +1,106 @@
+// Package mailer sends emails, through SMTP in production and to memory (and
+// the log) when running locally and in tests.
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorInvalidHeader = errors.New("email headers can't contain line breaks")
+
+type Message struct {
+	To      string
+	Subject string
+	// Body is plain text
+	Body string
+}
+
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// SMTP sends emails through an SMTP server, with STARTTLS if the server
+// supports it.
+type SMTP struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// NewSMTP returns a mailer for the server at addr (host:port). It doesn't
+// authenticate if username is empty.
+func NewSMTP(addr, username, password, from string) *SMTP {
+	s := &SMTP{addr: addr, from: from}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		s.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return s
+}
+
+// Send ignores the context, net/smtp has no support for it
+func (s *SMTP) Send(ctx context.Context, message Message) error {
+	data, err := format(s.from, message, time.Now())
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{message.To}, data)
+}
+
+// format returns the message with headers, as it is sent to the SMTP server
+func format(from string, message Message, date time.Time) ([]byte, error) {
+	for _, header := range []string{from, message.To, message.Subject} {
+		if strings.ContainsAny(header, "\r\n") {
+			return nil, ErrorInvalidHeader
+		}
+	}
+	var data bytes.Buffer
+	fmt.Fprintf(&data, "From: %s\r\n", from)
+	fmt.Fprintf(&data, "To: %s\r\n", message.To)
+	fmt.Fprintf(&data, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", message.Subject))
+	fmt.Fprintf(&data, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	data.WriteString("MIME-Version: 1.0\r\n")
+	data.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	data.WriteString("\r\n")
+	data.WriteString(strings.ReplaceAll(strings.ReplaceAll(message.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return data.Bytes(), nil
+}
+
+// Capture keeps the emails in memory instead of sending them, and logs them
+// so the links in them can be used when running locally.
+type Capture struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func NewCapture() *Capture {
+	return &Capture{}
+}
+
+func (c *Capture) Send(ctx context.Context, message Message) error {
+	if _, err := format("capture", message, time.Now()); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.messages = append(c.messages, message)
+	slog.InfoContext(ctx, fmt.Sprintf("captured email to %s: %s\n%s", message.To, message.Subject, message.Body))
+	return nil
+}
+
+// Messages returns the emails that has been sent, the oldest first
+func (c *Capture) Messages() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message(nil), c.messages...)
+}
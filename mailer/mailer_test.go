@@ -0,0 +1,50 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	message := Message{To: "ola@example.com", Subject: "Bekreft e-post", Body: "line 1\nline 2"}
+	data, err := format("power@ffail.win", message, time.Date(2025, 1, 22, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	expected := "From: power@ffail.win\r\n" +
+		"To: ola@example.com\r\n" +
+		"Subject: Bekreft e-post\r\n" +
+		"Date: Wed, 22 Jan 2025 12:00:00 +0000\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" +
+		"line 1\r\nline 2"
+	if string(data) != expected {
+		t.Errorf("expected\n%q\ngot\n%q", expected, data)
+	}
+
+	message.Subject = "Ærlig talt"
+	if data, _ = format("power@ffail.win", message, time.Now()); !strings.Contains(string(data), "Subject: =?utf-8?q?=C3=86rlig_talt?=\r\n") {
+		t.Errorf("expected the subject to be encoded, got %q", data)
+	}
+}
+
+func TestFormatHeaderInjection(t *testing.T) {
+	message := Message{To: "ola@example.com\r\nBcc: everyone@example.com", Subject: "hi"}
+	if _, err := format("power@ffail.win", message, time.Now()); !errors.Is(err, ErrorInvalidHeader) {
+		t.Errorf("expected ErrorInvalidHeader, got %v", err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	capture := NewCapture()
+	capture.Send(context.Background(), Message{To: "ola@example.com", Subject: "1"})
+	capture.Send(context.Background(), Message{To: "kari@example.com", Subject: "2"})
+	messages := capture.Messages()
+	if len(messages) != 2 || messages[0].Subject != "1" || messages[1].To != "kari@example.com" {
+		t.Errorf("expected both messages, got %+v", messages)
+	}
+}
@@ -1,31 +1,67 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/go-chi/chi/v5"
+	"github.com/karl-gustav/power_price/apikey"
 	"github.com/karl-gustav/power_price/calculator"
 	"github.com/karl-gustav/power_price/common"
 	"github.com/karl-gustav/power_price/currency"
+	"github.com/karl-gustav/power_price/mailer"
+	"github.com/karl-gustav/power_price/ratelimit"
 	"github.com/karl-gustav/power_price/storage"
 	"github.com/karl-gustav/slogdriver"
 )
 
 const (
-	missingKeyMessage = "send an email to power@ffail.win to get a free API key"
+	missingKeyMessage = "sign up for a free API key at https://norway-power.ffail.win/signup"
+	// endpointPrices is the name of the endpoint in the usage of API keys
+	endpointPrices = "prices"
+	// endpointStats and endpointOptimizers can be set in the scopes of keys,
+	// but the endpoints doesn't exist yet
+	endpointStats      = "stats"
+	endpointOptimizers = "optimizers"
+	// endpointAdmin is the admin API, it is only used in the scopes of keys
+	endpointAdmin = "admin"
 )
 
 var firstDayInDataset = time.Date(2014, 12, 12, 0, 0, 0, 0, common.Loc)
 
+// maxPriceRangeDays is the most days the prices can be got for at once with
+// from and to, a range counts as one request towards the quota
+const maxPriceRangeDays = 31
+
 var SECURITY_TOKEN = os.Getenv("SECURITY_TOKEN")
 
+var store storage.Store
+
+// keyRateLimits is the rate limit per API key, it is checked before anything
+// else so a single key can't use up its quota (or our Firestore budget) in
+// one burst
+var keyRateLimits = ratelimit.NewKeyed(
+	getEnvInt("RATE_LIMIT_PER_MINUTE", 60),
+	getEnvInt("RATE_LIMIT_BURST", 10),
+)
+
+// revisionCheckDays is how many days back we check for corrected prices
+var revisionCheckDays = getEnvInt("REVISION_CHECK_DAYS", 3)
+
 func init() {
 	if slogdriver.OnGCP() {
 		projectID, err := metadata.ProjectID()
@@ -39,181 +75,506 @@ func init() {
 }
 
 func main() {
-	if SECURITY_TOKEN == "" {
+	if mode != modeAPI && mode != modePlayground {
+		panic(fmt.Sprintf("Environment variable MODE must be %s or %s, got %q", modeAPI, modePlayground, mode))
+	}
+	playground := mode == modePlayground
+	if SECURITY_TOKEN == "" && !playground {
 		panic("Envionment variable SECURITY_TOKEN is required!")
 	}
+	calculator.SetRateLimit(
+		getEnvInt("ENTSOE_REQUESTS_PER_MINUTE", calculator.DefaultRequestsPerMinute),
+		getEnvInt("ENTSOE_BURST", calculator.DefaultBurst),
+		getEnvDuration("ENTSOE_MAX_QUEUE_TIME", calculator.DefaultMaxQueueTime),
+	)
+	if url := os.Getenv("ENTSOE_URL"); url != "" {
+		calculator.SetBaseURL(url)
+	}
+	if url := os.Getenv("NORGES_BANK_URL"); url != "" {
+		currency.SetBaseURL(url)
+	}
+	failureThreshold := getEnvInt("CIRCUIT_BREAKER_FAILURES", common.DefaultFailureThreshold)
+	openTime := getEnvDuration("CIRCUIT_BREAKER_OPEN_TIME", common.DefaultOpenTime)
+	calculator.SetCircuitBreaker(failureThreshold, openTime)
+	currency.SetCircuitBreaker(failureThreshold, openTime)
+
+	var err error
+	backend := getEnv("STORAGE", storage.BackendFirestore)
+	location := getEnv("GCP_PROJECT", storage.DefaultGCPProject)
+	if backend == storage.BackendBolt {
+		location = getEnv("STORAGE_PATH", "power_price.db")
+	}
+	persistentStore, err := storage.Open(context.Background(), backend, location)
+	if err != nil {
+		panic(err)
+	}
+	store = storage.NewLRU(
+		persistentStore,
+		getEnvInt("PRICE_CACHE_ENTRIES", storage.DefaultLRUEntries),
+		getEnvDuration("PRICE_CACHE_RECENT_TTL", storage.DefaultLRURecentTTL),
+		revisionCheckDays,
+	)
+	defer func() {
+		if err := store.Close(); err != nil {
+			slog.Error("got error when closing store: " + err.Error())
+		}
+	}()
+	hashSecret := os.Getenv("API_KEY_HASH_SECRET")
+	if hashSecret == "" && backend == storage.BackendFirestore && !playground {
+		panic("Envionment variable API_KEY_HASH_SECRET is required!")
+	}
+	apikey.SetSecret([]byte(hashSecret))
+	if key := os.Getenv("DEV_API_KEY"); key != "" && backend != storage.BackendFirestore {
+		apiKey := storage.ApiKey{Name: "dev", Quota: 1000, Prefix: apikey.Prefix(key)}
+		err = store.PutApiKey(context.Background(), apikey.Hash(key), apiKey)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if addr := os.Getenv("SMTP_ADDR"); addr != "" {
+		mailSender = mailer.NewSMTP(
+			addr,
+			os.Getenv("SMTP_USERNAME"),
+			os.Getenv("SMTP_PASSWORD"),
+			getEnv("MAIL_FROM", "power@ffail.win"),
+		)
+	}
 
+	r := newRouter()
+	if playground {
+		r = newPlaygroundRouter()
+	}
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	server := &http.Server{Addr: ":" + port, Handler: r}
+	// Cloud Run sends SIGTERM before shutting down an instance
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if interval := getEnvDuration("REVISION_CHECK_INTERVAL", time.Hour); revisionCheckDays > 0 && interval > 0 && !playground {
+		go checkForRevisions(ctx, revisionCheckDays, interval)
+	}
+	go func() {
+		slog.Info("Serving http://localhost:" + port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			slog.Error(err.Error())
+			stop()
+		}
+	}()
+	<-ctx.Done()
+
+	// let requests in flight finish before the store is closed
+	slog.Info("Shutting down server")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("got error when shutting down server: " + err.Error())
+	}
+}
+
+func newRouter() chi.Router {
 	r := chi.NewRouter()
 	r.Use(slogdriver.WithTraceContext)
 	r.Get("/favicon.ico", notFound)
-	r.Get("/", powerPriceHandler)
+	r.Group(func(r chi.Router) {
+		r.Use(cors)
+		r.Options("/", corsPreflightHandler)
+		r.Options("/usage", corsPreflightHandler)
+		r.Options("/usage/history", corsPreflightHandler)
+		r.Options("/v2/prices", corsPreflightHandler)
+		r.With(requireApiKey(endpointPrices)).Get("/", powerPriceHandler(writePriceMap))
+		r.With(requireApiKey(endpointPrices)).Get("/v2/prices", powerPriceHandler(writePriceList))
+		r.Group(func(r chi.Router) {
+			r.Use(requireApiKey(""))
+			r.Get("/usage", usageHandler)
+			r.Get("/usage/history", usageHistoryHandler)
+			r.Get("/keys", listKeysHandler)
+			r.Post("/keys", createKeyHandler)
+			r.Post("/keys/rotate", rotateKeyHandler)
+			r.Delete("/keys/{prefix}", revokeKeyHandler)
+		})
+	})
+	r.Mount("/admin", adminRouter())
+	r.Get("/signup", signupFormHandler)
+	r.Post("/signup", signupHandler)
+	r.Get("/signup/verify", verifyFormHandler)
+	r.Post("/signup/verify", verifyHandler)
 	r.Get("/graph", func(res http.ResponseWriter, req *http.Request) {
 		http.ServeFile(res, req, "index.html")
 	})
+	return r
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+// powerPriceHandler serves the prices in a format, the quota and the errors
+// are the same for all formats
+func powerPriceHandler(format priceFormat) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		servePrices(res, req, format)
 	}
-	slog.Info("Serving http://localhost:" + port)
-	slog.Error(http.ListenAndServe(":"+port, r).Error())
 }
 
-func powerPriceHandler(res http.ResponseWriter, req *http.Request) {
+func servePrices(res http.ResponseWriter, req *http.Request, format priceFormat) {
 	ctx := req.Context()
-	res.Header().Set("Access-Control-Allow-Origin", "*")
-	queryZone := req.URL.Query().Get("zone")
-	if queryZone == "" {
-		m := "\"zone\" query parameter is a required field. Valid zones are NO1, NO2, NO3, NO4 and NO5"
-		http.Error(res, m, http.StatusBadRequest)
-		return
-	}
-	zone, ok := calculator.Zones[queryZone]
+	c := callerFrom(ctx)
+	query, ok := parsePriceQuery(res, req, c.plan)
 	if !ok {
-		http.Error(
-			res,
-			queryZone+" is not a valid zone! Valid zones are NO1, NO2, NO3, NO4 and NO5",
-			http.StatusBadRequest,
-		)
 		return
 	}
 
-	queryDate := req.URL.Query().Get("date")
-	if queryDate == "" {
+	account := c.account
+	quota := quotaOf(c.plan)
+	ok, remaining, err := store.ConsumeQuota(ctx, c.accountID, endpointPrices, query.shortZone, quota)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when consuming quota for key %s: %v", c.prefix, err))
+		writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when getting usage for api key: "+c.prefix))
+		return
+	} else if !ok {
+		setQuotaHeaders(res.Header(), quota, remaining, c.rateLimit)
+		now := time.Now()
+		used := fmt.Sprintf("daily quota of %d requests for zone %s", quota.Daily, query.shortZone)
+		limit, reset, retryAfter := quota.Daily, quotaReset(now), secondsUntilQuotaReset(now)
+		if remaining.Monthly == 0 {
+			used = fmt.Sprintf("monthly quota of %d requests", quota.Monthly)
+			limit, reset, retryAfter = quota.Monthly, monthlyQuotaReset(now), secondsUntilMonthlyQuotaReset(now)
+		}
+		slog.WarnContext(ctx, fmt.Sprintf("blocked access for %s because the %s is used up", account.Email, used),
+			slog.String("email", account.Email),
+			slog.String("key", c.prefix),
+		)
+		res.Header().Set("Retry-After", strconv.Itoa(retryAfter))
 		m := fmt.Sprintf(
-			"\"date\" query parameter is a required field. Date uses this format %s",
-			common.StdDateFormat,
+			"you have exceeded your %s\n"+
+				"use https://playground-norway-power.ffail.win for testing your code (unlimited use)",
+			used,
 		)
-		http.Error(res, m, http.StatusBadRequest)
+		p := newProblem(http.StatusTooManyRequests, codeQuotaExceeded, m)
+		p.Plan, p.Quota, p.QuotaReset, p.RetryAfter = c.plan.Name, limit, &reset, retryAfter
+		writeProblem(res, req, p)
 		return
 	}
-	date, err := time.ParseInLocation(common.StdDateFormat, queryDate, common.Loc)
+	// failed requests doesn't count towards the quota
+	served := false
+	defer func() {
+		if served {
+			return
+		}
+		err := store.RefundQuota(context.WithoutCancel(ctx), c.accountID, endpointPrices, query.shortZone)
+		if err != nil {
+			slog.ErrorContext(ctx, "got error when running RefundQuota():", slog.Any("error", err))
+		}
+	}()
+
+	forecast, failed, err := priceRangeForecast(query, func(day time.Time) (*priceForecast, error) {
+		return getPriceForecast(ctx, query.zone, day)
+	})
 	if err != nil {
-		http.Error(
-			res,
-			fmt.Sprintf("Could not parse %s, in the format %s", queryDate, common.StdDateFormat),
-			http.StatusBadRequest,
-		)
-		return
-	}
-	if !isValidTimePeriod(date) {
-		http.Error(res, "price data only become available at 14:00 for the next day", http.StatusBadRequest)
-		return
+		// the request is refunded when we return
+		remaining.Daily++
+		if remaining.Monthly >= 0 {
+			remaining.Monthly++
+		}
 	}
-	if date.Before(firstDayInDataset) {
-		http.Error(res, "there isn't any price data from before 2014-12-12", http.StatusBadRequest)
+	setQuotaHeaders(res.Header(), quota, remaining, c.rateLimit)
+	if err != nil {
+		query.date = failed
+		writePriceError(res, req, query, err)
 		return
 	}
+	served = writePrices(ctx, res, query, c.plan, forecast, format)
+}
 
-	key := req.URL.Query().Get("key")
-	if key == "" {
-		http.Error(res, "\"key\" query parameter is a required field\n"+missingKeyMessage, http.StatusUnauthorized)
-		return
+// priceRangeForecast gets the prices for each day of the query and merges
+// them. The revision of a range is 0, since the days have their own. failed is
+// the day that the prices couldn't be got for.
+func priceRangeForecast(query priceQuery, forecastOf func(day time.Time) (*priceForecast, error)) (forecast *priceForecast, failed time.Time, err error) {
+	if query.days() == 1 {
+		forecast, err = forecastOf(query.date)
+		return forecast, query.date, err
 	}
-	ok, apiKey, err := storage.GetApiKey(ctx, key)
-	if err != nil {
-		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting API key for key `%s`: %v", key, err))
-		http.Error(res, "error when verifying api key: "+key, http.StatusInternalServerError)
-		return
-	} else if !ok {
-		slog.WarnContext(ctx, fmt.Sprintf("denied %s access to server because of key was not found", key))
-		m := fmt.Sprintf("the key you supplied is not in our systems: %s\n%s", key, missingKeyMessage)
-		http.Error(res, m, http.StatusUnauthorized)
-		return
-	} else if apiKey.Blocked {
-		slog.WarnContext(ctx, fmt.Sprintf("denied %s (%s) access to server because of %s", apiKey.Email, key, apiKey.Reason))
-		http.Error(res, "You have lost access to server: "+apiKey.Reason, http.StatusForbidden)
-		return
-	}
-	usage, err := storage.GetKeyUsage(ctx, key)
-	if err != nil {
-		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting usage for key `%s`: %v", key, err))
-		http.Error(res, "error when getting usage for api key: "+key, http.StatusInternalServerError)
-		return
-	} else if usage.GetZoneCount(queryZone) >= apiKey.Quota {
-		slog.WarnContext(ctx, fmt.Sprintf(
-			"blocked access for %s because too many requests over quota(%d) in zone %s: %d",
-			apiKey.Email,
-			apiKey.Quota,
-			queryZone,
-			usage.GetZoneCount(queryZone),
-		),
-			slog.String("email", apiKey.Email),
-			slog.String("key", key),
-		)
-		m := fmt.Sprintf(
-			"you have exceeded your daily quota of %d requests for zone %s\n"+
-				"use https://playground-norway-power.ffail.win for testing your code (unlimited use)",
-			apiKey.Quota,
-			queryZone,
-		)
-		http.Error(res, m, http.StatusTooManyRequests)
-		err = storage.IncrementKeyUsage(ctx, key, queryZone)
+	forecast = &priceForecast{Prices: map[string]calculator.PricePoint{}, Cache: cacheHit}
+	for day := query.date; !day.After(query.to); day = day.AddDate(0, 0, 1) {
+		dayForecast, err := forecastOf(day)
 		if err != nil {
-			slog.ErrorContext(ctx, "got error when running IncrementKeyUsage():", slog.Any("error", err))
+			return nil, day, err
+		}
+		// the cached prices are shared, so they are copied
+		maps.Copy(forecast.Prices, dayForecast.Prices)
+		forecast.Provisional = forecast.Provisional || dayForecast.Provisional
+		if dayForecast.Cache != cacheHit {
+			forecast.Cache = dayForecast.Cache
 		}
-		return
 	}
+	return forecast, time.Time{}, nil
+}
 
-	var priceForecast map[string]calculator.PricePoint
-	ok, cache, err := storage.GetCache(ctx, date, zone)
+// priceQuery is the zone, date and resolution of a request for prices
+type priceQuery struct {
+	shortZone string
+	zone      calculator.Zone
+	date      time.Time
+	// to is the last day of a range from date, it is date if the query is
+	// for one day
+	to time.Time
+	// resolution is empty if it isn't in the query
+	resolution string
+	// format is one of formats
+	format string
+}
+
+// parsePriceQuery validates the query parameters of a request for prices, and
+// checks that the plan includes the date and the resolution. If they aren't
+// valid the response is written and ok is false.
+func parsePriceQuery(res http.ResponseWriter, req *http.Request, plan storage.Plan) (query priceQuery, ok bool) {
+	invalidZone := func(m string) {
+		p := newProblem(http.StatusBadRequest, codeInvalidZone, m)
+		p.ValidZones = validZones()
+		writeProblem(res, req, p)
+	}
+	invalidDate := func(m string) {
+		p := newProblem(http.StatusBadRequest, codeInvalidDate, m)
+		p.DateFormat, p.FirstDate = common.StdDateFormat, firstDayInDataset.Format(common.StdDateFormat)
+		writeProblem(res, req, p)
+	}
+	query.shortZone = req.URL.Query().Get("zone")
+	if query.shortZone == "" {
+		invalidZone("\"zone\" query parameter is a required field. Valid zones are NO1, NO2, NO3, NO4 and NO5")
+		return query, false
+	}
+	query.zone, ok = calculator.Zones[query.shortZone]
 	if !ok {
-		slog.DebugContext(ctx, fmt.Sprintf(
-			"date/zone %s/%s not found in cache, getting from source",
-			date.Format(common.StdDateFormat),
-			zone,
-		))
+		invalidZone(query.shortZone + " is not a valid zone! Valid zones are NO1, NO2, NO3, NO4 and NO5")
+		return query, false
 	}
-	if err != nil {
-		slog.ErrorContext(ctx, fmt.Sprintf("got error when retreving cache: %v", err))
+
+	parseDate := func(value string) (date time.Time, ok bool) {
+		date, err := time.ParseInLocation(common.StdDateFormat, value, common.Loc)
+		if err != nil {
+			invalidDate(fmt.Sprintf("Could not parse %s, in the format %s", value, common.StdDateFormat))
+			return date, false
+		}
+		return date, true
 	}
-	if len(cache) != 0 {
-		// re-add timezone info because that is lost in firebase
-		for key, pricePoint := range cache {
-			pricePoint.From = pricePoint.From.In(common.Loc)
-			pricePoint.To = pricePoint.To.In(common.Loc)
-			cache[key] = pricePoint
+	queryDate, queryFrom, queryTo := req.URL.Query().Get("date"), req.URL.Query().Get("from"), req.URL.Query().Get("to")
+	switch {
+	case queryDate != "" && (queryFrom != "" || queryTo != ""):
+		invalidDate("use either the \"date\" query parameter or \"from\" and \"to\", not both")
+		return query, false
+	case queryDate != "":
+		if query.date, ok = parseDate(queryDate); !ok {
+			return query, false
 		}
-		priceForecast = cache
-	} else {
-		powerPrices, err := calculator.GetPrice(ctx, zone, date, SECURITY_TOKEN)
-		if err != nil {
-			if errors.Is(calculator.ErrorPricesNotAvialableYet, err) {
-				slog.WarnContext(ctx, fmt.Sprintf("got Acknowledgement_MarketDocument for zone %s and date %s", zone, date))
-				http.Error(res, err.Error(), http.StatusTooEarly)
-				return
-			}
-			slog.ErrorContext(ctx, fmt.Sprintf("got error when running getPrice(`%s`, `%s`): %v", zone, date, err))
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
+		query.to = query.date
+	case queryFrom != "" && queryTo != "":
+		if query.date, ok = parseDate(queryFrom); !ok {
+			return query, false
 		}
-		exchangeRate, err := currency.GetExchangeRate(ctx, "EUR", "NOK", date)
-		if err != nil {
-			slog.ErrorContext(ctx, fmt.Sprintf(`got error when running getExchangeRate("EUR", "NOK"): %v`, err))
-			http.Error(res, err.Error(), http.StatusInternalServerError)
-			return
+		if query.to, ok = parseDate(queryTo); !ok {
+			return query, false
 		}
-		priceForecast = calculator.CalculatePriceForcast(ctx, *powerPrices, *exchangeRate)
+		if query.to.Before(query.date) {
+			invalidDate(fmt.Sprintf("\"to\" (%s) is before \"from\" (%s)", queryTo, queryFrom))
+			return query, false
+		} else if days := query.days(); days > maxPriceRangeDays {
+			invalidDate(fmt.Sprintf("the range is %d days, it can be at most %d days", days, maxPriceRangeDays))
+			return query, false
+		}
+	case queryFrom != "" || queryTo != "":
+		invalidDate("a range needs both the \"from\" and the \"to\" query parameter")
+		return query, false
+	default:
+		invalidDate(fmt.Sprintf(
+			"\"date\" query parameter is a required field. Date uses this format %s",
+			common.StdDateFormat,
+		))
+		return query, false
+	}
+	if !isValidTimePeriod(query.to) {
+		// the status is 400 and not 425 like when ENTSO-E doesn't have the
+		// prices, because clients already handle it
+		p := newProblem(http.StatusBadRequest, codePricesNotAvailableYet, "price data only become available at 14:00 for the next day")
+		published := pricesPublished(query.to)
+		p.ExpectedPublication = &published
+		writeProblem(res, req, p)
+		return query, false
+	}
+	if query.date.Before(firstDayInDataset) {
+		invalidDate("there isn't any price data from before 2014-12-12")
+		return query, false
+	}
+	if plan.HistoryDays > 0 && query.date.Before(getStartOfDay(time.Now()).AddDate(0, 0, -plan.HistoryDays)) {
+		m := fmt.Sprintf("the %s plan only includes prices from the last %d days", plan.Name, plan.HistoryDays)
+		p := newProblem(http.StatusForbidden, codeNotInPlan, m)
+		p.Plan = plan.Name
+		writeProblem(res, req, p)
+		return query, false
+	}
+	query.resolution = req.URL.Query().Get("resolution")
+	if query.resolution != "" && !slices.Contains(resolutions, query.resolution) {
+		m := fmt.Sprintf("%s is not a valid resolution! Valid resolutions are %s", query.resolution, strings.Join(resolutions, ", "))
+		p := newProblem(http.StatusBadRequest, codeInvalidResolution, m)
+		p.ValidResolutions = resolutions
+		writeProblem(res, req, p)
+		return query, false
+	} else if query.resolution != "" && !allowsResolution(plan, query.resolution) {
+		m := fmt.Sprintf("the %s plan doesn't include prices in %s, only in %s", plan.Name, query.resolution, strings.Join(plan.Resolutions, ", "))
+		p := newProblem(http.StatusForbidden, codeNotInPlan, m)
+		p.Plan, p.ValidResolutions = plan.Name, plan.Resolutions
+		writeProblem(res, req, p)
+		return query, false
+	}
+	if query.format, ok = formatFromRequest(req); !ok {
+		m := fmt.Sprintf("%s is not a valid format! Valid formats are %s", query.format, strings.Join(formats, ", "))
+		p := newProblem(http.StatusBadRequest, codeInvalidFormat, m)
+		p.ValidFormats = formats
+		writeProblem(res, req, p)
+		return query, false
+	}
+	if _, tabular := tabularFormats[query.format]; query.days() > 1 && !tabular {
+		m := fmt.Sprintf("ranges are only in the formats %s, use \"date\" for %s", strings.Join(rangeFormats, ", "), query.format)
+		p := newProblem(http.StatusBadRequest, codeInvalidFormat, m)
+		p.ValidFormats = rangeFormats
+		writeProblem(res, req, p)
+		return query, false
+	}
+	return query, true
+}
 
-		err = storage.StoreCache(ctx, date, zone, priceForecast)
-		if err != nil {
-			slog.ErrorContext(ctx, fmt.Sprintf("got error when running StoreCache(): %v", err))
+// days is how many days the query is for
+func (q priceQuery) days() int {
+	days := 0
+	for day := q.date; !day.After(q.to); day = day.AddDate(0, 0, 1) {
+		days++
+	}
+	return days
+}
+
+// validZones are the short names of the zones, sorted
+func validZones() []string {
+	zones := make([]string, 0, len(calculator.Zones))
+	for zone := range calculator.Zones {
+		zones = append(zones, zone)
+	}
+	slices.Sort(zones)
+	return zones
+}
+
+// writePriceError writes the response for an error from getPriceForecast
+func writePriceError(res http.ResponseWriter, req *http.Request, query priceQuery, err error) {
+	ctx := req.Context()
+	zone, date := query.zone, query.date
+	var rateLimitErr *calculator.RateLimitError
+	var circuitOpenErr *common.CircuitOpenError
+	if errors.Is(calculator.ErrorPricesNotAvialableYet, err) {
+		slog.WarnContext(ctx, fmt.Sprintf("got Acknowledgement_MarketDocument for zone %s and date %s", zone, date))
+		p := newProblem(http.StatusTooEarly, codePricesNotAvailableYet, err.Error())
+		if published := pricesPublished(date); published.After(time.Now()) {
+			p.ExpectedPublication = &published
 		}
+		writeProblem(res, req, p)
+		return
+	} else if errors.As(err, &rateLimitErr) {
+		slog.WarnContext(ctx, fmt.Sprintf("rate limited request to ENTSO-E for zone %s and date %s", zone, date))
+		retryAfter := int(math.Ceil(rateLimitErr.RetryAfter.Seconds()))
+		res.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		p := newProblem(http.StatusServiceUnavailable, codeUpstreamError, err.Error())
+		p.RetryAfter = retryAfter
+		writeProblem(res, req, p)
+		return
+	} else if errors.As(err, &circuitOpenErr) {
+		slog.WarnContext(ctx, fmt.Sprintf("failing fast for zone %s and date %s: %v", zone, date, err))
+		retryAfter := int(math.Ceil(circuitOpenErr.RetryAfter.Seconds()))
+		res.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		p := newProblem(http.StatusServiceUnavailable, codeUpstreamError, err.Error())
+		p.RetryAfter = retryAfter
+		writeProblem(res, req, p)
+		return
 	}
+	slog.ErrorContext(ctx, fmt.Sprintf("got error when getting price forecast for zone %s and date %s: %v", zone, date, err))
+	writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, err.Error()))
+}
 
-	res.Header().Set("Content-Type", "application/json")
-	res.Header().Set("Cache-Control", "public,max-age=31536000,immutable") // 31536000sec --> 1 year
-	if err = json.NewEncoder(res).Encode(&priceForecast); err != nil {
+// priceFormat writes the prices, in the resolution they are resampled to. The
+// JSON format is different for each endpoint, the tabular formats in
+// tabularFormats are the same.
+type priceFormat func(res http.ResponseWriter, query priceQuery, forecast *priceForecast, prices map[string]calculator.PricePoint, resolution string) error
+
+// writePrices writes the prices in the resolution of the query, or in a
+// resolution the plan includes. served is false if the prices couldn't be
+// written.
+func writePrices(ctx context.Context, res http.ResponseWriter, query priceQuery, plan storage.Plan, forecast *priceForecast, format priceFormat) (served bool) {
+	if tabular, ok := tabularFormats[query.format]; ok {
+		format = tabular
+	}
+	res.Header().Add("Vary", "Accept")
+	if forecast.Revision > 0 {
+		res.Header().Set("X-Price-Revision", strconv.Itoa(forecast.Revision))
+		res.Header().Set("X-Price-Created", forecast.Created.Format(time.RFC3339))
+	}
+	// a shared cache would serve the prices to callers without a valid key,
+	// with the rate limit headers and resolution of the key that got them,
+	// so only the playground's prices are public
+	cacheability := "public"
+	if callerFrom(ctx).apiKey != nil {
+		cacheability = "private"
+	}
+	if forecast.Provisional {
+		res.Header().Set("X-Provisional", "true")
+		res.Header().Set("Cache-Control", cacheability+",max-age=300")
+	} else if isCheckedForRevisions(query.to) {
+		// ENTSO-E might still publish a corrected revision
+		res.Header().Set("Cache-Control", cacheability+",max-age=3600")
+	} else {
+		res.Header().Set("Cache-Control", cacheability+",max-age=31536000,immutable") // 31536000sec --> 1 year
+	}
+	prices := forecast.Prices
+	resolution := query.resolution
+	if resolution == "" && !allowsResolution(plan, priceResolution(prices)) {
+		resolution = plan.Resolutions[0]
+	}
+	if resolution == "" {
+		// the days of a range can be in different resolutions
+		resolution = priceResolution(prices)
+	}
+	prices = resample(prices, resolution)
+	if err := format(res, query, forecast, prices, resolution); err != nil {
 		slog.ErrorContext(ctx, fmt.Sprintf("got error when encoding priceForecast: %ov", err))
 		http.Error(res, err.Error(), http.StatusInternalServerError)
-		return
+		return false
 	}
-	err = storage.IncrementKeyUsage(ctx, key, queryZone)
-	if err != nil {
-		slog.ErrorContext(ctx, "got error when running IncrementKeyUsage():", slog.Any("error", err))
+	return true
+}
+
+// writePriceMap is the format of /, the prices by the start of the interval
+func writePriceMap(res http.ResponseWriter, query priceQuery, forecast *priceForecast, prices map[string]calculator.PricePoint, resolution string) error {
+	res.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(res).Encode(&prices)
+}
+
+func writeJSON(res http.ResponseWriter, req *http.Request, status int, value any) {
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(status)
+	// the status is already sent, so all we can do is log the error
+	if err := json.NewEncoder(res).Encode(value); err != nil {
+		slog.ErrorContext(req.Context(), fmt.Sprintf("got error when encoding response: %v", err))
 	}
 }
 
+// readJSON decodes the request body into value. If the body isn't valid the
+// response is written and ok is false.
+func readJSON(res http.ResponseWriter, req *http.Request, value any) (ok bool) {
+	decoder := json.NewDecoder(http.MaxBytesReader(res, req.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(value); err != nil {
+		http.Error(res, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
 func notFound(res http.ResponseWriter, req *http.Request) {
 	http.Error(res, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
@@ -230,6 +591,42 @@ func isValidTimePeriod(date time.Time) bool {
 	return false
 }
 
+func isCheckedForRevisions(date time.Time) bool {
+	return !date.Before(getStartOfDay(time.Now()).AddDate(0, 0, 1-revisionCheckDays))
+}
+
+func getEnv(name string, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+func getEnvInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		panic(fmt.Sprintf("Environment variable %s must be an integer, got %q", name, value))
+	}
+	return i
+}
+
+func getEnvDuration(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		panic(fmt.Sprintf("Environment variable %s must be a duration like 10s, got %q", name, value))
+	}
+	return d
+}
+
 func getStartOfDay(date time.Time) time.Time {
 	year, month, day := date.Date()
 	return time.Date(year, month, day, 0, 0, 0, 0, common.Loc)
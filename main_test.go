@@ -0,0 +1,1516 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karl-gustav/power_price/apikey"
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/currency"
+	"github.com/karl-gustav/power_price/mailer"
+	"github.com/karl-gustav/power_price/ratelimit"
+	"github.com/karl-gustav/power_price/storage"
+	"github.com/karl-gustav/power_price/upstreamtest"
+)
+
+const testKey = "test-key"
+
+// setupTest points the service at the ENTSO-E and Norges Bank stand-ins and an
+// in-memory store with the key testKey
+func setupTest(t *testing.T, apiKey storage.ApiKey) *upstreamtest.Server {
+	t.Helper()
+	upstream := upstreamtest.NewServer()
+	t.Cleanup(upstream.Close)
+	calculator.SetBaseURL(upstream.EntsoeURL)
+	currency.SetBaseURL(upstream.NorgesBankURL)
+	t.Cleanup(func() {
+		calculator.SetBaseURL(calculator.DefaultBaseURL)
+		currency.SetBaseURL(currency.DefaultBaseURL)
+	})
+	SECURITY_TOKEN = "standin"
+	calculator.SetCircuitBreaker(common.DefaultFailureThreshold, common.DefaultOpenTime)
+	currency.SetCircuitBreaker(common.DefaultFailureThreshold, common.DefaultOpenTime)
+	currency.ForgetExchangeRates()
+	cachedExchangeRateMisses = newExpiringSet(100)
+	keyRateLimits = ratelimit.NewKeyed(60, 10)
+	mailSender = mailer.NewCapture()
+	signupsPerIP = ratelimit.NewKeyed(1, 5)
+	signupsPerDomain = ratelimit.NewKeyed(5, 20)
+	authFailuresPerIP = ratelimit.NewKeyed(10, 20)
+	bannedIPs = newExpiringSet(100)
+	unknownKeys = newExpiringSet(100)
+	store = storage.NewMemory()
+	forgetPlans()
+	apiKey.Prefix = apikey.Prefix(testKey)
+	if err := store.PutApiKey(context.Background(), apikey.Hash(testKey), apiKey); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	return upstream
+}
+
+func getPrices(query string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+	res := httptest.NewRecorder()
+	newRouter().ServeHTTP(res, req)
+	return res
+}
+
+func TestPowerPriceHandler(t *testing.T) {
+	upstream := setupTest(t, storage.ApiKey{Quota: 10})
+
+	res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	var prices map[string]calculator.PricePoint
+	if err := json.NewDecoder(res.Body).Decode(&prices); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	pricePoint, ok := prices["2025-01-22T00:00:00+01:00"]
+	if !ok {
+		t.Fatalf("expected a price for 2025-01-22T00:00:00+01:00, got %v", prices)
+	}
+	if pricePoint.PriceMWhEUR != 47.14 {
+		t.Errorf("expected the price to be 47.14, was %f", pricePoint.PriceMWhEUR)
+	}
+	if pricePoint.ExchangeRateDate != "2025-01-21" {
+		t.Errorf("expected the exchange rate from 2025-01-21, was from %s", pricePoint.ExchangeRateDate)
+	}
+
+	// the second request is served from the cache
+	res = getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if requests := upstream.Requests(upstreamtest.EntsoePath); requests != 1 {
+		t.Errorf("expected 1 request to ENTSO-E, got %d", requests)
+	}
+}
+
+func TestPricesV2(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 10})
+	get := func(query string) (*httptest.ResponseRecorder, pricesResponse) {
+		req := httptest.NewRequest(http.MethodGet, "/v2/prices?"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+testKey)
+		res := httptest.NewRecorder()
+		newRouter().ServeHTTP(res, req)
+		var response pricesResponse
+		json.NewDecoder(res.Body).Decode(&response)
+		return res, response
+	}
+
+	res, response := get("zone=NO2&date=2025-01-22")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", res.Code)
+	}
+	if response.Zone != "NO2" || response.Date != "2025-01-22" || response.Currency != "NOK" || response.Resolution != resolution60Minutes {
+		t.Errorf("expected the zone, date, currency and resolution, got %+v", response)
+	}
+	if len(response.Prices) != 24 || response.Prices[0].PriceMWhEUR != 47.14 {
+		t.Fatalf("expected 24 prices starting with 47.14 EUR/MWh, got %+v", response.Prices)
+	}
+	for i, price := range response.Prices {
+		if i > 0 && !price.Start.Equal(response.Prices[i-1].End) {
+			t.Errorf("expected the prices to be ordered, %s came after %s", price.Start, response.Prices[i-1].End)
+		}
+	}
+	if response.Metadata.ExchangeRateDate != "2025-01-21" || response.Metadata.Cache != cacheMiss {
+		t.Errorf("expected the exchange rate date and a cache miss, got %+v", response.Metadata)
+	}
+
+	res, response = get("zone=NO2&date=2025-01-22&resolution=PT15M")
+	if len(response.Prices) != 96 || response.Resolution != resolution15Minutes || response.Metadata.Cache != cacheHit {
+		t.Errorf("expected 96 cached quarters, got %d %s %+v", len(response.Prices), response.Resolution, response.Metadata)
+	}
+	// the quota is shared with /
+	if remaining := res.Header().Get("RateLimit-Remaining"); remaining != "8" {
+		t.Errorf("expected 8 requests left, got %q", remaining)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey); res.Header().Get("RateLimit-Remaining") != "7" {
+		t.Errorf("expected 7 requests left, got %q", res.Header().Get("RateLimit-Remaining"))
+	}
+
+	if res, _ := get("zone=NO6&date=2025-01-22"); res.Code != http.StatusBadRequest || res.Header().Get("Content-Type") != "application/problem+json" {
+		t.Errorf("expected the same errors as /, got %d %v", res.Code, res.Header())
+	}
+}
+
+func TestPriceFormats(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 20})
+	get := func(path, accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+testKey)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		res := httptest.NewRecorder()
+		newRouter().ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("/?zone=NO2&date=2025-01-22&format=csv", "")
+	if res.Code != http.StatusOK || res.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Fatalf("expected CSV, got %d %v: %s", res.Code, res.Header(), res.Body)
+	}
+	csvBody := res.Body.String()
+	rows, err := csv.NewReader(res.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if len(rows) != 25 || strings.Join(rows[0], ",") != "NOK_per_kWh,EUR_per_MWh,exchange_rate,exchange_rate_date,valid_from,valid_to,provisional" {
+		t.Fatalf("expected a header row and 24 prices, got %v", rows)
+	}
+	if row := rows[1]; row[1] != "47.14" || row[3] != "2025-01-21" || row[4] != "2025-01-22T00:00:00+01:00" || row[6] != "false" {
+		t.Errorf("expected the first hour, got %v", row)
+	}
+
+	if res := get("/v2/prices?zone=NO2&date=2025-01-22", "text/csv"); res.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("expected CSV for Accept: text/csv, got %v", res.Header())
+	}
+	if res := get("/?zone=NO2&date=2025-01-22", "text/csv;q=0.5, application/json"); res.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("expected JSON when it is preferred, got %v", res.Header())
+	}
+
+	res = get("/?zone=NO2&date=2025-01-22&format=tsv", "")
+	if res.Header().Get("Content-Type") != "text/tab-separated-values; charset=utf-8" || strings.ReplaceAll(res.Body.String(), "\t", ",") != csvBody {
+		t.Errorf("expected the CSV separated by tabs, got %s", res.Body)
+	}
+
+	res = get("/?zone=NO2&date=2025-01-22&format=table", "")
+	lines := strings.Split(strings.TrimSpace(res.Body.String()), "\n")
+	if len(lines) != 25 || !strings.HasPrefix(lines[0], "NOK_per_kWh  EUR_per_MWh  exchange_rate") {
+		t.Fatalf("expected a table with a header row, got %s", res.Body)
+	}
+	if column := strings.Index(lines[0], "valid_from"); strings.Index(lines[1], "2025-01-22T00:00:00+01:00") != column {
+		t.Errorf("expected the columns to be aligned, got %s", res.Body)
+	}
+
+	res = get("/?zone=NO2&date=2025-01-22&format=xml", "")
+	var p problem
+	json.NewDecoder(res.Body).Decode(&p)
+	if res.Code != http.StatusBadRequest || p.Code != codeInvalidFormat || len(p.ValidFormats) != 4 {
+		t.Errorf("expected invalid_format, got %d %+v", res.Code, p)
+	}
+
+	// the day before is the same prices a day earlier
+	ctx := context.Background()
+	zone := calculator.Zones["NO2"]
+	_, cache, _ := store.GetCache(ctx, time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc), zone)
+	dayBefore := storage.PriceDocument{Prices: map[string]calculator.PricePoint{}}
+	for _, price := range cache.Prices {
+		price.From, price.To = price.From.AddDate(0, 0, -1), price.To.AddDate(0, 0, -1)
+		dayBefore.Prices[price.From.Format(time.RFC3339)] = price
+	}
+	if err := store.StoreCache(ctx, time.Date(2025, 1, 21, 0, 0, 0, 0, common.Loc), zone, dayBefore); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	res = get("/?zone=NO2&from=2025-01-21&to=2025-01-22&format=csv", "")
+	rows, err = csv.NewReader(res.Body).ReadAll()
+	if res.Code != http.StatusOK || err != nil || len(rows) != 49 {
+		t.Fatalf("expected a header row and 48 prices, got %d %v (%v)", res.Code, rows, err)
+	}
+	if rows[1][4] != "2025-01-21T00:00:00+01:00" || rows[48][5] != "2025-01-23T00:00:00+01:00" {
+		t.Errorf("expected the prices of both days in order, got %v and %v", rows[1], rows[48])
+	}
+	if disposition := res.Header().Get("Content-Disposition"); !strings.Contains(disposition, "2025-01-21-to-2025-01-22") {
+		t.Errorf("expected the range in the file name, got %q", disposition)
+	}
+
+	res = get("/?zone=NO2&from=2025-01-21&to=2025-01-22", "")
+	p = problem{}
+	json.NewDecoder(res.Body).Decode(&p)
+	if res.Code != http.StatusBadRequest || p.Code != codeInvalidFormat || len(p.ValidFormats) != 3 {
+		t.Errorf("expected invalid_format for a JSON range, got %d %+v", res.Code, p)
+	}
+
+	// start over with a full burst
+	keyRateLimits = ratelimit.NewKeyed(60, 10)
+	for _, query := range []string{
+		"from=2025-01-21",
+		"to=2025-01-22",
+		"from=2025-01-22&to=2025-01-21",
+		"from=2024-12-01&to=2025-01-22",
+		"date=2025-01-22&from=2025-01-21&to=2025-01-22",
+	} {
+		res = get("/?zone=NO2&format=csv&"+query, "")
+		p = problem{}
+		json.NewDecoder(res.Body).Decode(&p)
+		if res.Code != http.StatusBadRequest || p.Code != codeInvalidDate {
+			t.Errorf("expected invalid_date for %s, got %d %+v", query, res.Code, p)
+		}
+	}
+}
+
+func TestPowerPriceHandlerErrors(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 1})
+	store.PutApiKey(context.Background(), apikey.Hash("blocked-key"), storage.ApiKey{Blocked: true, Reason: "abuse", Quota: 10})
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		code   string
+	}{
+		{"missing zone", "date=2025-01-22&key=" + testKey, http.StatusBadRequest, codeInvalidZone},
+		{"invalid zone", "zone=NO6&date=2025-01-22&key=" + testKey, http.StatusBadRequest, codeInvalidZone},
+		{"invalid date", "zone=NO2&date=22.01.2025&key=" + testKey, http.StatusBadRequest, codeInvalidDate},
+		{"missing key", "zone=NO2&date=2025-01-22", http.StatusUnauthorized, codeMissingApiKey},
+		{"unknown key", "zone=NO2&date=2025-01-22&key=unknown", http.StatusUnauthorized, codeInvalidApiKey},
+		{"blocked key", "zone=NO2&date=2025-01-22&key=blocked-key", http.StatusForbidden, codeKeyBlocked},
+		{"not available yet", "zone=NO2&date=2025-01-23&key=" + testKey, http.StatusTooEarly, codePricesNotAvailableYet},
+		{"not published yet", "zone=NO2&date=2099-01-01&key=" + testKey, http.StatusBadRequest, codePricesNotAvailableYet},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			res := getPrices(test.query)
+			if res.Code != test.status {
+				t.Errorf("expected status %d, got %d: %s", test.status, res.Code, res.Body)
+			}
+			var p problem
+			if err := json.NewDecoder(res.Body).Decode(&p); err != nil || p.Code != test.code || p.Status != test.status {
+				t.Errorf("expected a problem with the code %s, got %+v (%v)", test.code, p, err)
+			}
+			if contentType := res.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("expected Content-Type application/problem+json, was %q", contentType)
+			}
+		})
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 1})
+
+	res := getPrices("zone=NO6&date=2025-01-22&key=" + testKey)
+	var p problem
+	json.NewDecoder(res.Body).Decode(&p)
+	if p.Detail != "NO6 is not a valid zone! Valid zones are NO1, NO2, NO3, NO4 and NO5" || fmt.Sprint(p.ValidZones) != "[NO1 NO2 NO3 NO4 NO5]" {
+		t.Errorf("expected the message and the valid zones, got %+v", p)
+	}
+
+	res = getPrices("zone=NO2&date=2099-01-01&key=" + testKey)
+	p = problem{}
+	json.NewDecoder(res.Body).Decode(&p)
+	if want := time.Date(2098, 12, 31, 14, 0, 0, 0, common.Loc); p.ExpectedPublication == nil || !p.ExpectedPublication.Equal(want) {
+		t.Errorf("expected the prices to be published at %s, got %+v", want, p)
+	}
+
+	getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	res = getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	p = problem{}
+	json.NewDecoder(res.Body).Decode(&p)
+	if p.Code != codeQuotaExceeded || p.Quota != 1 || p.QuotaReset == nil || strconv.Itoa(p.RetryAfter) != res.Header().Get("Retry-After") {
+		t.Errorf("expected the quota and when it is reset, got %+v", p)
+	}
+
+	// the messages are still available as plain text
+	req := httptest.NewRequest(http.MethodGet, "/?zone=NO6&date=2025-01-22&key="+testKey, nil)
+	req.Header.Set("Accept", "text/plain")
+	res = httptest.NewRecorder()
+	newRouter().ServeHTTP(res, req)
+	if !strings.HasPrefix(res.Header().Get("Content-Type"), "text/plain") || res.Body.String() != "NO6 is not a valid zone! Valid zones are NO1, NO2, NO3, NO4 and NO5\n" {
+		t.Errorf("expected the message as plain text, got %v: %s", res.Header(), res.Body)
+	}
+}
+
+func TestWantsPlainText(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"application/json", false},
+		{"text/plain", true},
+		{"text/*", true},
+		{"text/plain, */*", true},
+		{"text/plain;q=0.5, application/json", false},
+		{"application/problem+json;q=0.5, text/plain", true},
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", false},
+		{"text/plain;q=0", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept", test.accept)
+		if got := wantsPlainText(req); got != test.want {
+			t.Errorf("expected %v for %q, got %v", test.want, test.accept, got)
+		}
+	}
+}
+
+func TestPowerPriceHandlerQuota(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 1})
+
+	res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if limit := res.Header().Get("RateLimit-Limit"); limit != "1" {
+		t.Errorf("expected RateLimit-Limit to be 1, was %q", limit)
+	}
+	if remaining := res.Header().Get("RateLimit-Remaining"); remaining != "0" {
+		t.Errorf("expected RateLimit-Remaining to be 0, was %q", remaining)
+	}
+	reset, err := strconv.Atoi(res.Header().Get("RateLimit-Reset"))
+	if err != nil || reset <= 0 || reset > 25*60*60 {
+		t.Errorf("expected RateLimit-Reset to be the seconds until midnight, was %q", res.Header().Get("RateLimit-Reset"))
+	}
+	res = getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d: %s", res.Code, res.Body)
+	}
+	if retryAfter := res.Header().Get("Retry-After"); retryAfter != strconv.Itoa(reset) && retryAfter != strconv.Itoa(reset-1) {
+		t.Errorf("expected Retry-After to be %d, was %q", reset, retryAfter)
+	}
+	// the quota is per zone
+	if res := getPrices("zone=NO1&date=2025-01-22&key=" + testKey); res.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+}
+
+// uncachedStore never caches prices, so requests that aren't coalesced call
+// ENTSO-E again instead of reading the prices from the cache
+type uncachedStore struct {
+	storage.Store
+}
+
+func (uncachedStore) StoreCache(context.Context, time.Time, calculator.Zone, storage.PriceDocument) error {
+	return nil
+}
+
+// waitFor fails the test if condition isn't true within a second
+// cacheReadCounter counts the calls to GetCache
+type cacheReadCounter struct {
+	storage.Store
+	reads atomic.Int32
+}
+
+func (c *cacheReadCounter) GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (bool, *storage.PriceDocument, error) {
+	c.reads.Add(1)
+	return c.Store.GetCache(ctx, day, zone)
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !condition(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting")
+		}
+	}
+}
+
+func TestConcurrentPriceRequestsAreCoalesced(t *testing.T) {
+	upstream := setupTest(t, storage.ApiKey{Quota: 100})
+	store = uncachedStore{store}
+	release := upstream.Hold(upstreamtest.EntsoePath)
+	defer release()
+
+	// the burst of the rate limit per key
+	const n = 10
+	responses := make(chan *httptest.ResponseRecorder, n)
+	for range n {
+		go func() {
+			responses <- getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+		}()
+	}
+	// give the other requests time to join the one waiting for ENTSO-E
+	waitFor(t, func() bool { return upstream.Requests(upstreamtest.EntsoePath) == 1 })
+	time.Sleep(50 * time.Millisecond)
+	release()
+	for range n {
+		if res := <-responses; res.Code != http.StatusOK {
+			t.Errorf("expected status 200, got %d: %s", res.Code, res.Body)
+		}
+	}
+	if requests := upstream.Requests(upstreamtest.EntsoePath); requests != 1 {
+		t.Errorf("expected 1 request to ENTSO-E, got %d", requests)
+	}
+	if requests := upstream.Requests(upstreamtest.NorgesBankPath); requests != 1 {
+		t.Errorf("expected 1 request to Norges Bank, got %d", requests)
+	}
+}
+
+func TestSharedPriceRequestSurvivesCancellation(t *testing.T) {
+	upstream := setupTest(t, storage.ApiKey{})
+	release := upstream.Hold(upstreamtest.EntsoePath)
+	defer release()
+	date := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := getPriceForecast(ctx, calculator.Zones["NO2"], date)
+		first <- err
+	}()
+	waitFor(t, func() bool { return upstream.Requests(upstreamtest.EntsoePath) == 1 })
+	second := make(chan error, 1)
+	go func() {
+		_, err := getPriceForecast(context.Background(), calculator.Zones["NO2"], date)
+		second <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	// the request that started the fetch goes away
+	cancel()
+	release()
+
+	if err := <-second; err != nil {
+		t.Errorf("expected the shared fetch to not be canceled, got %v", err)
+	}
+	<-first
+	if requests := upstream.Requests(upstreamtest.EntsoePath); requests != 1 {
+		t.Errorf("expected 1 request to ENTSO-E, got %d", requests)
+	}
+	if ok, _, _ := store.GetCache(context.Background(), date, calculator.Zones["NO2"]); !ok {
+		t.Errorf("expected the prices to be cached")
+	}
+}
+
+func TestProvisionalPricesWithCachedExchangeRate(t *testing.T) {
+	upstream := setupTest(t, storage.ApiKey{Quota: 10})
+	upstream.SetFailing(upstreamtest.NorgesBankPath, true)
+
+	// a new instance doesn't know any rates
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey); res.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500 without any known rate, got %d: %s", res.Code, res.Body)
+	}
+	// and remembers that the cache didn't have one either
+	counting := &cacheReadCounter{Store: store}
+	store = counting
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey); res.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500 without any known rate, got %d: %s", res.Code, res.Body)
+	}
+	if counting.reads.Load() != 1 {
+		t.Errorf("expected only the prices for the date to be read, got %d reads", counting.reads.Load())
+	}
+	cachedExchangeRateMisses = newExpiringSet(100)
+
+	from := time.Date(2025, 1, 20, 0, 0, 0, 0, common.Loc)
+	err := store.StoreCache(context.Background(), from, calculator.Zones["NO2"], storage.PriceDocument{
+		Prices: map[string]calculator.PricePoint{
+			from.Format(time.RFC3339): {PriceMWhEUR: 50, ExchangeRate: 11.5, ExchangeRateDate: "2025-01-17", From: from, To: from.Add(time.Hour)},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if res.Code != http.StatusOK || res.Header().Get("X-Provisional") != "true" {
+		t.Fatalf("expected provisional prices, got %d: %s", res.Code, res.Body)
+	}
+	var prices map[string]calculator.PricePoint
+	json.NewDecoder(res.Body).Decode(&prices)
+	if price := prices["2025-01-22T00:00:00+01:00"]; price.ExchangeRate != 11.5 || price.ExchangeRateDate != "2025-01-17" {
+		t.Errorf("expected the exchange rate of the cached prices, got %+v", price)
+	}
+}
+
+func TestCheckForRevision(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 10})
+	store = storage.NewLRU(store, 10, time.Minute, 0)
+	ctx := context.Background()
+	day := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	zone := calculator.Zones["NO2"]
+	err := store.StoreCache(ctx, day, zone, storage.PriceDocument{
+		Prices: map[string]calculator.PricePoint{
+			"2025-01-22T00:00:00+01:00": {PriceMWhEUR: 1, ExchangeRate: 11, ExchangeRateDate: "2025-01-21"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if replaced, err := checkForRevision(ctx, zone, day); !replaced || err != nil {
+		t.Fatalf("expected the prices to be replaced, got %t %v", replaced, err)
+	}
+	// the in-memory cache must have the new revision as well
+	_, cache, _ := store.GetCache(ctx, day, zone)
+	if cache.Revision != 1 {
+		t.Errorf("expected cache to be replaced with revision 1, was revision %d", cache.Revision)
+	}
+	pricePoint := cache.Prices["2025-01-22T00:00:00+01:00"]
+	if pricePoint.PriceMWhEUR != 47.14 || pricePoint.ExchangeRate != 11 {
+		t.Errorf("expected corrected price with the cached exchange rate, got %+v", pricePoint)
+	}
+
+	res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if revision := res.Header().Get("X-Price-Revision"); revision != "1" {
+		t.Errorf("expected X-Price-Revision header to be 1, was %q", revision)
+	}
+}
+
+func TestCheckForRevisionReadsThePersistentStore(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 10})
+	persistent := store
+	store = storage.NewLRU(persistent, 10, time.Minute, 0)
+	ctx := context.Background()
+	day := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	zone := calculator.Zones["NO2"]
+	if err := store.StoreCache(ctx, day, zone, storage.PriceDocument{}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	// another instance has already stored the new revision
+	if err := persistent.StoreCache(ctx, day, zone, storage.PriceDocument{Revision: 1}); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if replaced, err := checkForRevision(ctx, zone, day); replaced || err != nil {
+		t.Errorf("expected the stored revision to be the newest, got %t %v", replaced, err)
+	}
+}
+
+func TestMetricsAreOnlyForAdmins(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 10})
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+
+	for path, want := range map[string]int{"/debug/vars": http.StatusNotFound, "/admin/debug/vars": http.StatusUnauthorized} {
+		res := httptest.NewRecorder()
+		newRouter().ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		if res.Code != want {
+			t.Errorf("expected status %d for %s without the admin token, got %d", want, path, res.Code)
+		}
+	}
+	res := adminRequest(t, http.MethodGet, "/debug/vars", "")
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"auth"`) {
+		t.Errorf("expected the metrics, got %d: %.200s", res.Code, res.Body)
+	}
+}
+
+func TestAdminCheckRevisions(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 10})
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+
+	res := adminRequest(t, http.MethodPost, "/revisions/check", "")
+	if res.Code != http.StatusOK || strings.TrimSpace(res.Body.String()) != `{"replaced":0}` {
+		t.Errorf("expected nothing to be replaced, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestFailedRequestsDoesNotConsumeQuota(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 1})
+
+	// there are no prices for 2025-01-23 in the stand-in
+	if res := getPrices("zone=NO2&date=2025-01-23&key=" + testKey); res.Code != http.StatusTooEarly {
+		t.Fatalf("expected status 425, got %d: %s", res.Code, res.Body)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey); res.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 100, RequestsPerMinute: 1, Burst: 2})
+
+	// the first request uses the default limit, because the key isn't known
+	// yet, then the bucket is capped to the burst of the key
+	for range 3 {
+		if res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey); res.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+		}
+	}
+	res := getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d: %s", res.Code, res.Body)
+	}
+	if retryAfter := res.Header().Get("Retry-After"); retryAfter == "" {
+		t.Errorf("expected Retry-After header")
+	}
+	if limit := res.Header().Get("RateLimit-Limit"); limit != "1" {
+		t.Errorf("expected RateLimit-Limit to be 1, was %q", limit)
+	}
+	if remaining := res.Header().Get("RateLimit-Remaining"); remaining != "0" {
+		t.Errorf("expected RateLimit-Remaining to be 0, was %q", remaining)
+	}
+	// the rate limited request doesn't count towards the quota
+	usage, _ := store.GetKeyUsage(context.Background(), apikey.Hash(testKey))
+	if usage.GetZoneCount("NO2") != 3 {
+		t.Errorf("expected usage of 3, got %d", usage.GetZoneCount("NO2"))
+	}
+}
+
+func TestUsageHandler(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 10})
+	getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+
+	req := httptest.NewRequest(http.MethodGet, "/usage?key="+testKey, nil)
+	res := httptest.NewRecorder()
+	newRouter().ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	var usage usageResponse
+	if err := json.NewDecoder(res.Body).Decode(&usage); err != nil {
+		t.Fatal(err)
+	}
+	if usage.Quota != 10 {
+		t.Errorf("expected quota 10, got %d", usage.Quota)
+	}
+	if len(usage.Zones) != len(calculator.Zones) {
+		t.Errorf("expected usage for all %d zones, got %d", len(calculator.Zones), len(usage.Zones))
+	}
+	if zone := usage.Zones["NO2"]; zone.Used != 2 || zone.Remaining != 8 {
+		t.Errorf("expected 2 used and 8 remaining in NO2, got %+v", zone)
+	}
+	if zone := usage.Zones["NO1"]; zone.Used != 0 || zone.Remaining != 10 {
+		t.Errorf("expected 0 used and 10 remaining in NO1, got %+v", zone)
+	}
+	if usage.Endpoints[endpointPrices] != 2 {
+		t.Errorf("expected 2 requests to %s, got %d", endpointPrices, usage.Endpoints[endpointPrices])
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/usage?key=unknown", nil)
+	res = httptest.NewRecorder()
+	newRouter().ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestAdminUsageReport(t *testing.T) {
+	setupTest(t, storage.ApiKey{Email: "test@example.com", Quota: 1})
+	ctx := context.Background()
+	store.PutApiKey(ctx, "other-key", storage.ApiKey{Email: "other@example.com", Quota: 10})
+	store.ConsumeQuota(ctx, apikey.Hash(testKey), endpointPrices, "NO1", storage.Quota{Daily: 1})
+	store.ConsumeQuota(ctx, apikey.Hash(testKey), endpointPrices, "NO1", storage.Quota{Daily: 1})
+	for _, zone := range []string{"NO1", "NO2"} {
+		store.ConsumeQuota(ctx, "other-key", endpointPrices, zone, storage.Quota{Daily: 10})
+	}
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+	handler := requireAdmin(http.HandlerFunc(adminUsageReportHandler))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/usage", nil)
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 without the admin token, got %d: %s", res.Code, res.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/usage?top=1", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	var report usageReport
+	if err := json.NewDecoder(res.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Requests != 3 || report.Rejected != 1 || report.Zones["NO1"] != 2 || report.RejectedZones["NO1"] != 1 {
+		t.Errorf("expected 3 requests (2 in NO1) and 1 rejected in NO1, got %+v", report.usageTotals)
+	}
+	if day := report.Days[time.Now().In(common.Loc).Format(common.StdDateFormat)]; day == nil || day.Requests != 3 {
+		t.Errorf("expected 3 requests today, got %+v", report.Days)
+	}
+	if len(report.Keys) != 1 || report.Keys[0].ID != "other-key" || report.Keys[0].Email != "other@example.com" {
+		t.Errorf("expected other-key to be the top consumer, got %+v", report.Keys)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/admin/usage?from=2025-01-02&to=2025-01-01", nil)
+	req.Header.Set("Authorization", "Bearer admin-token")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, req)
+	if res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 when from is after to, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func adminRequest(t *testing.T, method, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+	req.Header.Set("X-Admin-User", "ola")
+	res := httptest.NewRecorder()
+	adminRouter().ServeHTTP(res, req)
+	return res
+}
+
+func TestAdminApiKeyLifecycle(t *testing.T) {
+	setupTest(t, storage.ApiKey{Email: "kari@example.com", Quota: 1})
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+
+	res := adminRequest(t, http.MethodPost, "/keys", `{"email":"ola@example.com","name":"home assistant"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	var created createdApiKey
+	json.NewDecoder(res.Body).Decode(&created)
+	if len(created.Key) < 32 || created.Account == nil || created.Account.Plan != defaultPlan || created.Created.IsZero() {
+		t.Errorf("expected a generated key on the default plan, got %+v", created)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + created.Key); res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "30 days") {
+		t.Errorf("expected the free plan to not include old prices, got %d: %s", res.Code, res.Body)
+	}
+	if res := adminRequest(t, http.MethodPost, "/keys", `{"email":"not an email"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid email, got %d: %s", res.Code, res.Body)
+	}
+
+	res = adminRequest(t, http.MethodPatch, "/keys/"+created.ID, `{"name":"heat pump"}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	_, apiKey, _ := store.GetApiKey(context.Background(), created.ID)
+	if apiKey.Name != "heat pump" || apiKey.Email != "ola@example.com" {
+		t.Errorf("expected the name to be updated, got %+v", apiKey)
+	}
+	res = adminRequest(t, http.MethodPatch, "/accounts/"+created.ID, `{"plan":"commercial"}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	_, account, _ := store.GetAccount(context.Background(), created.ID)
+	if account.Plan != planCommercial {
+		t.Errorf("expected the plan to be updated, got %+v", account)
+	}
+	if res := adminRequest(t, http.MethodPatch, "/accounts/"+created.ID, `{"plan":"gold"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an unknown plan, got %d: %s", res.Code, res.Body)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + created.Key); res.Code != http.StatusOK {
+		t.Errorf("expected the key to work on the commercial plan, got %d: %s", res.Code, res.Body)
+	}
+
+	if res := adminRequest(t, http.MethodPost, "/keys/"+created.ID+"/block", `{}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 when blocking without a reason, got %d: %s", res.Code, res.Body)
+	}
+	if res := adminRequest(t, http.MethodPost, "/keys/"+created.ID+"/block", `{"reason":"abuse"}`); res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + created.Key); res.Code != http.StatusForbidden || !strings.Contains(res.Body.String(), "abuse") {
+		t.Errorf("expected the blocked key to get 403 with the reason, got %d: %s", res.Code, res.Body)
+	}
+	if res := adminRequest(t, http.MethodPost, "/keys/"+created.ID+"/unblock", ""); res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + created.Key); res.Code != http.StatusOK {
+		t.Errorf("expected the unblocked key to work, got %d: %s", res.Code, res.Body)
+	}
+	if res := adminRequest(t, http.MethodPatch, "/keys/unknown", `{"name":"x"}`); res.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown key, got %d: %s", res.Code, res.Body)
+	}
+	if res := adminRequest(t, http.MethodPatch, "/accounts/unknown", `{"quota":5}`); res.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for an unknown account, got %d: %s", res.Code, res.Body)
+	}
+
+	res = adminRequest(t, http.MethodGet, "/keys?email=ola@", "")
+	var apiKeys []storage.ApiKeyEntry
+	json.NewDecoder(res.Body).Decode(&apiKeys)
+	if len(apiKeys) != 1 || apiKeys[0].ID != created.ID {
+		t.Errorf("expected to find the created key by email, got %+v", apiKeys)
+	}
+
+	res = adminRequest(t, http.MethodGet, "/audit-log?key="+created.ID, "")
+	var entries []storage.AuditLogEntry
+	json.NewDecoder(res.Body).Decode(&entries)
+	var actions []string
+	for _, entry := range entries {
+		if entry.Actor != actorAdminToken || entry.Details["claimed_admin_user"] != "ola" {
+			t.Errorf("expected the actor to be the admin token, claiming to be ola, got %+v", entry)
+		}
+		actions = append(actions, entry.Action)
+	}
+	if fmt.Sprint(actions) != "[unblock block update_account update create]" {
+		t.Errorf("expected all actions in the audit log, newest first, got %v", actions)
+	}
+	if entries[2].Details["plan"] != "free -> commercial" {
+		t.Errorf("expected the plan change in the audit log, got %+v", entries[2])
+	}
+}
+
+func signup(body, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Forwarded-For", ip)
+	res := httptest.NewRecorder()
+	signupHandler(res, req)
+	return res
+}
+
+func TestSignup(t *testing.T) {
+	setupTest(t, storage.ApiKey{})
+	capture := mailSender.(*mailer.Capture)
+
+	res := signup(`{"name":"Ola","email":"ola@example.com"}`, "192.0.2.1")
+	if res.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", res.Code, res.Body)
+	}
+	messages := capture.Messages()
+	if len(messages) != 1 || messages[0].To != "ola@example.com" {
+		t.Fatalf("expected a verification email to ola@example.com, got %+v", messages)
+	}
+	link := regexp.MustCompile(`https://\S+/signup/verify\?token=(\S+)`).FindStringSubmatch(messages[0].Body)
+	if link == nil {
+		t.Fatalf("expected a verification link in the email, got %q", messages[0].Body)
+	}
+
+	// opening the link only shows a form, so email scanners don't use it up
+	res = httptest.NewRecorder()
+	verifyFormHandler(res, httptest.NewRequest(http.MethodGet, "/signup/verify?token="+link[1], nil))
+	if !strings.Contains(res.Body.String(), `value="`+link[1]+`"`) {
+		t.Errorf("expected the verify form to contain the token, got %s", res.Body)
+	}
+
+	verify := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/signup/verify", strings.NewReader("token="+link[1]))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		res := httptest.NewRecorder()
+		verifyHandler(res, req)
+		return res
+	}
+	res = verify()
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	key := regexp.MustCompile(`your API key is (\S+)`).FindStringSubmatch(res.Body.String())[1]
+	ok, apiKey, _ := store.GetApiKey(context.Background(), apikey.Hash(key))
+	if !ok || apiKey.Email != "ola@example.com" || apiKey.Name != "Ola" {
+		t.Errorf("expected a key for Ola, got %+v", apiKey)
+	}
+	if _, account, _ := store.GetAccount(context.Background(), apiKey.Account); account == nil || account.Plan != defaultPlan {
+		t.Errorf("expected an account on the default plan, got %+v", account)
+	}
+	if res := verify(); res.Code != http.StatusNotFound {
+		t.Errorf("expected the link to only work once, got %d: %s", res.Code, res.Body)
+	}
+
+	if res := signup(`{"email":"Ola <ola@example.com>"}`, "192.0.2.1"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid email, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestSignupNormalizesEmail(t *testing.T) {
+	setupTest(t, storage.ApiKey{})
+	capture := mailSender.(*mailer.Capture)
+	for i := range maxAccountsPerEmail {
+		store.PutApiKey(context.Background(), fmt.Sprintf("key-%d", i), storage.ApiKey{Email: "ola@example.com"})
+	}
+
+	if res := signup(`{"email":"Ola@Example.COM"}`, "192.0.2.1"); res.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", res.Code, res.Body)
+	}
+	messages := capture.Messages()
+	if len(messages) != 1 || messages[0].To != "ola@example.com" {
+		t.Fatalf("expected a verification email to ola@example.com, got %+v", messages)
+	}
+	token := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(messages[0].Body)[1]
+	req := httptest.NewRequest(http.MethodPost, "/signup/verify", strings.NewReader("token="+token))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res := httptest.NewRecorder()
+	verifyHandler(res, req)
+	if res.Code != http.StatusConflict {
+		t.Errorf("expected the accounts of ola@example.com to count, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestSignupLimits(t *testing.T) {
+	setupTest(t, storage.ApiKey{})
+	signupsPerIP = ratelimit.NewKeyed(1, 2)
+	signupsPerDomain = ratelimit.NewKeyed(1, 3)
+
+	for i, expected := range []int{http.StatusAccepted, http.StatusAccepted, http.StatusTooManyRequests} {
+		res := signup(fmt.Sprintf(`{"email":"user%d@example.com"}`, i), "192.0.2.1")
+		if res.Code != expected {
+			t.Errorf("expected signup %d from the same IP to get status %d, got %d: %s", i, expected, res.Code, res.Body)
+		}
+	}
+	// the other IP may sign up, but there is only one left for the domain
+	for i, expected := range []int{http.StatusAccepted, http.StatusTooManyRequests} {
+		res := signup(fmt.Sprintf(`{"email":"other%d@example.com"}`, i), "192.0.2.2")
+		if res.Code != expected {
+			t.Errorf("expected signup %d to example.com to get status %d, got %d: %s", i, expected, res.Code, res.Body)
+		}
+	}
+	if res := signup(`{"email":"ola@example.org"}`, "192.0.2.3"); res.Code != http.StatusAccepted {
+		t.Errorf("expected signup to another domain to work, got %d: %s", res.Code, res.Body)
+	}
+	// the addresses the client adds to X-Forwarded-For don't get it around
+	// the limit of the IP
+	if res := signup(`{"email":"ola@example.net"}`, "203.0.113.9, 192.0.2.1"); res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the signup to be limited by the IP added by the proxy, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestLegacyApiKeysAreMigrated(t *testing.T) {
+	setupTest(t, storage.ApiKey{})
+	migrateLegacyApiKeys = true
+	t.Cleanup(func() { migrateLegacyApiKeys = false })
+	ctx := context.Background()
+	store.PutApiKey(ctx, "legacy-key", storage.ApiKey{Email: "ola@example.com", Quota: 10})
+	store.ConsumeQuota(ctx, "legacy-key", endpointPrices, "NO2", storage.Quota{Daily: 10})
+
+	res := getPrices("zone=NO2&date=2025-01-22&key=legacy-key")
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected the legacy key to work, got %d: %s", res.Code, res.Body)
+	}
+	if ok, _, _ := store.GetApiKey(ctx, "legacy-key"); ok {
+		t.Errorf("expected the key to no longer be stored in plain text")
+	}
+	ok, apiKey, _ := store.GetApiKey(ctx, apikey.Hash("legacy-key"))
+	if !ok || apiKey.Email != "ola@example.com" || apiKey.Prefix != apikey.Prefix("legacy-key") {
+		t.Errorf("expected the key to be stored by its hash, got %+v", apiKey)
+	}
+	if usage, _ := store.GetKeyUsage(ctx, apikey.Hash("legacy-key")); usage.GetZoneCount("NO2") != 2 {
+		t.Errorf("expected today's usage to be kept, got %+v", usage)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=unknown-key"); strings.Contains(res.Body.String(), "unknown-key") {
+		t.Errorf("expected only the prefix of the key in the response, got %s", res.Body)
+	}
+
+	// only keys that look like legacy keys are looked up in plain text
+	store.PutApiKey(ctx, "../legacy", storage.ApiKey{Quota: 10})
+	if res := getPrices("zone=NO2&date=2025-01-22&key=../legacy"); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected a key that isn't a legacy key to not be migrated, got %d: %s", res.Code, res.Body)
+	}
+
+	migrateLegacyApiKeys = false
+	store.PutApiKey(ctx, "other-legacy-key", storage.ApiKey{Quota: 10})
+	if res := getPrices("zone=NO2&date=2025-01-22&key=other-legacy-key"); res.Code != http.StatusUnauthorized {
+		t.Errorf("expected legacy keys to not work when the migration is turned off, got %d: %s", res.Code, res.Body)
+	}
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+	// the admin API migrates the stored documents, whatever their ID is
+	if res := adminRequest(t, http.MethodPost, "/migrate-keys", ""); res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"migrated":2`) {
+		t.Errorf("expected 2 keys to be migrated, got %d: %s", res.Code, res.Body)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=other-legacy-key"); res.Code != http.StatusOK {
+		t.Errorf("expected the migrated key to work, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestApiKeyHeaders(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 100})
+	tests := []struct {
+		name       string
+		query      string
+		header     http.Header
+		want       int
+		deprecated bool
+	}{
+		{"bearer", "", http.Header{"Authorization": {"Bearer " + testKey}}, http.StatusOK, false},
+		{"lower case scheme", "", http.Header{"Authorization": {"bearer " + testKey}}, http.StatusOK, false},
+		{"x-api-key", "", http.Header{"X-Api-Key": {testKey}}, http.StatusOK, false},
+		{"query parameter", "&key=" + testKey, nil, http.StatusOK, true},
+		{"authorization before x-api-key", "", http.Header{"Authorization": {"Bearer " + testKey}, "X-Api-Key": {"unknown"}}, http.StatusOK, false},
+		{"x-api-key before query parameter", "&key=" + testKey, http.Header{"X-Api-Key": {"unknown"}}, http.StatusUnauthorized, false},
+		{"basic auth", "&key=" + testKey, http.Header{"Authorization": {"Basic " + testKey}}, http.StatusUnauthorized, false},
+		{"no key", "", nil, http.StatusUnauthorized, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?zone=NO2&date=2025-01-22"+test.query, nil)
+			for name, values := range test.header {
+				req.Header[name] = values
+			}
+			res := httptest.NewRecorder()
+			newRouter().ServeHTTP(res, req)
+			if res.Code != test.want {
+				t.Errorf("expected status %d, got %d: %s", test.want, res.Code, res.Body)
+			}
+			if deprecated := res.Header().Get("Deprecation") == "true"; deprecated != test.deprecated {
+				t.Errorf("expected deprecated to be %t, got headers %v", test.deprecated, res.Header())
+			}
+			// shared caches must not serve the prices to callers without the key
+			if cacheControl := res.Header().Get("Cache-Control"); res.Code == http.StatusOK && !strings.HasPrefix(cacheControl, "private,") {
+				t.Errorf("expected the prices to only be cached privately, got Cache-Control %q", cacheControl)
+			}
+		})
+	}
+
+	res := httptest.NewRecorder()
+	corsPreflightHandler(res, httptest.NewRequest(http.MethodOptions, "/", nil))
+	if res.Code != http.StatusNoContent {
+		t.Errorf("expected status 204, got %d", res.Code)
+	}
+	if allowed := res.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(allowed, "Authorization") || !strings.Contains(allowed, "X-API-Key") {
+		t.Errorf("expected the key headers to be allowed, got %q", allowed)
+	}
+}
+
+func accountRequest(method, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	res := httptest.NewRecorder()
+	newRouter().ServeHTTP(res, req)
+	return res
+}
+
+func TestAccountApiKeys(t *testing.T) {
+	// the test key is created before there were accounts
+	setupTest(t, storage.ApiKey{Email: "ola@example.com", Quota: 2})
+	ctx := context.Background()
+
+	res := accountRequest(http.MethodPost, "/keys", testKey, `{"name":"heat pump"}`)
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	var second newAccountApiKey
+	json.NewDecoder(res.Body).Decode(&second)
+	if _, apiKey, _ := store.GetApiKey(ctx, apikey.Hash(testKey)); apiKey.Account != apikey.Hash(testKey) {
+		t.Errorf("expected the test key to be moved to an account with its ID, got %+v", apiKey)
+	}
+
+	// the keys share the quota of the account
+	for i, key := range []string{testKey, second.Key} {
+		if res := getPrices("zone=NO2&date=2025-01-22&key=" + key); res.Code != http.StatusOK {
+			t.Errorf("expected request %d to be allowed, got %d: %s", i, res.Code, res.Body)
+		}
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&key=" + second.Key); res.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the quota of the account to be used up, got %d: %s", res.Code, res.Body)
+	}
+
+	res = accountRequest(http.MethodGet, "/keys", second.Key, "")
+	var keys []accountApiKey
+	json.NewDecoder(res.Body).Decode(&keys)
+	if len(keys) != 2 {
+		t.Fatalf("expected 2 keys in the account, got %+v", keys)
+	}
+	for _, key := range keys {
+		if key.Current != (key.Prefix == second.Prefix) {
+			t.Errorf("expected only the key used for the request to be current, got %+v", keys)
+		}
+	}
+
+	res = accountRequest(http.MethodPost, "/keys/rotate", second.Key, "")
+	if res.Code != http.StatusCreated {
+		t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+	}
+	var rotated newAccountApiKey
+	json.NewDecoder(res.Body).Decode(&rotated)
+	if rotated.Name != "heat pump" {
+		t.Errorf("expected the rotated key to keep the name, got %+v", rotated)
+	}
+	_, old, _ := store.GetApiKey(ctx, apikey.Hash(second.Key))
+	if gracePeriod := time.Until(old.Expires); gracePeriod < keyRotationGracePeriod-time.Minute || gracePeriod > keyRotationGracePeriod {
+		t.Errorf("expected the old key to expire after the grace period, got %s", old.Expires)
+	}
+	for _, key := range []string{second.Key, rotated.Key} {
+		if res := accountRequest(http.MethodGet, "/usage", key, ""); res.Code != http.StatusOK {
+			t.Errorf("expected the key to work during the grace period, got %d: %s", res.Code, res.Body)
+		}
+	}
+	// a rotated key would otherwise be rotated into a key that never expires
+	if res := accountRequest(http.MethodPost, "/keys/rotate", second.Key, ""); res.Code != http.StatusConflict {
+		t.Errorf("expected status 409 when rotating the key again, got %d: %s", res.Code, res.Body)
+	}
+
+	if res := accountRequest(http.MethodDelete, "/keys/"+second.Prefix, testKey, ""); res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res := accountRequest(http.MethodGet, "/usage", second.Key, ""); res.Code != http.StatusUnauthorized || !strings.Contains(res.Body.String(), "expired") {
+		t.Errorf("expected the revoked key to have expired, got %d: %s", res.Code, res.Body)
+	}
+	if res := accountRequest(http.MethodDelete, "/keys/"+second.Prefix, testKey, ""); res.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for a key that is already revoked, got %d: %s", res.Code, res.Body)
+	}
+	if res := accountRequest(http.MethodPost, "/keys", testKey, `{"expires":"2020-01-01T00:00:00Z"}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an expiry in the past, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestRotateApiKeyInFullAccount(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 100})
+	for i := 1; i < maxKeysPerAccount; i++ {
+		if res := accountRequest(http.MethodPost, "/keys", testKey, `{}`); res.Code != http.StatusCreated {
+			t.Fatalf("expected status 201 for key %d, got %d: %s", i, res.Code, res.Body)
+		}
+	}
+	if res := accountRequest(http.MethodPost, "/keys/rotate", testKey, ""); res.Code != http.StatusConflict {
+		t.Errorf("expected status 409 when rotating a key in a full account, got %d: %s", res.Code, res.Body)
+	}
+	if _, apiKey, _ := store.GetApiKey(context.Background(), apikey.Hash(testKey)); !apiKey.Expires.IsZero() {
+		t.Errorf("expected the key to not expire when it can't be rotated, got %+v", apiKey)
+	}
+}
+
+func TestScopedApiKeys(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 100})
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+	createKey := func(scopes string) string {
+		t.Helper()
+		res := adminRequest(t, http.MethodPost, "/keys", `{"email":"ola@example.com","plan":"commercial","scopes":`+scopes+`}`)
+		if res.Code != http.StatusCreated {
+			t.Fatalf("expected status 201, got %d: %s", res.Code, res.Body)
+		}
+		var created createdApiKey
+		json.NewDecoder(res.Body).Decode(&created)
+		return created.Key
+	}
+	partner := createKey(`{"zones":["NO1"],"origins":["https://Example.com"]}`)
+	stats := createKey(`{"endpoints":["stats"]}`)
+	admin := createKey(`{"endpoints":["admin"]}`)
+
+	tests := []struct {
+		name   string
+		key    string
+		zone   string
+		origin string
+		want   int
+	}{
+		{"allowed zone and origin", partner, "NO1", "https://example.com", http.StatusOK},
+		{"other zone", partner, "NO2", "https://example.com", http.StatusForbidden},
+		{"other origin", partner, "NO1", "https://evil.example.com", http.StatusForbidden},
+		{"no origin", partner, "NO1", "", http.StatusForbidden},
+		{"other endpoint", stats, "NO1", "", http.StatusForbidden},
+		{"admin only", admin, "NO1", "", http.StatusForbidden},
+		{"no scopes", testKey, "NO2", "https://evil.example.com", http.StatusOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?zone="+test.zone+"&date=2025-01-22", nil)
+			req.Header.Set("Authorization", "Bearer "+test.key)
+			if test.origin != "" {
+				req.Header.Set("Origin", test.origin)
+			}
+			res := httptest.NewRecorder()
+			newRouter().ServeHTTP(res, req)
+			if res.Code != test.want {
+				t.Errorf("expected status %d, got %d: %s", test.want, res.Code, res.Body)
+			}
+			// browsers may only read the response on the origins of the key
+			allowed := "*"
+			if test.key == partner {
+				allowed = ""
+				if test.origin == "https://example.com" {
+					allowed = test.origin
+				}
+				if vary := res.Header().Values("Vary"); !slices.Contains(vary, "Origin") {
+					t.Errorf("expected the response to vary by Origin, got %v", vary)
+				}
+			}
+			if origin := res.Header().Get("Access-Control-Allow-Origin"); origin != allowed {
+				t.Errorf("expected Access-Control-Allow-Origin %q, got %q", allowed, origin)
+			}
+		})
+	}
+
+	for key, want := range map[string]int{admin: http.StatusOK, testKey: http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/keys", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		res := httptest.NewRecorder()
+		adminRouter().ServeHTTP(res, req)
+		if res.Code != want {
+			t.Errorf("expected status %d from the admin API with %s, got %d: %s", want, apikey.Prefix(key), res.Code, res.Body)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/keys/"+apikey.Hash(stats)+"/block", strings.NewReader(`{"reason":"testing"}`))
+	req.Header.Set("Authorization", "Bearer "+admin)
+	req.Header.Set("X-Admin-User", "kari")
+	adminRouter().ServeHTTP(httptest.NewRecorder(), req)
+	var entries []storage.AuditLogEntry
+	json.NewDecoder(adminRequest(t, http.MethodGet, "/audit-log?key="+apikey.Hash(stats), "").Body).Decode(&entries)
+	if len(entries) == 0 || entries[0].Action != "block" || entries[0].Actor != apikey.Prefix(admin) {
+		t.Errorf("expected the admin key to be the actor of the block, got %+v", entries)
+	}
+
+	if res := accountRequest(http.MethodPost, "/keys", stats, `{}`); res.Code != http.StatusForbidden {
+		t.Errorf("expected keys with scopes to not create keys, got %d: %s", res.Code, res.Body)
+	}
+	for _, scopes := range []string{`{"endpoints":["admin"]}`, `{"zones":["NO6"]}`, `{"origins":["https://example.com/page"]}`} {
+		if res := accountRequest(http.MethodPost, "/keys", testKey, `{"scopes":`+scopes+`}`); res.Code != http.StatusBadRequest {
+			t.Errorf("expected status 400 for the scopes %s, got %d: %s", scopes, res.Code, res.Body)
+		}
+	}
+	res := accountRequest(http.MethodPost, "/keys", testKey, `{"scopes":{"zones":["NO5"]}}`)
+	var created newAccountApiKey
+	json.NewDecoder(res.Body).Decode(&created)
+	res = accountRequest(http.MethodPost, "/keys/rotate", created.Key, "")
+	var rotated newAccountApiKey
+	json.NewDecoder(res.Body).Decode(&rotated)
+	if fmt.Sprint(rotated.Scopes.Zones) != "[NO5]" {
+		t.Errorf("expected the rotated key to keep the scopes, got %+v", rotated)
+	}
+}
+
+func TestPlans(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 100})
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+	res := adminRequest(t, http.MethodPut, "/plans/tiny", `{"daily_quota":5,"monthly_quota":2,"resolutions":["PT60M"]}`)
+	if res.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+	}
+	if res := adminRequest(t, http.MethodPut, "/plans/tiny", `{"resolutions":["P1D"]}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid resolution, got %d: %s", res.Code, res.Body)
+	}
+	res = adminRequest(t, http.MethodGet, "/plans", "")
+	var plans []storage.Plan
+	json.NewDecoder(res.Body).Decode(&plans)
+	var names []string
+	for _, plan := range plans {
+		names = append(names, plan.Name)
+	}
+	if fmt.Sprint(names) != "[commercial free hobby tiny]" {
+		t.Errorf("expected the built-in plans and tiny, got %v", names)
+	}
+
+	res = adminRequest(t, http.MethodPost, "/keys", `{"email":"ola@example.com","plan":"tiny"}`)
+	var created createdApiKey
+	json.NewDecoder(res.Body).Decode(&created)
+	if res := adminRequest(t, http.MethodPost, "/keys", `{"email":"ola@example.com","plan":"tiny","quota":10}`); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a plan with a quota, got %d: %s", res.Code, res.Body)
+	}
+	if res := getPrices("zone=NO2&date=2025-01-22&resolution=PT15M&key=" + created.Key); res.Code != http.StatusForbidden {
+		t.Errorf("expected status 403 for a resolution that isn't in the plan, got %d: %s", res.Code, res.Body)
+	}
+	for _, zone := range []string{"NO1", "NO2"} {
+		if res := getPrices("zone=" + zone + "&date=2025-01-22&resolution=PT60M&key=" + created.Key); res.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", res.Code, res.Body)
+		}
+	}
+	res = getPrices("zone=NO3&date=2025-01-22&key=" + created.Key)
+	if res.Code != http.StatusTooManyRequests || !strings.Contains(res.Body.String(), "monthly quota of 2") {
+		t.Errorf("expected the monthly quota to be used up, got %d: %s", res.Code, res.Body)
+	}
+	if res.Header().Get("RateLimit-Limit") != "2" || res.Header().Get("RateLimit-Remaining") != "0" {
+		t.Errorf("expected the RateLimit headers for the monthly quota, got %v", res.Header())
+	}
+	if retryAfter, _ := strconv.Atoi(res.Header().Get("Retry-After")); retryAfter != secondsUntilMonthlyQuotaReset(time.Now()) {
+		t.Errorf("expected Retry-After to be the start of next month, got %d", retryAfter)
+	}
+
+	// a change to the plan applies to all its accounts
+	adminRequest(t, http.MethodPut, "/plans/tiny", `{"daily_quota":5,"monthly_quota":3}`)
+	if res := getPrices("zone=NO3&date=2025-01-22&key=" + created.Key); res.Code != http.StatusOK {
+		t.Errorf("expected the new monthly quota to apply, got %d: %s", res.Code, res.Body)
+	}
+	res = accountRequest(http.MethodGet, "/usage", created.Key, "")
+	var usage usageResponse
+	json.NewDecoder(res.Body).Decode(&usage)
+	if usage.Plan != "tiny" || usage.Month == nil || usage.Month.Used != 3 || usage.Month.Remaining != 0 {
+		t.Errorf("expected the monthly usage of the tiny plan, got %+v", usage)
+	}
+
+	getPrices("zone=NO2&date=2025-01-22&key=" + testKey)
+	res = adminRequest(t, http.MethodGet, "/usage/monthly", "")
+	var report monthlyUsageReport
+	json.NewDecoder(res.Body).Decode(&report)
+	if len(report.Plans) != 2 || report.Plans[0].Plan != "" || report.Plans[1].Plan != "tiny" || report.Plans[1].Requests != 3 {
+		t.Errorf("expected the usage per plan, got %+v", report)
+	}
+	res = adminRequest(t, http.MethodGet, "/usage/monthly?format=csv", "")
+	if line := fmt.Sprintf("%s,tiny,%s,ola@example.com,,3,1", report.Month, created.ID); !strings.Contains(res.Body.String(), line) {
+		t.Errorf("expected %q in the CSV, got %s", line, res.Body)
+	}
+	if res := adminRequest(t, http.MethodGet, "/usage/monthly?month=2025-13", ""); res.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for an invalid month, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestResample(t *testing.T) {
+	start := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	quarters := map[string]calculator.PricePoint{}
+	for i, price := range []float64{1, 2, 3, 6} {
+		from := start.Add(time.Duration(i) * 15 * time.Minute)
+		quarters[from.Format(time.RFC3339)] = calculator.PricePoint{PriceKWhNOK: price, From: from, To: from.Add(15 * time.Minute)}
+	}
+	hours := resample(quarters, resolution60Minutes)
+	hour, ok := hours[start.Format(time.RFC3339)]
+	if len(hours) != 1 || !ok || hour.PriceKWhNOK != 3 || !hour.To.Equal(start.Add(time.Hour)) {
+		t.Fatalf("expected one hour with the average price 3, got %+v", hours)
+	}
+	quarters = resample(hours, resolution15Minutes)
+	quarter, ok := quarters[start.Add(45*time.Minute).Format(time.RFC3339)]
+	if len(quarters) != 4 || !ok || quarter.PriceKWhNOK != 3 || !quarter.To.Equal(start.Add(time.Hour)) {
+		t.Errorf("expected four quarters with the price of the hour, got %+v", quarters)
+	}
+
+	// a range can have days in both resolutions
+	next := start.Add(time.Hour)
+	quarters[next.Format(time.RFC3339)] = calculator.PricePoint{PriceKWhNOK: 7, From: next, To: next.Add(time.Hour)}
+	if mixed := resample(quarters, resolution15Minutes); len(mixed) != 8 || mixed[next.Add(45*time.Minute).Format(time.RFC3339)].PriceKWhNOK != 7 {
+		t.Errorf("expected the hour to be split into quarters, got %+v", mixed)
+	}
+	if mixed := resample(quarters, resolution60Minutes); len(mixed) != 2 || mixed[next.Format(time.RFC3339)].PriceKWhNOK != 7 {
+		t.Errorf("expected the hour to be kept as it is, got %+v", mixed)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	t.Cleanup(func() { trustedProxyHops = 1 })
+	tests := []struct {
+		hops         int
+		forwardedFor string
+		want         string
+	}{
+		{1, "192.0.2.1", "192.0.2.1"},
+		{1, "203.0.113.9, 192.0.2.1", "192.0.2.1"},
+		{2, "203.0.113.9, 192.0.2.1, 198.51.100.1", "192.0.2.1"},
+		{2, "192.0.2.1", "192.0.2.1"},
+		{2, "", "192.0.2.7"},
+		{0, "203.0.113.9", "192.0.2.7"},
+	}
+	for _, test := range tests {
+		trustedProxyHops = test.hops
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.7:1234"
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if ip := clientIP(req); ip != test.want {
+			t.Errorf("expected %s with %d hops and X-Forwarded-For %q, got %s", test.want, test.hops, test.forwardedFor, ip)
+		}
+	}
+}
+
+func TestAuthFailuresAreThrottled(t *testing.T) {
+	setupTest(t, storage.ApiKey{Quota: 100})
+	authFailuresPerIP = ratelimit.NewKeyed(1, 3)
+	get := func(ip, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?zone=NO2&date=2025-01-22", nil)
+		req.Header.Set("X-Forwarded-For", ip)
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		res := httptest.NewRecorder()
+		newRouter().ServeHTTP(res, req)
+		return res
+	}
+
+	hits := unknownKeyCacheHits.Value()
+	for _, key := range []string{"unknown-key", "unknown-key", ""} {
+		if res := get("192.0.2.1", key); res.Code != http.StatusUnauthorized {
+			t.Fatalf("expected status 401, got %d: %s", res.Code, res.Body)
+		}
+	}
+	if unknownKeyCacheHits.Value() != hits+1 {
+		t.Errorf("expected the unknown key to be looked up once, got %d cache hits", unknownKeyCacheHits.Value()-hits)
+	}
+	if _, banned := bannedIPs.expiresIn("192.0.2.1"); banned {
+		t.Errorf("expected the IP to not be banned before it has used up the burst")
+	}
+	get("192.0.2.1", "unknown-key")
+	res := get("192.0.2.1", testKey)
+	if res.Code != http.StatusTooManyRequests || res.Header().Get("Retry-After") != strconv.Itoa(int(authBanDuration.Seconds())) {
+		t.Errorf("expected the IP to be banned, also with a valid key, got %d %v: %s", res.Code, res.Header(), res.Body)
+	}
+	if res := get("192.0.2.2", testKey); res.Code != http.StatusOK {
+		t.Errorf("expected other IPs to work, got %d: %s", res.Code, res.Body)
+	}
+}
+
+func TestExpiringSet(t *testing.T) {
+	set := newExpiringSet(2)
+	set.add("a", time.Minute)
+	set.add("b", time.Hour)
+	set.add("c", time.Hour)
+	if _, ok := set.expiresIn("a"); ok || set.len() != 2 {
+		t.Errorf("expected the key that expires first to be evicted, got %v", set.expires)
+	}
+	set.add("d", -time.Second)
+	if _, ok := set.expiresIn("d"); ok {
+		t.Errorf("expected an expired key to not be in the set")
+	}
+	set.remove("b")
+	if _, ok := set.expiresIn("b"); ok {
+		t.Errorf("expected a removed key to not be in the set")
+	}
+}
+
+func TestPlayground(t *testing.T) {
+	upstream := setupTest(t, storage.ApiKey{})
+	get := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/?"+query, nil)
+		res := httptest.NewRecorder()
+		newPlaygroundRouter().ServeHTTP(res, req)
+		return res
+	}
+	first := get("zone=NO2&date=2024-01-15")
+	if first.Code != http.StatusOK || first.Header().Get("X-Playground") != "true" {
+		t.Fatalf("expected prices without a key, got %d: %s", first.Code, first.Body)
+	}
+	if cacheControl := first.Header().Get("Cache-Control"); !strings.HasPrefix(cacheControl, "public,") {
+		t.Errorf("expected the playground prices to be public, got Cache-Control %q", cacheControl)
+	}
+	var prices map[string]calculator.PricePoint
+	json.Unmarshal(first.Body.Bytes(), &prices)
+	if len(prices) != 24 {
+		t.Errorf("expected 24 hourly prices, got %d", len(prices))
+	}
+	if second := get("zone=NO2&date=2024-01-15"); second.Body.String() != first.Body.String() {
+		t.Errorf("expected the same prices every time")
+	}
+	if other := get("zone=NO4&date=2024-01-15"); other.Body.String() == first.Body.String() {
+		t.Errorf("expected other prices in another zone")
+	}
+	prices = nil
+	json.Unmarshal(get("zone=NO2&date=2025-10-26").Body.Bytes(), &prices)
+	if len(prices) != 25*4 {
+		t.Errorf("expected 25 hours of quarters when changing from summer time, got %d", len(prices))
+	}
+	for _, price := range prices {
+		if price.PriceMWhEUR <= 0 || price.ExchangeRate <= 0 || price.ExchangeRateDate != "2025-10-24" {
+			t.Fatalf("expected a realistic price, got %+v", price)
+		}
+	}
+	if upstream.Requests(upstreamtest.EntsoePath) != 0 || upstream.Requests(upstreamtest.NorgesBankPath) != 0 {
+		t.Errorf("expected the playground to not call ENTSO-E or Norges Bank")
+	}
+	if ok, _, _ := store.GetCache(context.Background(), time.Date(2024, 1, 15, 0, 0, 0, 0, common.Loc), calculator.Zones["NO2"]); ok {
+		t.Errorf("expected the made up prices to not be cached")
+	}
+
+	tests := []struct {
+		simulate   string
+		want       int
+		retryAfter string
+	}{
+		{"not_available_yet", http.StatusTooEarly, ""},
+		{"rate_limited", http.StatusServiceUnavailable, "30"},
+		{"upstream_down", http.StatusServiceUnavailable, "30"},
+		{"error", http.StatusInternalServerError, ""},
+		{"unknown", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		res := get("zone=NO2&date=2024-01-15&simulate=" + test.simulate)
+		if res.Code != test.want || res.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("expected status %d for %s, got %d %v: %s", test.want, test.simulate, res.Code, res.Header(), res.Body)
+		}
+	}
+	if res := get("zone=NO6&date=2024-01-15"); res.Code != http.StatusBadRequest {
+		t.Errorf("expected the query to be validated, got %d: %s", res.Code, res.Body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/prices?zone=NO2&date=2024-01-15", nil)
+	res := httptest.NewRecorder()
+	newPlaygroundRouter().ServeHTTP(res, req)
+	var response pricesResponse
+	json.NewDecoder(res.Body).Decode(&response)
+	if len(response.Prices) != 24 || response.Metadata.Cache != cacheSynthetic {
+		t.Errorf("expected 24 made up prices, got %+v", response)
+	}
+
+	ADMIN_TOKEN = "admin-token"
+	t.Cleanup(func() { ADMIN_TOKEN = "" })
+	for path, want := range map[string]int{"/debug/vars": http.StatusNotFound, "/admin/debug/vars": http.StatusUnauthorized} {
+		res := httptest.NewRecorder()
+		newPlaygroundRouter().ServeHTTP(res, httptest.NewRequest(http.MethodGet, path, nil))
+		if res.Code != want {
+			t.Errorf("expected status %d for %s without the admin token, got %d", want, path, res.Code)
+		}
+	}
+	req = httptest.NewRequest(http.MethodGet, "/admin/debug/vars", nil)
+	req.Header.Set("Authorization", "Bearer "+ADMIN_TOKEN)
+	res = httptest.NewRecorder()
+	newPlaygroundRouter().ServeHTTP(res, req)
+	if res.Code != http.StatusOK || !strings.Contains(res.Body.String(), `"playground"`) {
+		t.Errorf("expected the metrics with the admin token, got %d", res.Code)
+	}
+}
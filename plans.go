@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+const (
+	planFree       = "free"
+	planHobby      = "hobby"
+	planCommercial = "commercial"
+
+	resolution15Minutes = "PT15M"
+	resolution60Minutes = "PT60M"
+)
+
+var resolutions = []string{resolution15Minutes, resolution60Minutes}
+
+// defaultPlan is the plan of new accounts
+var defaultPlan = getEnv("DEFAULT_PLAN", planFree)
+
+// plansCacheTTL is how long the plans are cached, a change to a plan applies
+// to all its accounts when the cache expires
+var plansCacheTTL = getEnvDuration("PLANS_CACHE_TTL", time.Minute)
+
+// builtinPlans are used until a plan with the same name is stored with
+// PUT /admin/plans/{name}
+func builtinPlans() []storage.Plan {
+	return []storage.Plan{
+		{
+			Name:         planFree,
+			DailyQuota:   defaultQuota,
+			MonthlyQuota: 2000,
+			Resolutions:  []string{resolution60Minutes},
+			HistoryDays:  30,
+		},
+		{
+			Name:              planHobby,
+			DailyQuota:        1000,
+			MonthlyQuota:      20000,
+			RequestsPerMinute: 120,
+			Burst:             20,
+			HistoryDays:       365,
+		},
+		{
+			Name:              planCommercial,
+			DailyQuota:        10000,
+			RequestsPerMinute: 600,
+			Burst:             100,
+		},
+	}
+}
+
+var plans struct {
+	mu      sync.Mutex
+	plans   map[string]storage.Plan
+	fetched time.Time
+}
+
+// getPlans returns the built-in plans with the stored plans on top
+func getPlans(ctx context.Context) (map[string]storage.Plan, error) {
+	plans.mu.Lock()
+	defer plans.mu.Unlock()
+	if plans.plans != nil && time.Since(plans.fetched) < plansCacheTTL {
+		return plans.plans, nil
+	}
+	stored, err := store.ListPlans(ctx)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]storage.Plan{}
+	for _, plan := range append(builtinPlans(), stored...) {
+		all[plan.Name] = plan
+	}
+	plans.plans, plans.fetched = all, time.Now()
+	return all, nil
+}
+
+// forgetPlans makes the next getPlans read the plans from the store
+func forgetPlans() {
+	plans.mu.Lock()
+	defer plans.mu.Unlock()
+	plans.plans = nil
+}
+
+func getPlan(ctx context.Context, name string) (ok bool, plan storage.Plan, err error) {
+	all, err := getPlans(ctx)
+	if err != nil {
+		return false, plan, err
+	}
+	plan, ok = all[name]
+	return ok, plan, nil
+}
+
+// accountPlan returns the plan of the account. Accounts without a plan get
+// a plan with the quota and the rate limit of the account, without a monthly
+// quota or any other limits.
+func accountPlan(ctx context.Context, account *storage.Account) (storage.Plan, error) {
+	if account.Plan == "" {
+		return storage.Plan{
+			DailyQuota:        account.Quota,
+			RequestsPerMinute: account.RequestsPerMinute,
+			Burst:             account.Burst,
+		}, nil
+	}
+	ok, plan, err := getPlan(ctx, account.Plan)
+	if err != nil {
+		return plan, err
+	} else if !ok {
+		return plan, fmt.Errorf("the plan %s doesn't exist", account.Plan)
+	}
+	return plan, nil
+}
+
+func quotaOf(plan storage.Plan) storage.Quota {
+	return storage.Quota{Daily: plan.DailyQuota, Monthly: plan.MonthlyQuota}
+}
+
+// allowsResolution is true if prices can be returned in the resolution, an
+// empty list allows all
+func allowsResolution(plan storage.Plan, resolution string) bool {
+	return len(plan.Resolutions) == 0 || slices.Contains(plan.Resolutions, resolution)
+}
+
+// validatePlanName returns an error if there is no plan with the name
+func validatePlanName(ctx context.Context, name string) error {
+	all, err := getPlans(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := all[name]; !ok {
+		names := make([]string, 0, len(all))
+		for name := range all {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		return fmt.Errorf("%s is not a plan, the plans are %s", name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+func adminListPlansHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	all, err := getPlans(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing plans: %v", err))
+		http.Error(res, "error when listing plans", http.StatusInternalServerError)
+		return
+	}
+	list := make([]storage.Plan, 0, len(all))
+	for _, plan := range all {
+		list = append(list, plan)
+	}
+	slices.SortFunc(list, func(a, b storage.Plan) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	writeJSON(res, req, http.StatusOK, list)
+}
+
+// adminPutPlanHandler creates or replaces a plan, it applies to all accounts
+// on the plan within PLANS_CACHE_TTL
+func adminPutPlanHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	var plan storage.Plan
+	if !readJSON(res, req, &plan) {
+		return
+	}
+	name := chi.URLParam(req, "name")
+	if plan.Name != "" && plan.Name != name {
+		http.Error(res, fmt.Sprintf("the name in the body (%s) isn't the name in the URL (%s)", plan.Name, name), http.StatusBadRequest)
+		return
+	}
+	plan.Name = name
+	if plan.DailyQuota < 0 || plan.MonthlyQuota < 0 || plan.RequestsPerMinute < 0 || plan.Burst < 0 || plan.HistoryDays < 0 {
+		http.Error(res, "daily_quota, monthly_quota, requests_per_minute, burst and history_days can't be negative", http.StatusBadRequest)
+		return
+	}
+	for _, resolution := range plan.Resolutions {
+		if !slices.Contains(resolutions, resolution) {
+			http.Error(res, fmt.Sprintf("%s is not a valid resolution, valid resolutions are %s", resolution, strings.Join(resolutions, ", ")), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := store.PutPlan(ctx, plan); err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when storing the plan %s: %v", name, err))
+		http.Error(res, "error when storing plan: "+name, http.StatusInternalServerError)
+		return
+	}
+	forgetPlans()
+	audit(req, "update_plan", name, map[string]string{"plan": fmt.Sprintf("%+v", plan)})
+	writeJSON(res, req, http.StatusOK, plan)
+}
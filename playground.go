@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/currency"
+	"github.com/karl-gustav/power_price/storage"
+	"github.com/karl-gustav/slogdriver"
+)
+
+const (
+	modeAPI = "api"
+	// modePlayground is for testing clients, no API key is needed and the
+	// prices are made up if they aren't in the cache
+	modePlayground = "playground"
+)
+
+var mode = getEnv("MODE", modeAPI)
+
+// firstDayWithQuarters is the first day ENTSO-E published the day-ahead prices
+// per 15 minutes
+var firstDayWithQuarters = time.Date(2025, 10, 1, 0, 0, 0, 0, common.Loc)
+
+// simulations are the errors the playground returns for simulate=<name>, so
+// clients can test how they handle them
+var simulations = map[string]error{
+	"not_available_yet": calculator.ErrorPricesNotAvialableYet,
+	"rate_limited":      &calculator.RateLimitError{RetryAfter: 30 * time.Second},
+	"upstream_down":     &common.CircuitOpenError{Upstream: "transparency.entsoe.eu", RetryAfter: 30 * time.Second},
+	"error":             errors.New("simulated error"),
+}
+
+// zoneLevels is about the average price in EUR/MWh in each zone, the prices
+// are higher in the south
+var zoneLevels = map[string]float64{
+	"NO1": 60,
+	"NO2": 70,
+	"NO3": 35,
+	"NO4": 20,
+	"NO5": 55,
+}
+
+var (
+	playgroundMetrics   = expvar.NewMap("playground")
+	playgroundCached    = new(expvar.Int)
+	playgroundSynthetic = new(expvar.Int)
+	playgroundSimulated = new(expvar.Int)
+)
+
+func init() {
+	playgroundMetrics.Set("cached", playgroundCached)
+	playgroundMetrics.Set("synthetic", playgroundSynthetic)
+	playgroundMetrics.Set("simulated", playgroundSimulated)
+}
+
+// newPlaygroundRouter is the router for MODE=playground, it only has the
+// prices, the graph and the metrics for admins
+func newPlaygroundRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(slogdriver.WithTraceContext)
+	r.Get("/favicon.ico", notFound)
+	r.With(requireAdmin).Handle("/admin/debug/vars", expvar.Handler())
+	r.Group(func(r chi.Router) {
+		r.Use(cors)
+		r.Options("/", corsPreflightHandler)
+		r.Options("/v2/prices", corsPreflightHandler)
+		r.Get("/", playgroundPriceHandler(writePriceMap))
+		r.Get("/v2/prices", playgroundPriceHandler(writePriceList))
+	})
+	r.Get("/graph", func(res http.ResponseWriter, req *http.Request) {
+		http.ServeFile(res, req, "index.html")
+	})
+	return r
+}
+
+// playgroundPriceHandler is powerPriceHandler without API keys and quotas.
+// The prices are the cached prices, or made up prices if they aren't cached.
+func playgroundPriceHandler(format priceFormat) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		servePlaygroundPrices(res, req, format)
+	}
+}
+
+func servePlaygroundPrices(res http.ResponseWriter, req *http.Request, format priceFormat) {
+	ctx := req.Context()
+	query, ok := parsePriceQuery(res, req, storage.Plan{})
+	if !ok {
+		return
+	}
+	res.Header().Set("X-Playground", "true")
+	if simulate := req.URL.Query().Get("simulate"); simulate != "" {
+		err, ok := simulations[simulate]
+		if !ok {
+			names := make([]string, 0, len(simulations))
+			for name := range simulations {
+				names = append(names, name)
+			}
+			slices.Sort(names)
+			m := fmt.Sprintf("%s is not a simulation, the simulations are %s", simulate, strings.Join(names, ", "))
+			writeProblem(res, req, newProblem(http.StatusBadRequest, codeInvalidSimulation, m))
+			return
+		}
+		playgroundSimulated.Add(1)
+		slog.InfoContext(ctx, fmt.Sprintf("simulating %s for zone %s", simulate, query.shortZone))
+		writePriceError(res, req, query, err)
+		return
+	}
+	forecast, _, _ := priceRangeForecast(query, func(day time.Time) (*priceForecast, error) {
+		return playgroundPriceForecast(ctx, query.shortZone, query.zone, day), nil
+	})
+	writePrices(ctx, res, query, storage.Plan{}, forecast, format)
+}
+
+// playgroundPriceForecast never calls ENTSO-E or Norges Bank, and never stores
+// the made up prices in the cache
+func playgroundPriceForecast(ctx context.Context, shortZone string, zone calculator.Zone, date time.Time) *priceForecast {
+	ok, cache, err := store.GetCache(ctx, date, zone)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when retreving cache: %v", err))
+	}
+	if ok && len(cache.Prices) != 0 {
+		playgroundCached.Add(1)
+		return &priceForecast{
+			Prices:   cache.Prices,
+			Revision: cache.Revision,
+			Created:  cache.CreatedDateTime,
+			Cache:    cacheHit,
+		}
+	}
+	playgroundSynthetic.Add(1)
+	return syntheticPriceForecast(shortZone, date)
+}
+
+// syntheticPriceForecast makes up prices that look like real prices, with
+// peaks in the morning and the afternoon, higher prices in the winter and
+// lower prices in the weekends. The same zone and date always gets the same
+// prices.
+func syntheticPriceForecast(shortZone string, date time.Time) *priceForecast {
+	seed := fnv.New64a()
+	seed.Write([]byte(shortZone + date.Format(common.StdDateFormat)))
+	random := rand.New(rand.NewPCG(seed.Sum64(), 0))
+
+	season := 1 + 0.4*math.Cos(2*math.Pi*float64(date.YearDay()-15)/365)
+	weekend := 1.0
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		weekend = 0.85
+	}
+	level := zoneLevels[shortZone] * season * weekend * (0.7 + 0.6*random.Float64())
+	exchangeRate := syntheticExchangeRate(date)
+
+	resolution := time.Hour
+	if !date.Before(firstDayWithQuarters) {
+		resolution = 15 * time.Minute
+	}
+	prices := map[string]calculator.PricePoint{}
+	end := date.AddDate(0, 0, 1)
+	// Add instead of AddDate, so the days when we change to and from summer
+	// time get 23 and 25 hours
+	for from := date; from.Before(end); from = from.Add(resolution) {
+		hour := float64(from.Hour()) + float64(from.Minute())/60
+		shape := 1 + 0.25*peak(hour, 8, 1.5) + 0.3*peak(hour, 18, 2) - 0.25*peak(hour, 3.5, 2)
+		priceMWhEUR := math.Round(level*shape*(0.95+0.1*random.Float64())*100) / 100
+		prices[from.Format(time.RFC3339)] = calculator.PricePoint{
+			PriceKWhNOK:      priceMWhEUR * exchangeRate.Rate / 1000,
+			PriceMWhEUR:      priceMWhEUR,
+			ExchangeRate:     exchangeRate.Rate,
+			ExchangeRateDate: exchangeRate.Date,
+			From:             from,
+			To:               from.Add(resolution),
+		}
+	}
+	return &priceForecast{
+		Prices:   prices,
+		Revision: 1,
+		// the prices for a day are published around 13:00 the day before
+		Created: date.Add(-11 * time.Hour),
+		Cache:   cacheSynthetic,
+	}
+}
+
+// peak is 1 at the center and goes towards 0 width hours from it
+func peak(hour, center, width float64) float64 {
+	return math.Exp(-math.Pow((hour-center)/width, 2))
+}
+
+// syntheticExchangeRate is a EUR/NOK rate from the last weekday before the
+// date, like the rates from Norges Bank
+func syntheticExchangeRate(date time.Time) currency.ExchangeRate {
+	rateDate := date.AddDate(0, 0, -1)
+	for rateDate.Weekday() == time.Saturday || rateDate.Weekday() == time.Sunday {
+		rateDate = rateDate.AddDate(0, 0, -1)
+	}
+	days := rateDate.Sub(firstDayInDataset).Hours() / 24
+	return currency.ExchangeRate{
+		Rate: math.Round((10.5+0.8*math.Sin(days/180))*10000) / 10000,
+		Date: rateDate.Format(common.StdDateFormat),
+	}
+}
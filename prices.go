@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/currency"
+	"github.com/karl-gustav/power_price/storage"
+	"golang.org/x/sync/singleflight"
+)
+
+// priceRequests makes sure that there is only one request per zone/date going
+// to the cache and upstream at a time, all other requests for the same
+// zone/date waits for that one and shares the result (or the error).
+var priceRequests singleflight.Group
+
+// cachedExchangeRateMisses remembers the zones and dates that
+// rememberCachedExchangeRate didn't find a rate for, so a Norges Bank outage
+// doesn't have every request read a week of cached prices
+var cachedExchangeRateMisses = newExpiringSet(1000)
+
+// cachedExchangeRateMissTTL is how long a miss is remembered, prices cached by
+// other instances are found after this
+const cachedExchangeRateMissTTL = time.Minute
+
+// The cache status of the prices in /v2/prices
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+	// cacheSynthetic is for the made up prices in the playground
+	cacheSynthetic = "synthetic"
+)
+
+type priceForecast struct {
+	Prices map[string]calculator.PricePoint
+	// Revision and Created is the revisionNumber and createdDateTime of the
+	// ENTSO-E document the prices are calculated from, Revision is 0 for prices
+	// cached before we started storing it
+	Revision int
+	Created  time.Time
+	// Provisional is set when the prices are calculated with the last known
+	// exchange rate, these are not cached and should be fetched again later
+	Provisional bool
+	// Cache is cacheHit if the prices were in the cache
+	Cache string
+}
+
+// getPriceForecast returns the price forecast for a zone and date, either from
+// the cache or from ENTSO-E and Norges Bank. The returned forecast is shared
+// between concurrent callers and must not be modified.
+func getPriceForecast(ctx context.Context, zone calculator.Zone, date time.Time) (*priceForecast, error) {
+	requestKey := fmt.Sprintf("%s/%s", zone, date.Format(common.StdDateFormat))
+	// the fetch is shared with other requests, so it can't be canceled just
+	// because the request that started it is
+	sharedCtx := context.WithoutCancel(ctx)
+	result, err, shared := priceRequests.Do(requestKey, func() (any, error) {
+		return fetchPriceForecast(sharedCtx, zone, date)
+	})
+	if shared {
+		slog.DebugContext(ctx, fmt.Sprintf("shared price request for %s with other requests", requestKey))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.(*priceForecast), nil
+}
+
+func fetchPriceForecast(ctx context.Context, zone calculator.Zone, date time.Time) (*priceForecast, error) {
+	ok, cache, err := store.GetCache(ctx, date, zone)
+	if !ok {
+		slog.DebugContext(ctx, fmt.Sprintf(
+			"date/zone %s/%s not found in cache, getting from source",
+			date.Format(common.StdDateFormat),
+			zone,
+		))
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when retreving cache: %v", err))
+	}
+	if ok && len(cache.Prices) != 0 {
+		// makes the rate available if Norges Bank goes down later
+		currency.RememberExchangeRate("EUR", "NOK", cachedExchangeRate(cache))
+		return &priceForecast{
+			Prices:   cache.Prices,
+			Revision: cache.Revision,
+			Created:  cache.CreatedDateTime,
+			Cache:    cacheHit,
+		}, nil
+	}
+
+	powerPrices, err := calculator.GetPrice(ctx, zone, date, SECURITY_TOKEN)
+	if err != nil {
+		return nil, err
+	}
+	exchangeRate, err := currency.GetExchangeRate(ctx, "EUR", "NOK", date)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf(`got error when running getExchangeRate("EUR", "NOK"): %v`, err))
+		lastKnownRate, ok := currency.GetLastKnownExchangeRate("EUR", "NOK", date)
+		if !ok {
+			// a new instance hasn't seen any rates yet
+			rememberCachedExchangeRate(ctx, zone, date)
+			lastKnownRate, ok = currency.GetLastKnownExchangeRate("EUR", "NOK", date)
+		}
+		if !ok {
+			return nil, err
+		}
+		slog.WarnContext(ctx, fmt.Sprintf(
+			"using last known exchange rate from %s for zone %s and date %s",
+			lastKnownRate.Date,
+			zone,
+			date.Format(common.StdDateFormat),
+		))
+		exchangeRate = lastKnownRate
+	}
+	forecast := &priceForecast{
+		Prices:      calculator.CalculatePriceForcast(ctx, *powerPrices, *exchangeRate),
+		Revision:    powerPrices.Revision(),
+		Created:     powerPrices.CreatedDateTime,
+		Provisional: exchangeRate.Provisional,
+		Cache:       cacheMiss,
+	}
+	if forecast.Provisional {
+		// don't cache prices with the wrong exchange rate
+		return forecast, nil
+	}
+
+	err = store.StoreCache(ctx, date, zone, storage.PriceDocument{
+		Prices:          forecast.Prices,
+		Revision:        forecast.Revision,
+		CreatedDateTime: forecast.Created,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when running StoreCache(): %v", err))
+	}
+	return forecast, nil
+}
+
+// rememberCachedExchangeRate remembers the exchange rate of the latest cached
+// prices in the zone before the date, at most currency.MaxExchangeRateAge
+// before it
+func rememberCachedExchangeRate(ctx context.Context, zone calculator.Zone, date time.Time) {
+	key := fmt.Sprintf("%s/%s", zone, date.Format(common.StdDateFormat))
+	if _, ok := cachedExchangeRateMisses.expiresIn(key); ok {
+		return
+	}
+	oldest := date.Add(-currency.MaxExchangeRateAge)
+	for day := date.AddDate(0, 0, -1); !day.Before(oldest); day = day.AddDate(0, 0, -1) {
+		ok, cache, err := store.GetCache(ctx, day, zone)
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when retreving cache: %v", err))
+			return
+		} else if ok && len(cache.Prices) != 0 {
+			currency.RememberExchangeRate("EUR", "NOK", cachedExchangeRate(cache))
+			return
+		}
+	}
+	cachedExchangeRateMisses.add(key, cachedExchangeRateMissTTL)
+}
+
+// cachedExchangeRate returns the exchange rate the cached prices were
+// calculated with
+func cachedExchangeRate(document *storage.PriceDocument) currency.ExchangeRate {
+	for _, pricePoint := range document.Prices {
+		return currency.ExchangeRate{
+			Rate: pricePoint.ExchangeRate,
+			Date: pricePoint.ExchangeRateDate,
+		}
+	}
+	return currency.ExchangeRate{}
+}
+
+// priceResolution is the resolution the prices are published in, ENTSO-E
+// publishes prices per hour or per 15 minutes
+func priceResolution(prices map[string]calculator.PricePoint) string {
+	for _, price := range prices {
+		if price.From.Minute() != 0 {
+			return resolution15Minutes
+		}
+	}
+	return resolution60Minutes
+}
+
+// allOfLength is true if all the intervals of the prices are the length
+func allOfLength(prices map[string]calculator.PricePoint, length time.Duration) bool {
+	for _, price := range prices {
+		if price.To.Sub(price.From) != length {
+			return false
+		}
+	}
+	return true
+}
+
+// resample returns the prices in another resolution. The price of an hour is
+// the average of its quarters, and the price of a quarter is the price of its
+// hour. The prices can be in both resolutions, like the days of a range, and
+// are returned as they are if they already all are in the resolution.
+func resample(prices map[string]calculator.PricePoint, resolution string) map[string]calculator.PricePoint {
+	length := time.Hour
+	if resolution == resolution15Minutes {
+		length = 15 * time.Minute
+	}
+	if allOfLength(prices, length) {
+		return prices
+	}
+	resampled := map[string]calculator.PricePoint{}
+	if resolution == resolution15Minutes {
+		for key, price := range prices {
+			if price.To.Sub(price.From) == length {
+				resampled[key] = price
+				continue
+			}
+			for start := price.From; start.Before(price.From.Add(time.Hour)); start = start.Add(15 * time.Minute) {
+				quarter := price
+				quarter.From, quarter.To = start, start.Add(15*time.Minute)
+				resampled[start.In(common.Loc).Format(time.RFC3339)] = quarter
+			}
+		}
+		return resampled
+	}
+	quarters := map[string]int{}
+	for _, price := range prices {
+		start := price.From.Truncate(time.Hour)
+		key := start.In(common.Loc).Format(time.RFC3339)
+		hour, ok := resampled[key]
+		if !ok {
+			hour = price
+			hour.From, hour.To = start, start.Add(time.Hour)
+			hour.PriceKWhNOK, hour.PriceMWhEUR = 0, 0
+		}
+		hour.PriceKWhNOK += price.PriceKWhNOK
+		hour.PriceMWhEUR += price.PriceMWhEUR
+		hour.Provisional = hour.Provisional || price.Provisional
+		resampled[key] = hour
+		quarters[key]++
+	}
+	for key, hour := range resampled {
+		hour.PriceKWhNOK /= float64(quarters[key])
+		hour.PriceMWhEUR /= float64(quarters[key])
+		resampled[key] = hour
+	}
+	return resampled
+}
+
+// checkForRevisions checks every interval if ENTSO-E has published a new
+// revision of the prices for the last days, and replaces the cached prices
+// if it has. It runs until ctx is canceled.
+//
+// Cloud Run only gives an instance CPU while it handles requests, unless CPU
+// is always allocated, so the ticks can be late or skipped. Set
+// REVISION_CHECK_INTERVAL to 0 and call POST /admin/revisions/check from
+// Cloud Scheduler instead to have the checks run on time.
+func checkForRevisions(ctx context.Context, days int, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		checkRecentRevisions(ctx, days)
+	}
+}
+
+// checkRecentRevisions checks the prices for tomorrow and the last days in all
+// zones for new revisions, and returns how many was replaced
+func checkRecentRevisions(ctx context.Context, days int) (replaced int) {
+	today := getStartOfDay(time.Now())
+	for day := today.AddDate(0, 0, 1-days); !day.After(today.AddDate(0, 0, 1)); day = day.AddDate(0, 0, 1) {
+		for shortZone, zone := range calculator.Zones {
+			ok, err := checkForRevision(ctx, zone, day)
+			if err != nil && !errors.Is(err, calculator.ErrorPricesNotAvialableYet) {
+				slog.ErrorContext(ctx, fmt.Sprintf(
+					"got error when checking for new revision for zone %s and date %s: %v",
+					shortZone,
+					day.Format(common.StdDateFormat),
+					err,
+				))
+			}
+			if ok {
+				replaced++
+			}
+		}
+	}
+	return replaced
+}
+
+// checkForRevision replaces the cached prices if ENTSO-E has a newer
+// revision. The cached revision is read from the persistent store, since the
+// in-memory cache can be behind a revision stored by another instance.
+func checkForRevision(ctx context.Context, zone calculator.Zone, day time.Time) (replaced bool, err error) {
+	ok, cache, err := storage.Persistent(store).GetCache(ctx, day, zone)
+	if err != nil || !ok {
+		// nothing to correct, the next request for it gets the newest revision
+		return false, err
+	}
+	powerPrices, err := calculator.GetPrice(ctx, zone, day, SECURITY_TOKEN)
+	if err != nil {
+		return false, err
+	}
+	if powerPrices.Revision() <= cache.Revision {
+		return false, nil
+	}
+	slog.InfoContext(ctx, fmt.Sprintf(
+		"replacing revision %d with revision %d of the prices for zone %s and date %s",
+		cache.Revision,
+		powerPrices.Revision(),
+		zone,
+		day.Format(common.StdDateFormat),
+	))
+	// the exchange rate for the day doesn't change, so there's no need to ask
+	// Norges Bank for it again. Storing through the in-memory cache replaces
+	// the prices it has for the day.
+	err = store.StoreCache(ctx, day, zone, storage.PriceDocument{
+		Prices:          calculator.CalculatePriceForcast(ctx, *powerPrices, cachedExchangeRate(cache)),
+		Revision:        powerPrices.Revision(),
+		CreatedDateTime: powerPrices.CreatedDateTime,
+	})
+	return err == nil, err
+}
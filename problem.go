@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/karl-gustav/power_price/common"
+)
+
+// The codes in the problem responses, clients can rely on them not changing
+// even when the messages do
+const (
+	codeMissingApiKey         = "missing_api_key"
+	codeInvalidApiKey         = "invalid_api_key"
+	codeKeyExpired            = "key_expired"
+	codeKeyBlocked            = "key_blocked"
+	codeKeyNotAllowed         = "key_not_allowed"
+	codeTooManyAuthFailures   = "too_many_auth_failures"
+	codeRateLimited           = "rate_limited"
+	codeQuotaExceeded         = "quota_exceeded"
+	codeInvalidZone           = "invalid_zone"
+	codeInvalidDate           = "invalid_date"
+	codeInvalidResolution     = "invalid_resolution"
+	codeInvalidFormat         = "invalid_format"
+	codeNotInPlan             = "not_in_plan"
+	codePricesNotAvailableYet = "prices_not_available_yet"
+	codeUpstreamError         = "upstream_error"
+	codeInternalError         = "internal_error"
+	// codeInvalidSimulation is only in the playground
+	codeInvalidSimulation = "invalid_simulation"
+)
+
+// problem is an application/problem+json body (RFC 9457). Detail is the
+// message that used to be the plain text body, the other fields after Code
+// are only set for the codes they help with.
+type problem struct {
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail"`
+	Code   string `json:"code"`
+
+	ValidZones       []string `json:"valid_zones,omitempty"`
+	DateFormat       string   `json:"date_format,omitempty"`
+	FirstDate        string   `json:"first_date,omitempty"`
+	ValidResolutions []string `json:"valid_resolutions,omitempty"`
+	ValidFormats     []string `json:"valid_formats,omitempty"`
+	Plan             string   `json:"plan,omitempty"`
+	// ExpectedPublication is when the prices for the date are published
+	ExpectedPublication *time.Time `json:"expected_publication,omitempty"`
+	// RetryAfter is in seconds, the same as the Retry-After header
+	RetryAfter int        `json:"retry_after,omitempty"`
+	Quota      int        `json:"quota,omitempty"`
+	QuotaReset *time.Time `json:"quota_reset,omitempty"`
+	SignupURL  string     `json:"signup_url,omitempty"`
+}
+
+func newProblem(status int, code, detail string) problem {
+	return problem{Title: http.StatusText(status), Status: status, Detail: detail, Code: code}
+}
+
+// writeProblem writes the problem as application/problem+json, or only the
+// detail as text/plain if the client asks for that with the Accept header
+func writeProblem(res http.ResponseWriter, req *http.Request, p problem) {
+	if wantsPlainText(req) {
+		http.Error(res, p.Detail, p.Status)
+		return
+	}
+	res.Header().Del("Content-Length")
+	res.Header().Set("Content-Type", "application/problem+json")
+	res.Header().Set("X-Content-Type-Options", "nosniff")
+	res.WriteHeader(p.Status)
+	if err := json.NewEncoder(res).Encode(p); err != nil {
+		slog.ErrorContext(req.Context(), fmt.Sprintf("got error when encoding problem: %v", err))
+	}
+}
+
+// wantsPlainText is true if the Accept header prefers text/plain to JSON
+func wantsPlainText(req *http.Request) bool {
+	return prefersToJSON(req, "text/plain", "text/*")
+}
+
+// prefersToJSON is true if the Accept header prefers one of the media types
+// to JSON. A media type that is as good as */* wins, so
+// "Accept: text/plain, */*" prefers text/plain.
+func prefersToJSON(req *http.Request, mediaTypes ...string) bool {
+	wanted, json, any := -1.0, -1.0, -1.0
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			q = value
+		}
+		switch {
+		case slices.Contains(mediaTypes, mediaType):
+			wanted = max(wanted, q)
+		case mediaType == "application/problem+json" || mediaType == "application/json" || mediaType == "application/*":
+			json = max(json, q)
+		case mediaType == "*/*":
+			any = max(any, q)
+		}
+	}
+	if wanted <= 0 {
+		return false
+	} else if json >= 0 {
+		return wanted > json
+	}
+	return wanted >= any
+}
+
+// pricesPublished is about when ENTSO-E publishes the prices for the date
+func pricesPublished(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), date.Day()-1, 14, 0, 0, 0, common.Loc)
+}
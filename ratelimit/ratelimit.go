@@ -0,0 +1,167 @@
+// Package ratelimit has token bucket rate limits per key, e.g. per API key or
+// per IP address.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// idleTimeout is how long a key can be unused before it is forgotten, after
+// that the bucket would have been full again anyway for all sane limits
+const idleTimeout = 10 * time.Minute
+
+// Keyed is a token bucket per key. All keys have the same limit, unless it is
+// changed for a key with SetLimit.
+type Keyed struct {
+	requestsPerMinute int
+	burst             int
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	limiter           *rate.Limiter
+	requestsPerMinute int
+	lastUsed          time.Time
+}
+
+func NewKeyed(requestsPerMinute, burst int) *Keyed {
+	return &Keyed{
+		requestsPerMinute: requestsPerMinute,
+		burst:             burst,
+		buckets:           map[string]*bucket{},
+		lastSweep:         time.Now(),
+	}
+}
+
+// Result is the state of the bucket for a key after a call to Allow.
+type Result struct {
+	Allowed           bool
+	RequestsPerMinute int
+	Burst             int
+	// Remaining is how many requests can be made right now
+	Remaining int
+	// RetryAfter is how long until the next request can be made, 0 if
+	// Remaining is above 0
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again
+	Reset time.Duration
+}
+
+// Allow takes a token from the bucket for key if there is one.
+func (k *Keyed) Allow(key string) Result {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+	k.sweep(now)
+	b := k.bucket(key)
+	b.lastUsed = now
+	allowed := b.limiter.AllowN(now, 1)
+	tokens := b.limiter.TokensAt(now)
+	limit := float64(b.limiter.Limit())
+	result := Result{
+		Allowed:           allowed,
+		RequestsPerMinute: b.requestsPerMinute,
+		Burst:             b.limiter.Burst(),
+		Remaining:         max(int(tokens), 0),
+		Reset:             secondsToDuration((float64(b.limiter.Burst()) - tokens) / limit),
+	}
+	if tokens < 1 {
+		result.RetryAfter = secondsToDuration((1 - tokens) / limit)
+	}
+	return result
+}
+
+// SetLimit changes the limit for one key, a limit of 0 resets it to the
+// default limit.
+func (k *Keyed) SetLimit(key string, requestsPerMinute, burst int) {
+	if requestsPerMinute <= 0 {
+		requestsPerMinute = k.requestsPerMinute
+	}
+	if burst <= 0 {
+		burst = k.burst
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	b, ok := k.buckets[key]
+	if !ok {
+		k.buckets[key] = newBucket(requestsPerMinute, burst)
+		return
+	}
+	if b.requestsPerMinute == requestsPerMinute && b.limiter.Burst() == burst {
+		return
+	}
+	// the tokens that are left carries over to the new limit, but never more
+	// than the new burst
+	now := time.Now()
+	tokens := min(b.limiter.TokensAt(now), float64(burst))
+	b.requestsPerMinute = requestsPerMinute
+	b.limiter = rate.NewLimiter(perMinute(requestsPerMinute), burst)
+	if used := burst - int(math.Floor(tokens)); used > 0 {
+		b.limiter.AllowN(now, used)
+	}
+}
+
+func newBucket(requestsPerMinute, burst int) *bucket {
+	return &bucket{
+		limiter:           rate.NewLimiter(perMinute(requestsPerMinute), burst),
+		requestsPerMinute: requestsPerMinute,
+		lastUsed:          time.Now(),
+	}
+}
+
+func (k *Keyed) bucket(key string) *bucket {
+	b, ok := k.buckets[key]
+	if !ok {
+		b = newBucket(k.requestsPerMinute, k.burst)
+		k.buckets[key] = b
+	}
+	return b
+}
+
+// sweep forgets the keys that hasn't been used for a while, so the map
+// doesn't grow forever
+func (k *Keyed) sweep(now time.Time) {
+	if now.Sub(k.lastSweep) < time.Minute {
+		return
+	}
+	k.lastSweep = now
+	for key, b := range k.buckets {
+		if now.Sub(b.lastUsed) > idleTimeout {
+			delete(k.buckets, key)
+		}
+	}
+}
+
+// SetHeaders sets the RateLimit-* headers and Retry-After when the request
+// isn't allowed.
+func (r Result) SetHeaders(header http.Header) {
+	header.Set("RateLimit-Limit", strconv.Itoa(r.RequestsPerMinute))
+	header.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	header.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(r.Reset)))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%d;w=60;burst=%d", r.RequestsPerMinute, r.Burst))
+	if !r.Allowed {
+		header.Set("Retry-After", strconv.Itoa(ceilSeconds(r.RetryAfter)))
+	}
+}
+
+func perMinute(requests int) rate.Limit {
+	return rate.Limit(float64(requests) / 60)
+}
+
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
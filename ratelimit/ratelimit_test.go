@@ -0,0 +1,38 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyed(t *testing.T) {
+	limits := NewKeyed(60, 2)
+	for range 2 {
+		if result := limits.Allow("a"); !result.Allowed {
+			t.Fatalf("expected request to be allowed, got %+v", result)
+		}
+	}
+	result := limits.Allow("a")
+	if result.Allowed {
+		t.Fatalf("expected request to be denied, got %+v", result)
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > time.Second {
+		t.Errorf("expected to retry after less than a second, was %s", result.RetryAfter)
+	}
+	if result := limits.Allow("b"); !result.Allowed || result.Remaining != 1 {
+		t.Errorf("expected other keys to have their own bucket, got %+v", result)
+	}
+}
+
+func TestKeyedSetLimit(t *testing.T) {
+	limits := NewKeyed(60, 1)
+	limits.SetLimit("a", 120, 3)
+	for range 3 {
+		if result := limits.Allow("a"); !result.Allowed {
+			t.Fatalf("expected request to be allowed, got %+v", result)
+		}
+	}
+	if result := limits.Allow("a"); result.Allowed || result.RequestsPerMinute != 120 {
+		t.Errorf("expected request to be denied with a limit of 120, got %+v", result)
+	}
+}
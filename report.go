@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+const (
+	defaultReportDays = 30
+	maxReportDays     = 366
+	defaultTopKeys    = 10
+)
+
+// usageTotals is the sum of the usage for some keys and days
+type usageTotals struct {
+	Requests      int            `json:"requests"`
+	Rejected      int            `json:"rejected"`
+	Zones         map[string]int `json:"zones"`
+	RejectedZones map[string]int `json:"rejected_zones"`
+	Endpoints     map[string]int `json:"endpoints"`
+}
+
+type usageReport struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	usageTotals
+	Days map[string]*usageTotals `json:"days"`
+	// Keys is ordered by the number of requests, the most used key first
+	Keys []*keyUsage `json:"keys,omitempty"`
+}
+
+type keyUsage struct {
+	// ID is the ID of the account, the hash of its first key
+	ID     string `json:"id"`
+	Prefix string `json:"prefix,omitempty"`
+	Email  string `json:"email,omitempty"`
+	Name   string `json:"name,omitempty"`
+	usageTotals
+}
+
+func newUsageTotals() usageTotals {
+	return usageTotals{Zones: map[string]int{}, RejectedZones: map[string]int{}, Endpoints: map[string]int{}}
+}
+
+func (t *usageTotals) add(usage storage.Usage) {
+	for zone, count := range usage.Zones {
+		t.Zones[zone] += count
+		t.Requests += count
+	}
+	for zone, count := range usage.Rejected {
+		t.RejectedZones[zone] += count
+		t.Rejected += count
+	}
+	for endpoint, count := range usage.Endpoints {
+		t.Endpoints[endpoint] += count
+	}
+}
+
+// buildUsageReport sums up the usage per day and per key
+func buildUsageReport(usages []storage.DailyUsage, from, to time.Time) usageReport {
+	report := usageReport{
+		From:        from.Format(common.StdDateFormat),
+		To:          to.Format(common.StdDateFormat),
+		usageTotals: newUsageTotals(),
+		Days:        map[string]*usageTotals{},
+	}
+	keys := map[string]*keyUsage{}
+	for _, daily := range usages {
+		report.add(daily.Usage)
+		day, ok := report.Days[daily.Date]
+		if !ok {
+			totals := newUsageTotals()
+			day = &totals
+			report.Days[daily.Date] = day
+		}
+		day.add(daily.Usage)
+		key, ok := keys[daily.Key]
+		if !ok {
+			key = &keyUsage{ID: daily.Key, usageTotals: newUsageTotals()}
+			keys[daily.Key] = key
+			report.Keys = append(report.Keys, key)
+		}
+		key.add(daily.Usage)
+	}
+	sort.SliceStable(report.Keys, func(i, j int) bool {
+		if report.Keys[i].Requests != report.Keys[j].Requests {
+			return report.Keys[i].Requests > report.Keys[j].Requests
+		}
+		return report.Keys[i].Rejected > report.Keys[j].Rejected
+	})
+	return report
+}
+
+// parseDateRange reads the from and to query parameters, the default is the
+// last 30 days
+func parseDateRange(req *http.Request) (from, to time.Time, err error) {
+	to = getStartOfDay(time.Now().In(common.Loc))
+	if queryTo := req.URL.Query().Get("to"); queryTo != "" {
+		if to, err = time.ParseInLocation(common.StdDateFormat, queryTo, common.Loc); err != nil {
+			return from, to, fmt.Errorf("could not parse to=%s, in the format %s", queryTo, common.StdDateFormat)
+		}
+	}
+	from = to.AddDate(0, 0, -(defaultReportDays - 1))
+	if queryFrom := req.URL.Query().Get("from"); queryFrom != "" {
+		if from, err = time.ParseInLocation(common.StdDateFormat, queryFrom, common.Loc); err != nil {
+			return from, to, fmt.Errorf("could not parse from=%s, in the format %s", queryFrom, common.StdDateFormat)
+		}
+	}
+	if from.After(to) {
+		return from, to, fmt.Errorf("from (%s) is after to (%s)", from.Format(common.StdDateFormat), to.Format(common.StdDateFormat))
+	}
+	if to.Sub(from) >= maxReportDays*24*time.Hour {
+		return from, to, fmt.Errorf("the date range can't be longer than %d days", maxReportDays)
+	}
+	return from, to, nil
+}
+
+// usageHistoryHandler returns the usage of the account per zone and day, it
+// doesn't count towards the quota
+func usageHistoryHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	c := callerFrom(ctx)
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		p := newProblem(http.StatusBadRequest, codeInvalidDate, err.Error())
+		p.DateFormat = common.StdDateFormat
+		writeProblem(res, req, p)
+		return
+	}
+	usages, err := store.ListUsage(ctx, c.accountID, from, to)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing usage for key %s: %v", c.prefix, err))
+		writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when getting usage for api key: "+c.prefix))
+		return
+	}
+	report := buildUsageReport(usages, from, to)
+	// the key is the caller, so there is no need to list it
+	report.Keys = nil
+	writeJSON(res, req, http.StatusOK, report)
+}
+
+// adminUsageReportHandler returns the usage of all keys, with the top
+// consumers (top=10 by default)
+func adminUsageReportHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	from, to, err := parseDateRange(req)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	top := defaultTopKeys
+	if queryTop := req.URL.Query().Get("top"); queryTop != "" {
+		if top, err = strconv.Atoi(queryTop); err != nil || top < 1 {
+			http.Error(res, "top must be a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	usages, err := store.ListUsage(ctx, "", from, to)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing usage: %v", err))
+		http.Error(res, "error when listing usage", http.StatusInternalServerError)
+		return
+	}
+	report := buildUsageReport(usages, from, to)
+	report.Keys = report.Keys[:min(top, len(report.Keys))]
+	for _, key := range report.Keys {
+		ok, apiKey, err := store.GetApiKey(ctx, key.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when getting API key `%s`: %v", key.ID, err))
+			http.Error(res, "error when getting api key: "+key.ID, http.StatusInternalServerError)
+			return
+		} else if ok {
+			key.Prefix, key.Email, key.Name = apiKey.Prefix, apiKey.Email, apiKey.Name
+		}
+	}
+	writeJSON(res, req, http.StatusOK, report)
+}
+
+// planUsage is the usage of the accounts on a plan in a month, the accounts
+// are ordered like in usageReport
+type planUsage struct {
+	// Plan is empty for the accounts with a quota of their own
+	Plan string `json:"plan"`
+	usageTotals
+	Accounts []*keyUsage `json:"accounts"`
+}
+
+type monthlyUsageReport struct {
+	Month string       `json:"month"`
+	Plans []*planUsage `json:"plans"`
+}
+
+// adminMonthlyUsageHandler returns the usage of all accounts in a month
+// (month=YYYY-MM, this month by default) grouped by the plan the accounts are
+// on now, for invoicing. It is a CSV file with a line per account with
+// format=csv.
+func adminMonthlyUsageHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	year, month, _ := time.Now().In(common.Loc).Date()
+	from := time.Date(year, month, 1, 0, 0, 0, 0, common.Loc)
+	if queryMonth := req.URL.Query().Get("month"); queryMonth != "" {
+		var err error
+		if from, err = time.ParseInLocation(monthFormat, queryMonth, common.Loc); err != nil {
+			http.Error(res, fmt.Sprintf("could not parse month=%s, in the format %s", queryMonth, monthFormat), http.StatusBadRequest)
+			return
+		}
+	}
+	to := from.AddDate(0, 1, -1)
+	usages, err := store.ListUsage(ctx, "", from, to)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing usage: %v", err))
+		http.Error(res, "error when listing usage", http.StatusInternalServerError)
+		return
+	}
+	report := monthlyUsageReport{Month: from.Format(monthFormat), Plans: []*planUsage{}}
+	plans := map[string]*planUsage{}
+	for _, account := range buildUsageReport(usages, from, to).Keys {
+		found, stored, _, err := findAccount(ctx, account.ID)
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when getting account `%s`: %v", account.ID, err))
+			http.Error(res, "error when getting account: "+account.ID, http.StatusInternalServerError)
+			return
+		}
+		planName := ""
+		if found {
+			account.Email, account.Name, planName = stored.Email, stored.Name, stored.Plan
+		}
+		plan, ok := plans[planName]
+		if !ok {
+			plan = &planUsage{Plan: planName, usageTotals: newUsageTotals()}
+			plans[planName] = plan
+			report.Plans = append(report.Plans, plan)
+		}
+		plan.Requests += account.Requests
+		plan.Rejected += account.Rejected
+		for zone, count := range account.Zones {
+			plan.Zones[zone] += count
+		}
+		for zone, count := range account.RejectedZones {
+			plan.RejectedZones[zone] += count
+		}
+		for endpoint, count := range account.Endpoints {
+			plan.Endpoints[endpoint] += count
+		}
+		plan.Accounts = append(plan.Accounts, account)
+	}
+	sort.Slice(report.Plans, func(i, j int) bool {
+		return report.Plans[i].Plan < report.Plans[j].Plan
+	})
+	if req.URL.Query().Get("format") != "csv" {
+		writeJSON(res, req, http.StatusOK, report)
+		return
+	}
+	res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	res.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"usage-%s.csv\"", report.Month))
+	res.Header().Set("Cache-Control", "no-store")
+	writer := csv.NewWriter(res)
+	writer.Write([]string{"month", "plan", "account", "email", "name", "requests", "rejected"})
+	for _, plan := range report.Plans {
+		for _, account := range plan.Accounts {
+			writer.Write([]string{
+				report.Month,
+				plan.Plan,
+				account.ID,
+				account.Email,
+				account.Name,
+				strconv.Itoa(account.Requests),
+				strconv.Itoa(account.Rejected),
+			})
+		}
+	}
+	// the status is already sent, so all we can do is log the error
+	if writer.Flush(); writer.Error() != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when writing the monthly usage: %v", writer.Error()))
+	}
+}
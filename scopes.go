@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+// scopeEndpoints are the endpoints a key can be limited to
+var scopeEndpoints = []string{endpointPrices, endpointStats, endpointOptimizers, endpointAdmin}
+
+type callerKey struct{}
+
+// callerFrom returns the caller that requireApiKey put in the context, it is
+// the zero caller if there isn't one
+func callerFrom(ctx context.Context) caller {
+	c, _ := ctx.Value(callerKey{}).(caller)
+	return c
+}
+
+// requireApiKey authenticates the request and checks the scopes of the key
+// before the handler runs. endpoint is empty for the endpoints about the
+// account itself, e.g. /usage, which all keys can use. The zone is checked
+// if there is a zone query parameter, the handler validates it.
+func requireApiKey(endpoint string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			ctx := req.Context()
+			c, ok := authenticate(res, req)
+			if !ok {
+				return
+			}
+			allowOrigins(res.Header(), c.apiKey.Scopes, req)
+			if err := checkScopes(c.apiKey.Scopes, endpoint, req); err != nil {
+				slog.WarnContext(ctx, fmt.Sprintf("denied %s access to %s: %v", c.prefix, req.URL.Path, err))
+				writeProblem(res, req, newProblem(http.StatusForbidden, codeKeyNotAllowed, fmt.Sprintf("the key %s %v", c.prefix, err)))
+				return
+			}
+			next.ServeHTTP(res, req.WithContext(context.WithValue(ctx, callerKey{}, c)))
+		})
+	}
+}
+
+// checkScopes returns an error saying what the key isn't allowed to do
+func checkScopes(scopes storage.Scopes, endpoint string, req *http.Request) error {
+	if endpoint != "" && !allowsEndpoint(scopes, endpoint) {
+		return fmt.Errorf("can't be used for %s", endpoint)
+	}
+	if zone := req.URL.Query().Get("zone"); zone != "" && len(scopes.Zones) > 0 && !slices.Contains(scopes.Zones, zone) {
+		return fmt.Errorf("can't be used for %s, only for %s", zone, strings.Join(scopes.Zones, ", "))
+	}
+	if origin := req.Header.Get("Origin"); len(scopes.Origins) > 0 && !slices.Contains(scopes.Origins, strings.ToLower(origin)) {
+		if origin == "" {
+			return fmt.Errorf("can only be used from a browser on %s", strings.Join(scopes.Origins, ", "))
+		}
+		return fmt.Errorf("can't be used from %s", origin)
+	}
+	return nil
+}
+
+// allowOrigins replaces the wildcard from allowCORS with the origin of the
+// request for keys that can only be used from some origins, so browsers on
+// other sites can't read the response. It varies by Origin, since the
+// response for another origin is different.
+func allowOrigins(header http.Header, scopes storage.Scopes, req *http.Request) {
+	if len(scopes.Origins) == 0 {
+		return
+	}
+	header.Add("Vary", "Origin")
+	if origin := req.Header.Get("Origin"); slices.Contains(scopes.Origins, strings.ToLower(origin)) {
+		header.Set("Access-Control-Allow-Origin", origin)
+	} else {
+		header.Del("Access-Control-Allow-Origin")
+	}
+}
+
+// allowsEndpoint is true if the key can be used for the endpoint. Keys
+// without endpoints can use all endpoints but the admin API.
+func allowsEndpoint(scopes storage.Scopes, endpoint string) bool {
+	if len(scopes.Endpoints) == 0 {
+		return endpoint != endpointAdmin
+	}
+	return slices.Contains(scopes.Endpoints, endpoint)
+}
+
+// validateScopes checks the scopes of a new key and returns them with the
+// origins in lower case. Only admins can create keys for the admin API.
+func validateScopes(scopes storage.Scopes, allowAdmin bool) (storage.Scopes, error) {
+	for _, zone := range scopes.Zones {
+		if _, ok := calculator.Zones[zone]; !ok {
+			return scopes, fmt.Errorf("%s is not a valid zone! Valid zones are NO1, NO2, NO3, NO4 and NO5", zone)
+		}
+	}
+	for _, endpoint := range scopes.Endpoints {
+		if !slices.Contains(scopeEndpoints, endpoint) {
+			return scopes, fmt.Errorf("%s is not a valid endpoint, valid endpoints are %s", endpoint, strings.Join(scopeEndpoints, ", "))
+		} else if endpoint == endpointAdmin && !allowAdmin {
+			return scopes, fmt.Errorf("only admins can create keys for the %s endpoint", endpointAdmin)
+		}
+	}
+	origins := make([]string, 0, len(scopes.Origins))
+	for _, origin := range scopes.Origins {
+		u, err := url.Parse(strings.ToLower(origin))
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.Scheme+"://"+u.Host != strings.ToLower(origin) {
+			return scopes, fmt.Errorf("%q is not a valid origin, it must be like https://example.com", origin)
+		}
+		origins = append(origins, strings.ToLower(origin))
+	}
+	if len(origins) > 0 {
+		scopes.Origins = origins
+	}
+	return scopes, nil
+}
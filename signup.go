@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/karl-gustav/power_price/mailer"
+	"github.com/karl-gustav/power_price/ratelimit"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+const (
+	signupLinkTTL       = 24 * time.Hour
+	maxAccountsPerEmail = 3
+	maxNameLength       = 100
+)
+
+// PUBLIC_URL is where users reach the service, it is used in the
+// verification link
+var PUBLIC_URL = getEnv("PUBLIC_URL", "https://norway-power.ffail.win")
+
+// mailSender only logs the emails unless SMTP_ADDR is set
+var mailSender mailer.Mailer = mailer.NewCapture()
+
+// signups are limited per IP and per email domain, so the signup can't be
+// used to send lots of emails to someone
+var (
+	signupsPerIP     = ratelimit.NewKeyed(1, 5)
+	signupsPerDomain = ratelimit.NewKeyed(5, 20)
+)
+
+var signupForm = template.Must(template.New("signup").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Sign up for an API key</title></head>
+<body>
+	<h1>Sign up for a free API key</h1>
+	<form method="post" action="/signup">
+		<p><label>Name <input name="name" maxlength="100"></label></p>
+		<p><label>Email <input name="email" type="email" required></label></p>
+		<p><button type="submit">Send verification email</button></p>
+	</form>
+</body>
+</html>
+`))
+
+// verifyForm is a form instead of verifying on GET, because email scanners
+// open the links in emails and would use up the token
+var verifyForm = template.Must(template.New("verify").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Verify your email</title></head>
+<body>
+	<h1>Get your API key</h1>
+	<form method="post" action="/signup/verify">
+		<input type="hidden" name="token" value="{{.}}">
+		<p><button type="submit">Create API key</button></p>
+	</form>
+</body>
+</html>
+`))
+
+type signupRequest struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+func signupFormHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	signupForm.Execute(res, nil)
+}
+
+// signupHandler takes a JSON body or a form with name and email, and sends a
+// verification link to the email
+func signupHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	var body signupRequest
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		if !readJSON(res, req, &body) {
+			return
+		}
+	} else {
+		body.Name, body.Email = req.FormValue("name"), req.FormValue("email")
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	address, err := mail.ParseAddress(body.Email)
+	if err != nil || address.Address != body.Email {
+		http.Error(res, fmt.Sprintf("%q is not a valid email", body.Email), http.StatusBadRequest)
+		return
+	}
+	body.Email = normalizeEmail(body.Email)
+	if len(body.Name) > maxNameLength {
+		http.Error(res, fmt.Sprintf("the name can't be longer than %d characters", maxNameLength), http.StatusBadRequest)
+		return
+	}
+
+	ip := clientIP(req)
+	domain := body.Email[strings.LastIndex(body.Email, "@")+1:]
+	for _, limit := range []struct {
+		limiter *ratelimit.Keyed
+		key     string
+	}{{signupsPerIP, ip}, {signupsPerDomain, domain}} {
+		if result := limit.limiter.Allow(limit.key); !result.Allowed {
+			slog.WarnContext(ctx, fmt.Sprintf("rate limited signup for %s from %s", body.Email, ip))
+			result.SetHeaders(res.Header())
+			http.Error(res, "too many signups, try again later", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when generating signup token: %v", err))
+		http.Error(res, "error when signing up", http.StatusInternalServerError)
+		return
+	}
+	now := time.Now()
+	signup := storage.Signup{
+		Email:   body.Email,
+		Name:    body.Name,
+		IP:      ip,
+		Created: now,
+		Expires: now.Add(signupLinkTTL),
+	}
+	if err = store.PutSignup(ctx, token, signup); err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when storing signup for %s: %v", body.Email, err))
+		http.Error(res, "error when signing up", http.StatusInternalServerError)
+		return
+	}
+	link := fmt.Sprintf("%s/signup/verify?token=%s", strings.TrimSuffix(PUBLIC_URL, "/"), url.QueryEscape(token))
+	err = mailSender.Send(ctx, mailer.Message{
+		To:      body.Email,
+		Subject: "Verify your email to get an API key for Norway power prices",
+		Body: fmt.Sprintf(
+			"Open this link to get your API key:\n\n%s\n\nThe link works for %s. If you didn't sign up you can ignore this email.\n",
+			link,
+			signupLinkTTL,
+		),
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when sending verification email to %s: %v", body.Email, err))
+		http.Error(res, "error when sending the verification email", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(ctx, fmt.Sprintf("sent verification email to %s (%s)", body.Email, ip))
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.WriteHeader(http.StatusAccepted)
+	fmt.Fprintf(res, "we have sent a verification link to %s, open it to get your API key\n", body.Email)
+}
+
+func verifyFormHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", "text/html; charset=utf-8")
+	verifyForm.Execute(res, req.URL.Query().Get("token"))
+}
+
+// verifyHandler creates the API key when the email is verified
+func verifyHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	token := req.FormValue("token")
+	if token == "" {
+		http.Error(res, "token is a required field", http.StatusBadRequest)
+		return
+	}
+	ok, signup, err := store.TakeSignup(ctx, token)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting signup: %v", err))
+		http.Error(res, "error when verifying email", http.StatusInternalServerError)
+		return
+	} else if !ok {
+		http.Error(res, "the link is invalid or has already been used, sign up again at /signup", http.StatusNotFound)
+		return
+	} else if time.Now().After(signup.Expires) {
+		http.Error(res, "the link has expired, sign up again at /signup", http.StatusGone)
+		return
+	}
+
+	accountCount, err := countAccountsForEmail(ctx, signup.Email)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when listing API keys for %s: %v", signup.Email, err))
+		http.Error(res, "error when creating api key", http.StatusInternalServerError)
+		return
+	} else if accountCount >= maxAccountsPerEmail {
+		slog.WarnContext(ctx, fmt.Sprintf("denied signup for %s because it already has %d accounts", signup.Email, accountCount))
+		m := fmt.Sprintf("you already have %d accounts, more API keys can be added to them at /keys", accountCount)
+		http.Error(res, m, http.StatusConflict)
+		return
+	}
+	account := storage.Account{
+		Email:   signup.Email,
+		Name:    signup.Name,
+		Plan:    defaultPlan,
+		Created: time.Now(),
+	}
+	plan, err := accountPlan(ctx, &account)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting the plan for %s: %v", signup.Email, err))
+		http.Error(res, "error when creating api key", http.StatusInternalServerError)
+		return
+	}
+	key, entry, err := createApiKey(ctx, "", account, storage.ApiKey{Name: signup.Name})
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when creating API key for %s: %v", signup.Email, err))
+		http.Error(res, "error when creating api key", http.StatusInternalServerError)
+		return
+	}
+	addAuditLogEntry(ctx, "signup", "create", entry.ID, map[string]string{
+		"prefix": entry.Prefix,
+		"email":  account.Email,
+		"name":   account.Name,
+		"ip":     signup.IP,
+	})
+	res.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	res.Header().Set("Cache-Control", "no-store")
+	res.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(
+		res,
+		"your API key is %s\nkeep it secret, it is on the %s plan with a quota of %d requests per zone per day",
+		key,
+		plan.Name,
+		plan.DailyQuota,
+	)
+	if plan.MonthlyQuota > 0 {
+		fmt.Fprintf(res, " and %d requests per month", plan.MonthlyQuota)
+	}
+	fmt.Fprintln(res)
+}
+
+// normalizeEmail lower-cases the whole email, so Ola@Example.com and
+// ola@example.com are the same account holder. The local part is case
+// sensitive by the RFC, but no email provider we know of treats it that way,
+// and counting them as one is what stops a user from getting more accounts.
+func normalizeEmail(email string) string {
+	return strings.ToLower(email)
+}
+
+// countAccountsForEmail searches for the email as a prefix, so other emails
+// that start with it must be skipped. Emails stored before they were
+// normalized are only counted if they were stored in lower case.
+func countAccountsForEmail(ctx context.Context, email string) (int, error) {
+	email = normalizeEmail(email)
+	apiKeys, err := store.ListApiKeys(ctx, email)
+	if err != nil {
+		return 0, err
+	}
+	accounts := map[string]bool{}
+	for _, apiKey := range apiKeys {
+		if normalizeEmail(apiKey.Email) == email {
+			accounts[apiKey.AccountID(apiKey.ID)] = true
+		}
+	}
+	return len(accounts), nil
+}
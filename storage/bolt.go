@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	pricesBucket   = []byte("prices")
+	apiKeysBucket  = []byte("api-keys")
+	accountsBucket = []byte("accounts")
+	usageBucket    = []byte("usage")
+	// monthlyUsageBucket is keyed like usageBucket, with the month instead of
+	// the date
+	monthlyUsageBucket = []byte("monthly-usage")
+	plansBucket        = []byte("plans")
+	// auditLogBucket is keyed by a sequence number, so the entries are
+	// ordered by when they were added
+	auditLogBucket = []byte("audit-log")
+	signupsBucket  = []byte("signups")
+)
+
+// Bolt is a Store that keeps everything in a single file on disk, for running
+// the service without access to GCP.
+type Bolt struct {
+	db *bolt.DB
+}
+
+func NewBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{pricesBucket, apiKeysBucket, accountsBucket, usageBucket, monthlyUsageBucket, plansBucket, auditLogBucket, signupsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Bolt{db: db}, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (b *Bolt) StoreCache(ctx context.Context, day time.Time, zone calculator.Zone, document PriceDocument) error {
+	return b.put(pricesBucket, cacheKey(day, zone), document)
+}
+
+func (b *Bolt) GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (ok bool, document *PriceDocument, err error) {
+	ok, err = b.get(pricesBucket, cacheKey(day, zone), &document)
+	if !ok || err != nil {
+		return false, nil, err
+	}
+	document.inLoc()
+	return true, document, nil
+}
+
+func (b *Bolt) PutApiKey(ctx context.Context, key string, apiKey ApiKey) error {
+	return b.put(apiKeysBucket, key, apiKey)
+}
+
+func (b *Bolt) GetApiKey(ctx context.Context, key string) (ok bool, apiKey *ApiKey, err error) {
+	ok, err = b.get(apiKeysBucket, key, &apiKey)
+	return ok, apiKey, err
+}
+
+func (b *Bolt) PutAccount(ctx context.Context, id string, account Account) error {
+	return b.put(accountsBucket, id, account)
+}
+
+func (b *Bolt) GetAccount(ctx context.Context, id string) (ok bool, account *Account, err error) {
+	ok, err = b.get(accountsBucket, id, &account)
+	return ok, account, err
+}
+
+func (b *Bolt) GetKeyUsage(ctx context.Context, key string) (*Usage, error) {
+	var usage Usage
+	_, err := b.get(usageBucket, usageKey(key), &usage)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (b *Bolt) GetMonthlyUsage(ctx context.Context, key string) (*Usage, error) {
+	var usage Usage
+	_, err := b.get(monthlyUsageBucket, usageKeyOn(key, monthOf(today())), &usage)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (b *Bolt) ConsumeQuota(ctx context.Context, key, endpoint, shortZone string, quota Quota) (ok bool, remaining Remaining, err error) {
+	err = b.updateUsage(key, func(day, month *Usage) {
+		ok, remaining = consume(day, month, endpoint, shortZone, quota)
+	})
+	return ok, remaining, err
+}
+
+func (b *Bolt) RefundQuota(ctx context.Context, key, endpoint, shortZone string) error {
+	return b.updateUsage(key, func(day, month *Usage) {
+		day.add(endpoint, shortZone, -1)
+		month.add(endpoint, shortZone, -1)
+	})
+}
+
+func (b *Bolt) PutPlan(ctx context.Context, plan Plan) error {
+	return b.put(plansBucket, plan.Name, plan)
+}
+
+func (b *Bolt) ListPlans(ctx context.Context) ([]Plan, error) {
+	var plans []Plan
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// bolt iterates in key order, which is the name
+		return tx.Bucket(plansBucket).ForEach(func(_, value []byte) error {
+			var plan Plan
+			if _, err := decode(value, &plan); err != nil {
+				return err
+			}
+			plans = append(plans, plan)
+			return nil
+		})
+	})
+	return plans, err
+}
+
+func (b *Bolt) ListApiKeys(ctx context.Context, emailPrefix string) ([]ApiKeyEntry, error) {
+	return b.listApiKeys(func(apiKey ApiKey) bool {
+		return hasEmailPrefix(apiKey, emailPrefix)
+	})
+}
+
+func (b *Bolt) ListAccountApiKeys(ctx context.Context, account string) ([]ApiKeyEntry, error) {
+	return b.listApiKeys(func(apiKey ApiKey) bool {
+		return apiKey.Account == account
+	})
+}
+
+// listApiKeys goes through all keys and returns the ones that match
+func (b *Bolt) listApiKeys(match func(apiKey ApiKey) bool) ([]ApiKeyEntry, error) {
+	var apiKeys []ApiKeyEntry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		// bolt iterates in key order
+		return tx.Bucket(apiKeysBucket).ForEach(func(key, value []byte) error {
+			entry := ApiKeyEntry{ID: string(key)}
+			if _, err := decode(value, &entry.ApiKey); err != nil {
+				return err
+			}
+			if match(entry.ApiKey) {
+				apiKeys = append(apiKeys, entry)
+			}
+			return nil
+		})
+	})
+	return apiKeys, err
+}
+
+func (b *Bolt) MigrateApiKey(ctx context.Context, legacyKey, hashedKey, prefix string) (ok bool, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		apiKeys := tx.Bucket(apiKeysBucket)
+		var apiKey ApiKey
+		if ok, err = decode(apiKeys.Get([]byte(legacyKey)), &apiKey); !ok || err != nil {
+			return err
+		}
+		apiKey.Prefix = prefix
+		value, err := encode(apiKey)
+		if err != nil {
+			return err
+		}
+		if err = apiKeys.Put([]byte(hashedKey), value); err != nil {
+			return err
+		}
+		if err = apiKeys.Delete([]byte(legacyKey)); err != nil {
+			return err
+		}
+		if err = moveUsage(tx.Bucket(usageBucket), usageKey(legacyKey), usageKey(hashedKey)); err != nil {
+			return err
+		}
+		month := monthOf(today())
+		return moveUsage(tx.Bucket(monthlyUsageBucket), usageKeyOn(legacyKey, month), usageKeyOn(hashedKey, month))
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+func (b *Bolt) MigrateUsage(ctx context.Context, legacyKey, hashedKey string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range []*bolt.Bucket{tx.Bucket(usageBucket), tx.Bucket(monthlyUsageBucket)} {
+			// the bucket can't be changed while iterating over it
+			var dates []string
+			cursor := bucket.Cursor()
+			legacyPrefix := []byte(legacyKey + "/")
+			for storedKey, _ := cursor.Seek(legacyPrefix); bytes.HasPrefix(storedKey, legacyPrefix); storedKey, _ = cursor.Next() {
+				_, date := splitUsageKey(string(storedKey))
+				dates = append(dates, date)
+			}
+			for _, date := range dates {
+				if err := moveUsage(bucket, usageKeyOn(legacyKey, date), usageKeyOn(hashedKey, date)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// moveUsage adds the usage in from to the usage in to, and deletes from
+func moveUsage(bucket *bolt.Bucket, from, to string) error {
+	var legacy, usage Usage
+	ok, err := decode(bucket.Get([]byte(from)), &legacy)
+	if !ok || err != nil {
+		return err
+	}
+	if _, err = decode(bucket.Get([]byte(to)), &usage); err != nil {
+		return err
+	}
+	usage.merge(legacy)
+	value, err := encode(usage)
+	if err != nil {
+		return err
+	}
+	if err = bucket.Put([]byte(to), value); err != nil {
+		return err
+	}
+	return bucket.Delete([]byte(from))
+}
+
+func (b *Bolt) ListLegacyApiKeys(ctx context.Context) ([]string, error) {
+	legacy := map[string]bool{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		apiKeys := tx.Bucket(apiKeysBucket)
+		err := apiKeys.ForEach(func(key, value []byte) error {
+			var apiKey ApiKey
+			if _, err := decode(value, &apiKey); err != nil {
+				return err
+			}
+			if apiKey.Prefix == "" {
+				legacy[string(key)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(usageBucket).ForEach(func(storedKey, _ []byte) error {
+			if key, _ := splitUsageKey(string(storedKey)); apiKeys.Get([]byte(key)) == nil {
+				legacy[key] = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortedKeys(legacy), nil
+}
+
+func (b *Bolt) AddAuditLogEntry(ctx context.Context, entry AuditLogEntry) error {
+	value, err := encode(entry)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(auditLogBucket)
+		sequence, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		return bucket.Put(binary.BigEndian.AppendUint64(nil, sequence), value)
+	})
+}
+
+func (b *Bolt) ListAuditLog(ctx context.Context, key string, limit int) ([]AuditLogEntry, error) {
+	var entries []AuditLogEntry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(auditLogBucket).Cursor()
+		for k, value := cursor.Last(); k != nil && len(entries) < limit; k, value = cursor.Prev() {
+			var entry AuditLogEntry
+			if _, err := decode(value, &entry); err != nil {
+				return err
+			}
+			if key == "" || entry.Key == key {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (b *Bolt) PutSignup(ctx context.Context, token string, signup Signup) error {
+	return b.put(signupsBucket, token, signup)
+}
+
+func (b *Bolt) TakeSignup(ctx context.Context, token string) (ok bool, signup *Signup, err error) {
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(signupsBucket)
+		if ok, err = decode(bucket.Get([]byte(token)), &signup); !ok || err != nil {
+			return err
+		}
+		return bucket.Delete([]byte(token))
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return ok, signup, nil
+}
+
+func (b *Bolt) ListUsage(ctx context.Context, key string, from, to time.Time) ([]DailyUsage, error) {
+	fromDate, toDate := dateRange(from, to)
+	var usages []DailyUsage
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(usageBucket).ForEach(func(storedKey, value []byte) error {
+			usageKey, date := splitUsageKey(string(storedKey))
+			if (key != "" && usageKey != key) || date < fromDate || date > toDate {
+				return nil
+			}
+			daily := DailyUsage{Key: usageKey, Date: date}
+			if _, err := decode(value, &daily.Usage); err != nil {
+				return err
+			}
+			usages = append(usages, daily)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortDailyUsage(usages)
+	return usages, nil
+}
+
+// updateUsage runs update on today's and this month's usage of the key in one
+// transaction
+func (b *Bolt) updateUsage(key string, update func(day, month *Usage)) error {
+	date := today()
+	dayKey, monthKey := []byte(usageKeyOn(key, date)), []byte(usageKeyOn(key, monthOf(date)))
+	return b.db.Update(func(tx *bolt.Tx) error {
+		days, months := tx.Bucket(usageBucket), tx.Bucket(monthlyUsageBucket)
+		var day, month Usage
+		if _, err := decode(days.Get(dayKey), &day); err != nil {
+			return err
+		}
+		if _, err := decode(months.Get(monthKey), &month); err != nil {
+			return err
+		}
+		update(&day, &month)
+		for _, usage := range []struct {
+			bucket *bolt.Bucket
+			key    []byte
+			usage  Usage
+		}{{days, dayKey, day}, {months, monthKey, month}} {
+			value, err := encode(usage.usage)
+			if err != nil {
+				return err
+			}
+			if err = usage.bucket.Put(usage.key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *Bolt) put(bucket []byte, key string, value any) error {
+	encoded, err := encode(value)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(key), encoded)
+	})
+}
+
+// get decodes the value for key into value, ok is false if the key doesn't exist
+func (b *Bolt) get(bucket []byte, key string, value any) (ok bool, err error) {
+	err = b.db.View(func(tx *bolt.Tx) error {
+		ok, err = decode(tx.Bucket(bucket).Get([]byte(key)), value)
+		return err
+	})
+	return ok, err
+}
+
+func encode(value any) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func decode(data []byte, value any) (ok bool, err error) {
+	if data == nil {
+		return false, nil
+	}
+	// data is only valid inside the transaction, but gob copies what it needs
+	return true, gob.NewDecoder(bytes.NewReader(data)).Decode(value)
+}
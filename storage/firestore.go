@@ -0,0 +1,547 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/karl-gustav/power_price/calculator"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	priceStoragePath  = "power-price/norway-v2"
+	apiKeyStoragePath = "power-price/api-keys/users"
+	accountsPath      = "power-price/api-keys/accounts"
+	auditLogPath      = "power-price/api-keys/audit-log"
+	signupStoragePath = "power-price/api-keys/signups"
+	plansPath         = "power-price/api-keys/plans"
+	DefaultGCPProject = "my-cloud-collection"
+	// legacyEndpoint is the endpoint that was counted in the old usage
+	// documents
+	legacyEndpoint = "prices"
+)
+
+// Firestore is the Store used in production. It uses the same client for all
+// requests, creating a client takes longer than most requests to Firestore.
+type Firestore struct {
+	client *firestore.Client
+}
+
+func NewFirestore(client *firestore.Client) *Firestore {
+	return &Firestore{client: client}
+}
+
+// OpenFirestore creates a client for the GCP project, the client is closed
+// by Close.
+func OpenFirestore(ctx context.Context, gcpProject string) (*Firestore, error) {
+	if gcpProject == "" {
+		gcpProject = DefaultGCPProject
+	}
+	client, err := firestore.NewClient(ctx, gcpProject)
+	if err != nil {
+		return nil, err
+	}
+	return NewFirestore(client), nil
+}
+
+func (f *Firestore) Close() error {
+	return f.client.Close()
+}
+
+func (f *Firestore) StoreCache(ctx context.Context, day time.Time, zone calculator.Zone, document PriceDocument) error {
+	collection := f.client.Doc(fmt.Sprintf("%s/%s", priceStoragePath, cacheKey(day, zone)))
+
+	_, err := collection.Set(ctx, document)
+	return err
+}
+
+// GetCache also reads the documents from before we started storing revisions,
+// where the document only contained the prices.
+func (f *Firestore) GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (ok bool, priceDocument *PriceDocument, err error) {
+	documentRef := f.client.Doc(fmt.Sprintf("%s/%s", priceStoragePath, cacheKey(day, zone)))
+	document, err := documentRef.Get(ctx)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	priceDocument = &PriceDocument{}
+	if _, isRevisioned := document.Data()["prices"]; isRevisioned {
+		err = document.DataTo(priceDocument)
+	} else {
+		err = document.DataTo(&priceDocument.Prices)
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	priceDocument.inLoc()
+	return true, priceDocument, nil
+}
+
+func (f *Firestore) PutApiKey(ctx context.Context, key string, apiKey ApiKey) error {
+	_, err := f.client.Doc(fmt.Sprintf("%s/%s", apiKeyStoragePath, key)).Set(ctx, apiKey)
+	return err
+}
+
+func (f *Firestore) PutAccount(ctx context.Context, id string, account Account) error {
+	_, err := f.client.Doc(fmt.Sprintf("%s/%s", accountsPath, id)).Set(ctx, account)
+	return err
+}
+
+func (f *Firestore) GetAccount(ctx context.Context, id string) (ok bool, account *Account, err error) {
+	document, err := f.client.Doc(fmt.Sprintf("%s/%s", accountsPath, id)).Get(ctx)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	if err = document.DataTo(&account); err != nil {
+		return false, nil, err
+	}
+	return true, account, nil
+}
+
+func (f *Firestore) GetApiKey(ctx context.Context, key string) (ok bool, apiKey *ApiKey, err error) {
+	documentRef := f.client.Doc(fmt.Sprintf(
+		"%s/%s",
+		apiKeyStoragePath,
+		key,
+	))
+	document, err := documentRef.Get(ctx)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return false, nil, nil
+		}
+		return false, nil, err
+	}
+	err = document.DataTo(&apiKey)
+	if err != nil {
+		return false, nil, err
+	}
+	return true, apiKey, nil
+}
+
+// ListApiKeys searches for emailPrefix with a range query on email
+func (f *Firestore) ListApiKeys(ctx context.Context, emailPrefix string) ([]ApiKeyEntry, error) {
+	query := f.client.Collection(apiKeyStoragePath).Query
+	if emailPrefix != "" {
+		query = query.Where("email", ">=", emailPrefix).Where("email", "<", emailPrefix+"\uf8ff")
+	}
+	return f.listApiKeys(ctx, query)
+}
+
+func (f *Firestore) ListAccountApiKeys(ctx context.Context, account string) ([]ApiKeyEntry, error) {
+	return f.listApiKeys(ctx, f.client.Collection(apiKeyStoragePath).Where("account", "==", account))
+}
+
+func (f *Firestore) listApiKeys(ctx context.Context, query firestore.Query) ([]ApiKeyEntry, error) {
+	documents, err := query.Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	apiKeys := make([]ApiKeyEntry, 0, len(documents))
+	for _, document := range documents {
+		entry := ApiKeyEntry{ID: document.Ref.ID}
+		if err = document.DataTo(&entry.ApiKey); err != nil {
+			return nil, err
+		}
+		apiKeys = append(apiKeys, entry)
+	}
+	sortApiKeys(apiKeys)
+	return apiKeys, nil
+}
+
+func (f *Firestore) MigrateApiKey(ctx context.Context, legacyKey, hashedKey, prefix string) (ok bool, err error) {
+	legacyRef := f.client.Doc(fmt.Sprintf("%s/%s", apiKeyStoragePath, legacyKey))
+	hashedRef := f.client.Doc(fmt.Sprintf("%s/%s", apiKeyStoragePath, hashedKey))
+	err = f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// the transaction function can be retried, so the result must be reset
+		ok = false
+		legacyDoc, err := tx.Get(legacyRef)
+		if err != nil {
+			if grpc.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+		var apiKey ApiKey
+		if err = legacyDoc.DataTo(&apiKey); err != nil {
+			return err
+		}
+		// all reads must be done before the first write
+		moveUsage, err := f.readUsageMove(tx, f.usageDoc(legacyKey), f.usageDoc(hashedKey))
+		if err != nil {
+			return err
+		}
+		month := monthOf(today())
+		moveMonthlyUsage, err := f.readUsageMove(tx, f.monthlyUsageDoc(legacyKey, month), f.monthlyUsageDoc(hashedKey, month))
+		if err != nil {
+			return err
+		}
+		apiKey.Prefix = prefix
+		if err = tx.Set(hashedRef, apiKey); err != nil {
+			return err
+		}
+		if err = tx.Delete(legacyRef); err != nil {
+			return err
+		}
+		ok = true
+		if err = moveUsage(); err != nil {
+			return err
+		}
+		return moveMonthlyUsage()
+	})
+	if err != nil {
+		return false, err
+	}
+	return ok, nil
+}
+
+// MigrateUsage moves one day or month at a time, so there is no limit on how
+// many days that can be moved. A day that is moved is deleted in the same
+// transaction, so it can be run again if it fails.
+func (f *Firestore) MigrateUsage(ctx context.Context, legacyKey, hashedKey string) error {
+	for collection, docOn := range map[string]func(key, date string) *firestore.DocumentRef{
+		"usage":         f.usageDocOn,
+		"monthly-usage": f.monthlyUsageDoc,
+	} {
+		legacyRefs, err := f.client.Collection(fmt.Sprintf("%s/%s/%s", apiKeyStoragePath, legacyKey, collection)).DocumentRefs(ctx).GetAll()
+		if err != nil {
+			return err
+		}
+		for _, legacyRef := range legacyRefs {
+			err = f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+				moveUsage, err := f.readUsageMove(tx, legacyRef, docOn(hashedKey, legacyRef.ID))
+				if err != nil {
+					return err
+				}
+				return moveUsage()
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readUsageMove reads the usage in from and to, and returns a function that
+// writes the sum to to and deletes from
+func (f *Firestore) readUsageMove(tx *firestore.Transaction, from, to *firestore.DocumentRef) (move func() error, err error) {
+	fromDoc, err := tx.Get(from)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return func() error { return nil }, nil
+		}
+		return nil, err
+	}
+	legacy, err := readUsage(fromDoc)
+	if err != nil {
+		return nil, err
+	}
+	var usage Usage
+	toDoc, err := tx.Get(to)
+	if err != nil && grpc.Code(err) != codes.NotFound {
+		return nil, err
+	} else if err == nil {
+		if usage, err = readUsage(toDoc); err != nil {
+			return nil, err
+		}
+	}
+	usage.merge(legacy)
+	return func() error {
+		if err := tx.Set(to, usage); err != nil {
+			return err
+		}
+		return tx.Delete(from)
+	}, nil
+}
+
+// ListLegacyApiKeys also finds keys that only has usage left, the key
+// documents are missing but they are still listed by DocumentRefs
+func (f *Firestore) ListLegacyApiKeys(ctx context.Context) ([]string, error) {
+	keyRefs, err := f.client.Collection(apiKeyStoragePath).DocumentRefs(ctx).GetAll()
+	if err != nil || len(keyRefs) == 0 {
+		return nil, err
+	}
+	documents, err := f.client.GetAll(ctx, keyRefs)
+	if err != nil {
+		return nil, err
+	}
+	var legacy []string
+	for _, document := range documents {
+		if !document.Exists() {
+			legacy = append(legacy, document.Ref.ID)
+			continue
+		}
+		if prefix, err := document.DataAt("prefix"); err != nil || prefix == "" {
+			legacy = append(legacy, document.Ref.ID)
+		}
+	}
+	sort.Strings(legacy)
+	return legacy, nil
+}
+
+func (f *Firestore) AddAuditLogEntry(ctx context.Context, entry AuditLogEntry) error {
+	_, _, err := f.client.Collection(auditLogPath).Add(ctx, entry)
+	return err
+}
+
+func (f *Firestore) PutSignup(ctx context.Context, token string, signup Signup) error {
+	_, err := f.client.Doc(fmt.Sprintf("%s/%s", signupStoragePath, token)).Set(ctx, signup)
+	return err
+}
+
+func (f *Firestore) TakeSignup(ctx context.Context, token string) (ok bool, signup *Signup, err error) {
+	documentRef := f.client.Doc(fmt.Sprintf("%s/%s", signupStoragePath, token))
+	err = f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// the transaction function can be retried, so the result must be reset
+		ok, signup = false, nil
+		document, err := tx.Get(documentRef)
+		if err != nil {
+			if grpc.Code(err) == codes.NotFound {
+				return nil
+			}
+			return err
+		}
+		if err = document.DataTo(&signup); err != nil {
+			return err
+		}
+		ok = true
+		return tx.Delete(documentRef)
+	})
+	if err != nil {
+		return false, nil, err
+	}
+	return ok, signup, nil
+}
+
+// ListAuditLog for a key needs a composite index on key and time (descending)
+func (f *Firestore) ListAuditLog(ctx context.Context, key string, limit int) ([]AuditLogEntry, error) {
+	query := f.client.Collection(auditLogPath).Query
+	if key != "" {
+		query = query.Where("key", "==", key)
+	}
+	documents, err := query.OrderBy("time", firestore.Desc).Limit(limit).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditLogEntry, 0, len(documents))
+	for _, document := range documents {
+		var entry AuditLogEntry
+		if err = document.DataTo(&entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (f *Firestore) GetKeyUsage(ctx context.Context, key string) (*Usage, error) {
+	usageDoc, err := f.usageDoc(key).Get(ctx)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return &Usage{}, nil
+		} else {
+			return nil, err
+		}
+	}
+	usage, err := readUsage(usageDoc)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (f *Firestore) GetMonthlyUsage(ctx context.Context, key string) (*Usage, error) {
+	usageDoc, err := f.monthlyUsageDoc(key, monthOf(today())).Get(ctx)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return &Usage{}, nil
+		}
+		return nil, err
+	}
+	usage, err := readUsage(usageDoc)
+	if err != nil {
+		return nil, err
+	}
+	return &usage, nil
+}
+
+func (f *Firestore) ConsumeQuota(ctx context.Context, key, endpoint, shortZone string, quota Quota) (ok bool, remaining Remaining, err error) {
+	err = f.updateUsage(ctx, key, func(day, month *Usage) {
+		ok, remaining = consume(day, month, endpoint, shortZone, quota)
+	})
+	if err != nil {
+		return false, Remaining{}, err
+	}
+	return ok, remaining, nil
+}
+
+func (f *Firestore) RefundQuota(ctx context.Context, key, endpoint, shortZone string) error {
+	return f.updateUsage(ctx, key, func(day, month *Usage) {
+		day.add(endpoint, shortZone, -1)
+		month.add(endpoint, shortZone, -1)
+	})
+}
+
+// updateUsage runs update on today's and this month's usage of the key in a
+// transaction. The transaction function can be retried, so update must set
+// all its results every time.
+func (f *Firestore) updateUsage(ctx context.Context, key string, update func(day, month *Usage)) error {
+	date := today()
+	dayRef, monthRef := f.usageDocOn(key, date), f.monthlyUsageDoc(key, monthOf(date))
+	return f.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		day, err := getUsage(tx, dayRef)
+		if err != nil {
+			return err
+		}
+		month, err := getUsage(tx, monthRef)
+		if err != nil {
+			return err
+		}
+		update(&day, &month)
+		// replaces the whole documents, so old documents are migrated. Rejected
+		// requests are also stored, they are counted in Usage.Rejected
+		if err = tx.Set(dayRef, day); err != nil {
+			return err
+		}
+		return tx.Set(monthRef, month)
+	})
+}
+
+// getUsage reads a usage document in a transaction, a missing document is no
+// usage
+func getUsage(tx *firestore.Transaction, documentRef *firestore.DocumentRef) (Usage, error) {
+	usageDoc, err := tx.Get(documentRef)
+	if err != nil {
+		if grpc.Code(err) == codes.NotFound {
+			return Usage{}, nil
+		}
+		return Usage{}, err
+	}
+	return readUsage(usageDoc)
+}
+
+func (f *Firestore) PutPlan(ctx context.Context, plan Plan) error {
+	_, err := f.client.Collection(plansPath).Doc(plan.Name).Set(ctx, plan)
+	return err
+}
+
+func (f *Firestore) ListPlans(ctx context.Context) ([]Plan, error) {
+	planDocs, err := f.client.Collection(plansPath).Documents(ctx).GetAll()
+	if err != nil {
+		return nil, err
+	}
+	plans := make([]Plan, 0, len(planDocs))
+	for _, planDoc := range planDocs {
+		var plan Plan
+		if err = planDoc.DataTo(&plan); err != nil {
+			return nil, err
+		}
+		plans = append(plans, plan)
+	}
+	sortPlans(plans)
+	return plans, nil
+}
+
+// ListUsage lists the keys when key is empty, the usage documents are in a
+// subcollection of each key.
+func (f *Firestore) ListUsage(ctx context.Context, key string, from, to time.Time) ([]DailyUsage, error) {
+	keys := []string{key}
+	if key == "" {
+		keyRefs, err := f.client.Collection(apiKeyStoragePath).DocumentRefs(ctx).GetAll()
+		if err != nil {
+			return nil, err
+		}
+		keys = keys[:0]
+		for _, keyRef := range keyRefs {
+			keys = append(keys, keyRef.ID)
+		}
+	}
+	fromDate, toDate := dateRange(from, to)
+	var usages []DailyUsage
+	for _, key := range keys {
+		collection := f.client.Collection(fmt.Sprintf("%s/%s/usage", apiKeyStoragePath, key))
+		usageDocs, err := collection.
+			Where(firestore.DocumentID, ">=", collection.Doc(fromDate)).
+			Where(firestore.DocumentID, "<=", collection.Doc(toDate)).
+			Documents(ctx).
+			GetAll()
+		if err != nil {
+			return nil, err
+		}
+		for _, usageDoc := range usageDocs {
+			usage, err := readUsage(usageDoc)
+			if err != nil {
+				return nil, err
+			}
+			usages = append(usages, DailyUsage{Key: key, Date: usageDoc.Ref.ID, Usage: usage})
+		}
+	}
+	sortDailyUsage(usages)
+	return usages, nil
+}
+
+// firestoreUsage is Usage with the counters we had before usage was stored
+// per zone in a map
+type firestoreUsage struct {
+	Zones      map[string]int `firestore:"zones"`
+	Endpoints  map[string]int `firestore:"endpoints"`
+	Rejected   map[string]int `firestore:"rejected"`
+	No1Counter int            `firestore:"no1Counter"`
+	No2Counter int            `firestore:"no2Counter"`
+	No3Counter int            `firestore:"no3Counter"`
+	No4Counter int            `firestore:"no4Counter"`
+	No5Counter int            `firestore:"no5Counter"`
+}
+
+// readUsage reads both new and old usage documents, the old documents only
+// counted requests to the prices endpoint
+func readUsage(usageDoc *firestore.DocumentSnapshot) (Usage, error) {
+	var stored firestoreUsage
+	if err := usageDoc.DataTo(&stored); err != nil {
+		return Usage{}, err
+	}
+	usage := Usage{Zones: stored.Zones, Endpoints: stored.Endpoints, Rejected: stored.Rejected}
+	for shortZone, count := range map[string]int{
+		"NO1": stored.No1Counter,
+		"NO2": stored.No2Counter,
+		"NO3": stored.No3Counter,
+		"NO4": stored.No4Counter,
+		"NO5": stored.No5Counter,
+	} {
+		if count > 0 {
+			usage.add(legacyEndpoint, shortZone, count)
+		}
+	}
+	return usage, nil
+}
+
+func (f *Firestore) usageDoc(key string) *firestore.DocumentRef {
+	return f.usageDocOn(key, today())
+}
+
+func (f *Firestore) usageDocOn(key, date string) *firestore.DocumentRef {
+	return f.client.Doc(fmt.Sprintf(
+		"%s/%s/usage/%s",
+		apiKeyStoragePath,
+		key,
+		date,
+	))
+}
+
+func (f *Firestore) monthlyUsageDoc(key, month string) *firestore.DocumentRef {
+	return f.client.Doc(fmt.Sprintf(
+		"%s/%s/monthly-usage/%s",
+		apiKeyStoragePath,
+		key,
+		month,
+	))
+}
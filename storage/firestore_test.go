@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/firestore/apiv1/firestorepb"
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// The benchmarks needs the Firestore emulator:
+//
+//	gcloud emulators firestore start --host-port=localhost:8686
+//	FIRESTORE_EMULATOR_HOST=localhost:8686 go test ./storage -run=^$ -bench=Firestore
+func openEmulatorStore(b *testing.B) (context.Context, time.Time, calculator.Zone) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		b.Skip("FIRESTORE_EMULATOR_HOST is not set")
+	}
+	ctx := context.Background()
+	day := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	zone := calculator.Zones["NO2"]
+	store, err := OpenFirestore(ctx, "benchmark")
+	if err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+	defer store.Close()
+	document := PriceDocument{
+		Prices: map[string]calculator.PricePoint{
+			day.Format(time.RFC3339): {PriceMWhEUR: 47.14, From: day, To: day.Add(time.Hour)},
+		},
+	}
+	if err = store.StoreCache(ctx, day, zone, document); err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+	return ctx, day, zone
+}
+
+// BenchmarkFirestoreClientPerCall is how the storage used to work, with a new
+// client for every call.
+func BenchmarkFirestoreClientPerCall(b *testing.B) {
+	ctx, day, zone := openEmulatorStore(b)
+	b.ResetTimer()
+	for range b.N {
+		client, err := firestore.NewClient(ctx, "benchmark")
+		if err != nil {
+			b.Fatalf("unexpected error %v", err)
+		}
+		if _, _, err = NewFirestore(client).GetCache(ctx, day, zone); err != nil {
+			b.Fatalf("unexpected error %v", err)
+		}
+		client.Close()
+	}
+}
+
+func BenchmarkFirestoreSharedClient(b *testing.B) {
+	ctx, day, zone := openEmulatorStore(b)
+	store, err := OpenFirestore(ctx, "benchmark")
+	if err != nil {
+		b.Fatalf("unexpected error %v", err)
+	}
+	defer store.Close()
+	b.ResetTimer()
+	for range b.N {
+		if _, _, err = store.GetCache(ctx, day, zone); err != nil {
+			b.Fatalf("unexpected error %v", err)
+		}
+	}
+}
+
+// fakeFirestore answers all document reads with "missing"
+type fakeFirestore struct {
+	firestorepb.UnimplementedFirestoreServer
+}
+
+func (*fakeFirestore) BatchGetDocuments(req *firestorepb.BatchGetDocumentsRequest, stream firestorepb.Firestore_BatchGetDocumentsServer) error {
+	for _, name := range req.Documents {
+		err := stream.Send(&firestorepb.BatchGetDocumentsResponse{
+			Result:   &firestorepb.BatchGetDocumentsResponse_Missing{Missing: name},
+			ReadTime: timestamppb.Now(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// countingListener counts the connections to the fake Firestore
+type countingListener struct {
+	net.Listener
+	connections atomic.Int32
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.connections.Add(1)
+	}
+	return conn, err
+}
+
+func TestFirestoreReusesTheClient(t *testing.T) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	counting := &countingListener{Listener: listener}
+	server := grpc.NewServer()
+	firestorepb.RegisterFirestoreServer(server, &fakeFirestore{})
+	go server.Serve(counting)
+	defer server.Stop()
+	t.Setenv("FIRESTORE_EMULATOR_HOST", listener.Addr().String())
+
+	ctx := context.Background()
+	day := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	zone := calculator.Zones["NO2"]
+	store, err := OpenFirestore(ctx, "test")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	defer store.Close()
+	read := func(store *Firestore) {
+		t.Helper()
+		if ok, _, err := store.GetCache(ctx, day, zone); ok || err != nil {
+			t.Fatalf("expected no cached prices, got %v %v", ok, err)
+		}
+		if ok, _, err := store.GetApiKey(ctx, "key"); ok || err != nil {
+			t.Fatalf("expected no API key, got %v %v", ok, err)
+		}
+	}
+	// the client might have a pool of connections
+	for range 10 {
+		read(store)
+	}
+	connections := counting.connections.Load()
+	for range 20 {
+		read(store)
+	}
+	if now := counting.connections.Load(); now != connections {
+		t.Errorf("expected the requests to reuse the %d connections, got %d connections", connections, now)
+	}
+
+	// a client per call is what the storage used to do
+	client, err := firestore.NewClient(ctx, "test")
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	read(NewFirestore(client))
+	client.Close()
+	if now := counting.connections.Load(); now == connections {
+		t.Errorf("expected a new client to open a new connection")
+	}
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+)
+
+const (
+	DefaultLRUEntries   = 1000
+	DefaultLRURecentTTL = 5 * time.Minute
+)
+
+var (
+	lruMetrics   = expvar.NewMap("price_cache")
+	lruHits      = new(expvar.Int)
+	lruMisses    = new(expvar.Int)
+	lruEvictions = new(expvar.Int)
+	lruEntries   = new(expvar.Int)
+)
+
+func init() {
+	lruMetrics.Set("hits", lruHits)
+	lruMetrics.Set("misses", lruMisses)
+	lruMetrics.Set("evictions", lruEvictions)
+	lruMetrics.Set("entries", lruEntries)
+	lruMetrics.Set("hit_rate", expvar.Func(func() any {
+		hits, misses := lruHits.Value(), lruMisses.Value()
+		if hits+misses == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(hits+misses)
+	}))
+}
+
+// LRU keeps the most recently used prices in memory in front of another
+// Store. Today's and tomorrow's prices, and the prices for the last
+// revisableDays that ENTSO-E might still correct, expire after recentTTL so a
+// revision stored by another instance is picked up. Prices for earlier days
+// never change, so they are kept until they are evicted.
+//
+// The documents returned by GetCache are shared and must not be modified.
+type LRU struct {
+	Store
+	maxEntries    int
+	recentTTL     time.Duration
+	revisableDays int
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key      string
+	document *PriceDocument
+	expires  time.Time // zero if the entry never expires
+}
+
+func NewLRU(store Store, maxEntries int, recentTTL time.Duration, revisableDays int) *LRU {
+	return &LRU{
+		Store:         store,
+		maxEntries:    maxEntries,
+		recentTTL:     recentTTL,
+		revisableDays: revisableDays,
+		order:         list.New(),
+		entries:       map[string]*list.Element{},
+	}
+}
+
+// Persistent returns the store behind the LRU, or the store itself if it
+// isn't an LRU
+func Persistent(store Store) Store {
+	if lru, ok := store.(*LRU); ok {
+		return lru.Store
+	}
+	return store
+}
+
+func (l *LRU) StoreCache(ctx context.Context, day time.Time, zone calculator.Zone, document PriceDocument) error {
+	err := l.Store.StoreCache(ctx, day, zone, document)
+	if err != nil {
+		return err
+	}
+	l.add(day, zone, &document)
+	return nil
+}
+
+func (l *LRU) GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (ok bool, document *PriceDocument, err error) {
+	if document, ok := l.get(day, zone); ok {
+		lruHits.Add(1)
+		return true, document, nil
+	}
+	lruMisses.Add(1)
+	ok, document, err = l.Store.GetCache(ctx, day, zone)
+	if ok && err == nil {
+		l.add(day, zone, document)
+	}
+	return ok, document, err
+}
+
+func (l *LRU) get(day time.Time, zone calculator.Zone) (*PriceDocument, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	element, ok := l.entries[cacheKey(day, zone)]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*lruEntry)
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		l.remove(element)
+		return nil, false
+	}
+	l.order.MoveToFront(element)
+	return entry.document, true
+}
+
+func (l *LRU) add(day time.Time, zone calculator.Zone, document *PriceDocument) {
+	entry := &lruEntry{key: cacheKey(day, zone), document: document}
+	if l.isRecent(day) {
+		entry.expires = time.Now().Add(l.recentTTL)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if element, ok := l.entries[entry.key]; ok {
+		l.remove(element)
+	}
+	l.entries[entry.key] = l.order.PushFront(entry)
+	lruEntries.Add(1)
+	for l.order.Len() > l.maxEntries {
+		l.remove(l.order.Back())
+		lruEvictions.Add(1)
+	}
+}
+
+func (l *LRU) remove(element *list.Element) {
+	l.order.Remove(element)
+	delete(l.entries, element.Value.(*lruEntry).key)
+	lruEntries.Add(-1)
+}
+
+// isRecent returns true for today and tomorrow, and for the revisable days
+// before today
+func (l *LRU) isRecent(day time.Time) bool {
+	now := time.Now().In(common.Loc)
+	startOfToday := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, common.Loc)
+	return !day.Before(startOfToday.AddDate(0, 0, 1-max(l.revisableDays, 1)))
+}
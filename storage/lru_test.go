@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+)
+
+// countingStore counts the calls to GetCache
+type countingStore struct {
+	Store
+	gets int
+}
+
+func (c *countingStore) GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (bool, *PriceDocument, error) {
+	c.gets++
+	return c.Store.GetCache(ctx, day, zone)
+}
+
+func TestLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	zone := calculator.Zones["NO2"]
+	persistent := &countingStore{Store: NewMemory()}
+	lru := NewLRU(persistent, 2, time.Minute, 0)
+
+	days := []time.Time{
+		time.Date(2025, 1, 20, 0, 0, 0, 0, common.Loc),
+		time.Date(2025, 1, 21, 0, 0, 0, 0, common.Loc),
+		time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc),
+	}
+	for _, day := range days {
+		lru.StoreCache(ctx, day, zone, PriceDocument{})
+	}
+	if ok, _, _ := lru.GetCache(ctx, days[2], zone); !ok || persistent.gets != 0 {
+		t.Errorf("expected %s to be in memory, ok=%t gets=%d", days[2], ok, persistent.gets)
+	}
+	if ok, _, _ := lru.GetCache(ctx, days[0], zone); !ok || persistent.gets != 1 {
+		t.Errorf("expected %s to be evicted and read from the store, ok=%t gets=%d", days[0], ok, persistent.gets)
+	}
+}
+
+func TestLRUExpiresRecentDays(t *testing.T) {
+	ctx := context.Background()
+	zone := calculator.Zones["NO2"]
+	persistent := &countingStore{Store: NewMemory()}
+	lru := NewLRU(persistent, 10, 10*time.Millisecond, 3)
+	today := time.Now().In(common.Loc)
+	today = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, common.Loc)
+	revisable := today.AddDate(0, 0, -2)
+	lastYear := today.AddDate(-1, 0, 0)
+
+	for _, day := range []time.Time{today, revisable, lastYear} {
+		lru.StoreCache(ctx, day, zone, PriceDocument{})
+	}
+	time.Sleep(20 * time.Millisecond)
+	lru.GetCache(ctx, lastYear, zone)
+	if persistent.gets != 0 {
+		t.Errorf("expected last year to be in memory, got %d reads from the store", persistent.gets)
+	}
+	lru.GetCache(ctx, today, zone)
+	if persistent.gets != 1 {
+		t.Errorf("expected today to have expired, got %d reads from the store", persistent.gets)
+	}
+	lru.GetCache(ctx, revisable, zone)
+	if persistent.gets != 2 {
+		t.Errorf("expected the day that might be revised to have expired, got %d reads from the store", persistent.gets)
+	}
+}
+
+func TestPersistent(t *testing.T) {
+	persistent := NewMemory()
+	if store := Persistent(NewLRU(persistent, 10, time.Minute, 0)); store != persistent {
+		t.Errorf("expected the store behind the LRU, got %T", store)
+	}
+	if store := Persistent(persistent); store != persistent {
+		t.Errorf("expected the store itself, got %T", store)
+	}
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+)
+
+// Memory is a Store that keeps everything in memory, for tests and for
+// running the service locally.
+type Memory struct {
+	mu       sync.Mutex
+	prices   map[string]PriceDocument
+	apiKeys  map[string]ApiKey
+	accounts map[string]Account
+	usage    map[string]Usage
+	// monthlyUsage is keyed like usage, with the month instead of the date
+	monthlyUsage map[string]Usage
+	plans        map[string]Plan
+	// auditLog is ordered by time, the oldest first
+	auditLog []AuditLogEntry
+	signups  map[string]Signup
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		prices:       map[string]PriceDocument{},
+		apiKeys:      map[string]ApiKey{},
+		accounts:     map[string]Account{},
+		usage:        map[string]Usage{},
+		monthlyUsage: map[string]Usage{},
+		plans:        map[string]Plan{},
+		signups:      map[string]Signup{},
+	}
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+func (m *Memory) StoreCache(ctx context.Context, day time.Time, zone calculator.Zone, document PriceDocument) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	document.Prices = maps.Clone(document.Prices)
+	m.prices[cacheKey(day, zone)] = document
+	return nil
+}
+
+func (m *Memory) GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (ok bool, document *PriceDocument, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.prices[cacheKey(day, zone)]
+	if !ok {
+		return false, nil, nil
+	}
+	stored.Prices = maps.Clone(stored.Prices)
+	return true, &stored, nil
+}
+
+func (m *Memory) PutApiKey(ctx context.Context, key string, apiKey ApiKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apiKey.Scopes = apiKey.Scopes.clone()
+	m.apiKeys[key] = apiKey
+	return nil
+}
+
+func (m *Memory) GetApiKey(ctx context.Context, key string) (ok bool, apiKey *ApiKey, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.apiKeys[key]
+	if !ok {
+		return false, nil, nil
+	}
+	stored.Scopes = stored.Scopes.clone()
+	return true, &stored, nil
+}
+
+func (m *Memory) GetKeyUsage(ctx context.Context, key string) (*Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.usage[usageKey(key)].clone()
+	return &usage, nil
+}
+
+func (m *Memory) GetMonthlyUsage(ctx context.Context, key string) (*Usage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	usage := m.monthlyUsage[usageKeyOn(key, monthOf(today()))].clone()
+	return &usage, nil
+}
+
+func (m *Memory) ConsumeQuota(ctx context.Context, key, endpoint, shortZone string, quota Quota) (ok bool, remaining Remaining, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	date := today()
+	dayKey, monthKey := usageKeyOn(key, date), usageKeyOn(key, monthOf(date))
+	day, month := m.usage[dayKey], m.monthlyUsage[monthKey]
+	ok, remaining = consume(&day, &month, endpoint, shortZone, quota)
+	m.usage[dayKey], m.monthlyUsage[monthKey] = day, month
+	return ok, remaining, nil
+}
+
+func (m *Memory) RefundQuota(ctx context.Context, key, endpoint, shortZone string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	date := today()
+	for usages, usageKey := range map[*map[string]Usage]string{
+		&m.usage:        usageKeyOn(key, date),
+		&m.monthlyUsage: usageKeyOn(key, monthOf(date)),
+	} {
+		usage := (*usages)[usageKey]
+		usage.add(endpoint, shortZone, -1)
+		(*usages)[usageKey] = usage
+	}
+	return nil
+}
+
+func (m *Memory) PutPlan(ctx context.Context, plan Plan) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plan.Resolutions = slices.Clone(plan.Resolutions)
+	m.plans[plan.Name] = plan
+	return nil
+}
+
+func (m *Memory) ListPlans(ctx context.Context) ([]Plan, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	plans := make([]Plan, 0, len(m.plans))
+	for _, plan := range m.plans {
+		plan.Resolutions = slices.Clone(plan.Resolutions)
+		plans = append(plans, plan)
+	}
+	sortPlans(plans)
+	return plans, nil
+}
+
+func (m *Memory) ListUsage(ctx context.Context, key string, from, to time.Time) ([]DailyUsage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fromDate, toDate := dateRange(from, to)
+	var usages []DailyUsage
+	for storedKey, usage := range m.usage {
+		usageKey, date := splitUsageKey(storedKey)
+		if (key != "" && usageKey != key) || date < fromDate || date > toDate {
+			continue
+		}
+		usages = append(usages, DailyUsage{Key: usageKey, Date: date, Usage: usage.clone()})
+	}
+	sortDailyUsage(usages)
+	return usages, nil
+}
+
+func (m *Memory) ListApiKeys(ctx context.Context, emailPrefix string) ([]ApiKeyEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var apiKeys []ApiKeyEntry
+	for key, apiKey := range m.apiKeys {
+		if hasEmailPrefix(apiKey, emailPrefix) {
+			apiKeys = append(apiKeys, ApiKeyEntry{ID: key, ApiKey: apiKey})
+		}
+	}
+	sortApiKeys(apiKeys)
+	return apiKeys, nil
+}
+
+func (m *Memory) ListAccountApiKeys(ctx context.Context, account string) ([]ApiKeyEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var apiKeys []ApiKeyEntry
+	for key, apiKey := range m.apiKeys {
+		if apiKey.Account == account {
+			apiKeys = append(apiKeys, ApiKeyEntry{ID: key, ApiKey: apiKey})
+		}
+	}
+	sortApiKeys(apiKeys)
+	return apiKeys, nil
+}
+
+func (m *Memory) PutAccount(ctx context.Context, id string, account Account) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.accounts[id] = account
+	return nil
+}
+
+func (m *Memory) GetAccount(ctx context.Context, id string) (ok bool, account *Account, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.accounts[id]
+	if !ok {
+		return false, nil, nil
+	}
+	return true, &stored, nil
+}
+
+func (m *Memory) AddAuditLogEntry(ctx context.Context, entry AuditLogEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry.Details = maps.Clone(entry.Details)
+	m.auditLog = append(m.auditLog, entry)
+	return nil
+}
+
+func (m *Memory) ListAuditLog(ctx context.Context, key string, limit int) ([]AuditLogEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var entries []AuditLogEntry
+	for i := len(m.auditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		if key == "" || m.auditLog[i].Key == key {
+			entry := m.auditLog[i]
+			entry.Details = maps.Clone(entry.Details)
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (m *Memory) PutSignup(ctx context.Context, token string, signup Signup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.signups[token] = signup
+	return nil
+}
+
+func (m *Memory) TakeSignup(ctx context.Context, token string) (ok bool, signup *Signup, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.signups[token]
+	if !ok {
+		return false, nil, nil
+	}
+	delete(m.signups, token)
+	return true, &stored, nil
+}
+
+func (m *Memory) MigrateApiKey(ctx context.Context, legacyKey, hashedKey, prefix string) (ok bool, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apiKey, ok := m.apiKeys[legacyKey]
+	if !ok {
+		return false, nil
+	}
+	apiKey.Prefix = prefix
+	m.apiKeys[hashedKey] = apiKey
+	delete(m.apiKeys, legacyKey)
+	month := monthOf(today())
+	moveMemoryUsage(m.usage, usageKey(legacyKey), usageKey(hashedKey))
+	moveMemoryUsage(m.monthlyUsage, usageKeyOn(legacyKey, month), usageKeyOn(hashedKey, month))
+	return true, nil
+}
+
+func (m *Memory) MigrateUsage(ctx context.Context, legacyKey, hashedKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, usages := range []map[string]Usage{m.usage, m.monthlyUsage} {
+		for storedKey := range usages {
+			if key, date := splitUsageKey(storedKey); key == legacyKey {
+				moveMemoryUsage(usages, storedKey, usageKeyOn(hashedKey, date))
+			}
+		}
+	}
+	return nil
+}
+
+// moveMemoryUsage must be called with the lock held
+func moveMemoryUsage(usages map[string]Usage, from, to string) {
+	legacy, ok := usages[from]
+	if !ok {
+		return
+	}
+	usage := usages[to]
+	usage.merge(legacy)
+	usages[to] = usage
+	delete(usages, from)
+}
+
+func (m *Memory) ListLegacyApiKeys(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	legacy := map[string]bool{}
+	for key, apiKey := range m.apiKeys {
+		if apiKey.Prefix == "" {
+			legacy[key] = true
+		}
+	}
+	for storedKey := range m.usage {
+		if key, _ := splitUsageKey(storedKey); !legacy[key] {
+			if _, ok := m.apiKeys[key]; !ok {
+				legacy[key] = true
+			}
+		}
+	}
+	return sortedKeys(legacy), nil
+}
@@ -3,200 +3,436 @@ package storage
 import (
 	"context"
 	"fmt"
+	"maps"
+	"slices"
+	"sort"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/firestore"
 	"github.com/karl-gustav/power_price/calculator"
 	"github.com/karl-gustav/power_price/common"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/codes"
 )
 
 const (
-	priceStoragePath  = "power-price/norway-v2"
-	apiKeyStoragePath = "power-price/api-keys/users"
-	gcpProject        = "my-cloud-collection"
+	BackendFirestore = "firestore"
+	BackendMemory    = "memory"
+	BackendBolt      = "bolt"
 )
 
-type ApiKey struct {
-	Email   string `firestore:"email"`
-	Blocked bool   `firestore:"blocked"`
-	Reason  string `firestore:"reason"`
-	Name    string `firestore:"name"`
-	Quota   int    `firestore:"quota"`
-}
-
-type ZoneUsage struct {
-	No1Counter int `firestore:"no1Counter"`
-	No2Counter int `firestore:"no2Counter"`
-	No3Counter int `firestore:"no3Counter"`
-	No4Counter int `firestore:"no4Counter"`
-	No5Counter int `firestore:"no5Counter"`
-}
-
-func (u *ZoneUsage) GetZoneCount(shortZone string) int {
-	switch shortZone {
-	case "NO1":
-		return u.No1Counter
-	case "NO2":
-		return u.No2Counter
-	case "NO3":
-		return u.No3Counter
-	case "NO4":
-		return u.No4Counter
-	case "NO5":
-		return u.No5Counter
+// Store is where the price cache, API keys and API key usage is kept. API
+// keys are stored by their hash, see the apikey package.
+type Store interface {
+	StoreCache(ctx context.Context, day time.Time, zone calculator.Zone, document PriceDocument) error
+	// GetCache returns ok=false if there is nothing cached for the day and zone
+	GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (ok bool, document *PriceDocument, err error)
+	PutApiKey(ctx context.Context, key string, apiKey ApiKey) error
+	// GetApiKey returns ok=false if the key doesn't exist
+	GetApiKey(ctx context.Context, key string) (ok bool, apiKey *ApiKey, err error)
+	// ListApiKeys returns the keys with an email that starts with emailPrefix,
+	// or all keys if it is empty, ordered by key
+	ListApiKeys(ctx context.Context, emailPrefix string) ([]ApiKeyEntry, error)
+	// MigrateApiKey moves a key that was stored before keys were hashed, with
+	// today's usage, to hashedKey in one atomic operation. ok is false if
+	// there is no legacyKey.
+	MigrateApiKey(ctx context.Context, legacyKey, hashedKey, prefix string) (ok bool, err error)
+	// MigrateUsage moves the rest of the usage of legacyKey to hashedKey,
+	// adding it to the usage that is already there
+	MigrateUsage(ctx context.Context, legacyKey, hashedKey string) error
+	// ListLegacyApiKeys returns the keys that hasn't been migrated, and keys
+	// that has been migrated but still has usage left
+	ListLegacyApiKeys(ctx context.Context) ([]string, error)
+	// GetKeyUsage returns the usage for today
+	GetKeyUsage(ctx context.Context, key string) (*Usage, error)
+	// GetMonthlyUsage returns the usage for this month, it doesn't have the
+	// rejected requests
+	GetMonthlyUsage(ctx context.Context, key string) (*Usage, error)
+	// ConsumeQuota increments today's and this month's usage for the endpoint
+	// and zone in one atomic operation if the usage is below quota. ok is
+	// false if the quota is used up, remaining is how many requests are left
+	// after this one.
+	ConsumeQuota(ctx context.Context, key, endpoint, shortZone string, quota Quota) (ok bool, remaining Remaining, err error)
+	// RefundQuota gives back a request taken by ConsumeQuota, for requests
+	// that failed
+	RefundQuota(ctx context.Context, key, endpoint, shortZone string) error
+	PutPlan(ctx context.Context, plan Plan) error
+	// ListPlans returns the stored plans ordered by name
+	ListPlans(ctx context.Context) ([]Plan, error)
+	// ListUsage returns the usage per day from and to (inclusive) for the key,
+	// or for all keys if key is empty, ordered by key and date
+	ListUsage(ctx context.Context, key string, from, to time.Time) ([]DailyUsage, error)
+	// ListAccountApiKeys returns the keys that has Account set to account,
+	// ordered by key
+	ListAccountApiKeys(ctx context.Context, account string) ([]ApiKeyEntry, error)
+	PutAccount(ctx context.Context, id string, account Account) error
+	// GetAccount returns ok=false if the account doesn't exist, which it
+	// doesn't for keys without an Account
+	GetAccount(ctx context.Context, id string) (ok bool, account *Account, err error)
+	AddAuditLogEntry(ctx context.Context, entry AuditLogEntry) error
+	PutSignup(ctx context.Context, token string, signup Signup) error
+	// TakeSignup returns and deletes the signup in one atomic operation, so
+	// a token can only be used once. ok is false if it doesn't exist.
+	TakeSignup(ctx context.Context, token string) (ok bool, signup *Signup, err error)
+	// ListAuditLog returns the newest entries first, for the key or for all
+	// keys if key is empty
+	ListAuditLog(ctx context.Context, key string, limit int) ([]AuditLogEntry, error)
+	Close() error
+}
+
+// Open returns the store for the backend. location is the GCP project for
+// firestore and the database file for bolt.
+func Open(ctx context.Context, backend, location string) (Store, error) {
+	switch backend {
+	case BackendFirestore:
+		return OpenFirestore(ctx, location)
+	case BackendMemory:
+		return NewMemory(), nil
+	case BackendBolt:
+		return NewBolt(location)
 	default:
-		panic("invalid zone sent to GetZoneCount: " + shortZone)
+		return nil, fmt.Errorf("unknown storage backend %q, valid backends are %s, %s and %s", backend, BackendFirestore, BackendMemory, BackendBolt)
 	}
 }
 
-func StoreCache(ctx context.Context, day time.Time, zone calculator.Zone, prices map[string]calculator.PricePoint) error {
-	client, err := firestore.NewClient(ctx, gcpProject)
-	if err != nil {
-		return err
+// PriceDocument is the cached prices for a zone and day, with the revision of
+// the ENTSO-E document they were calculated from.
+type PriceDocument struct {
+	Prices map[string]calculator.PricePoint `firestore:"prices"`
+	// Revision is 0 for documents cached before we started storing revisions
+	Revision        int       `firestore:"revision"`
+	CreatedDateTime time.Time `firestore:"createdDateTime"`
+}
+
+// Plan is the quota and the features of the accounts that has it
+type Plan struct {
+	Name string `firestore:"name" json:"name"`
+	// DailyQuota is per zone per day
+	DailyQuota int `firestore:"dailyQuota" json:"daily_quota"`
+	// MonthlyQuota is for all zones in a month, 0 means no limit
+	MonthlyQuota int `firestore:"monthlyQuota" json:"monthly_quota"`
+	// RequestsPerMinute and Burst is the rate limit for each key, 0 means the
+	// default rate limit
+	RequestsPerMinute int `firestore:"requestsPerMinute" json:"requests_per_minute"`
+	Burst             int `firestore:"burst" json:"burst"`
+	// Resolutions are the resolutions the prices can be returned in, e.g.
+	// PT60M, an empty list allows all
+	Resolutions []string `firestore:"resolutions" json:"resolutions"`
+	// HistoryDays is how many days back prices can be requested, 0 means no
+	// limit
+	HistoryDays int `firestore:"historyDays" json:"history_days"`
+}
+
+// Quota is how many requests an account can make
+type Quota struct {
+	// Daily is per zone per day
+	Daily int
+	// Monthly is for all zones in a month, 0 means no limit
+	Monthly int
+}
+
+// Remaining is how many requests are left of a Quota
+type Remaining struct {
+	Daily int
+	// Monthly is -1 when there is no monthly quota
+	Monthly int
+}
+
+// Account is who the usage and the quota belongs to, it can have many API
+// keys. The ID of an account is the ID of its first key.
+type Account struct {
+	Email   string `firestore:"email" json:"email"`
+	Name    string `firestore:"name" json:"name"`
+	Blocked bool   `firestore:"blocked" json:"blocked"`
+	Reason  string `firestore:"reason" json:"reason"`
+	// Plan is the name of the plan of the account. If it is empty Quota,
+	// RequestsPerMinute and Burst are used instead.
+	Plan  string `firestore:"plan" json:"plan,omitempty"`
+	Quota int    `firestore:"quota" json:"quota"`
+	// RequestsPerMinute and Burst is the rate limit for each key, 0 means the
+	// default rate limit
+	RequestsPerMinute int       `firestore:"requestsPerMinute" json:"requests_per_minute"`
+	Burst             int       `firestore:"burst" json:"burst"`
+	Created           time.Time `firestore:"created" json:"created"`
+}
+
+// ApiKey is never deleted, it is revoked by setting Expires
+type ApiKey struct {
+	Email   string `firestore:"email" json:"email"`
+	Blocked bool   `firestore:"blocked" json:"blocked"`
+	Reason  string `firestore:"reason" json:"reason"`
+	Name    string `firestore:"name" json:"name"`
+	// Quota, RequestsPerMinute and Burst are only used for keys without an
+	// Account, for other keys they are set on the account
+	Quota             int `firestore:"quota" json:"quota,omitempty"`
+	RequestsPerMinute int `firestore:"requestsPerMinute" json:"requests_per_minute,omitempty"`
+	Burst             int `firestore:"burst" json:"burst,omitempty"`
+	// Created is zero for keys that was created in the Firestore console
+	Created time.Time `firestore:"created" json:"created"`
+	// Prefix is the part of the key that isn't secret, it is empty for keys
+	// that hasn't been migrated to being stored by their hash
+	Prefix string `firestore:"prefix" json:"prefix"`
+	// Account is empty for keys created before there were accounts, they are
+	// an account of their own with the ID of the key
+	Account string `firestore:"account" json:"account_id,omitempty"`
+	// Expires is zero for keys that never expire
+	Expires time.Time `firestore:"expires" json:"expires"`
+	Scopes  Scopes    `firestore:"scopes" json:"scopes"`
+}
+
+// Scopes limits what an API key can be used for, an empty list doesn't limit
+// anything
+type Scopes struct {
+	// Zones are e.g. NO1
+	Zones []string `firestore:"zones" json:"zones,omitempty"`
+	// Endpoints are e.g. prices. The admin API can only be used by keys that
+	// has it listed.
+	Endpoints []string `firestore:"endpoints" json:"endpoints,omitempty"`
+	// Origins are the websites the key can be used from, e.g.
+	// https://example.com. Requests without an Origin header are denied.
+	Origins []string `firestore:"origins" json:"origins,omitempty"`
+}
+
+// IsZero is true if the key can be used for everything but the admin API
+func (s Scopes) IsZero() bool {
+	return len(s.Zones) == 0 && len(s.Endpoints) == 0 && len(s.Origins) == 0
+}
+
+func (s Scopes) clone() Scopes {
+	return Scopes{Zones: slices.Clone(s.Zones), Endpoints: slices.Clone(s.Endpoints), Origins: slices.Clone(s.Origins)}
+}
+
+// AccountID is the ID of the account the key with the ID id belongs to
+func (a *ApiKey) AccountID(id string) string {
+	if a.Account == "" {
+		return id
 	}
-	defer client.Close()
-	collection := client.Doc(fmt.Sprintf(
-		"%s/%s/%s",
-		priceStoragePath,
-		zone,
-		day.Format(common.StdDateFormat),
-	))
-
-	_, err = collection.Set(ctx, prices)
-	return err
-}
-
-func GetCache(ctx context.Context, day time.Time, zone calculator.Zone) (ok bool, pricepoints map[string]calculator.PricePoint, err error) {
-	client, err := firestore.NewClient(ctx, gcpProject)
-	if err != nil {
-		return false, nil, err
+	return a.Account
+}
+
+// Expired is true if the key has expired at now
+func (a *ApiKey) Expired(now time.Time) bool {
+	return !a.Expires.IsZero() && !now.Before(a.Expires)
+}
+
+// LegacyAccount is the account of a key without an Account, with the settings
+// stored on the key
+func (a *ApiKey) LegacyAccount() Account {
+	return Account{
+		Email:             a.Email,
+		Name:              a.Name,
+		Quota:             a.Quota,
+		RequestsPerMinute: a.RequestsPerMinute,
+		Burst:             a.Burst,
+		Created:           a.Created,
 	}
-	defer client.Close()
-	documentRef := client.Doc(fmt.Sprintf(
-		"%s/%s/%s",
-		priceStoragePath,
-		zone,
-		day.Format(common.StdDateFormat),
-	))
-	document, err := documentRef.Get(ctx)
-	if err != nil {
-		if grpc.Code(err) == codes.NotFound {
-			return false, nil, nil
-		}
-		return false, nil, err
+}
+
+// ApiKeyEntry is an API key with the ID it is stored as, the hash of the key
+type ApiKeyEntry struct {
+	ID string `json:"id"`
+	ApiKey
+}
+
+// Signup is a request for an API key that is waiting for the email to be
+// verified
+type Signup struct {
+	Email   string    `firestore:"email"`
+	Name    string    `firestore:"name"`
+	IP      string    `firestore:"ip"`
+	Created time.Time `firestore:"created"`
+	// Expires is when the verification link stops working. In Firestore the
+	// signups are deleted by a TTL policy on this field.
+	Expires time.Time `firestore:"expires"`
+}
+
+// AuditLogEntry is a change made to an API key through the admin API
+type AuditLogEntry struct {
+	Time time.Time `firestore:"time" json:"time"`
+	// Actor is who made the change
+	Actor string `firestore:"actor" json:"actor"`
+	// Action is what was done, e.g. create or block
+	Action string `firestore:"action" json:"action"`
+	// Key is the ID of the API key or the account, the ID of an account is
+	// the ID of its first key
+	Key     string            `firestore:"key" json:"key"`
+	Details map[string]string `firestore:"details" json:"details,omitempty"`
+}
+
+// Usage is the number of requests an API key has made in one day
+type Usage struct {
+	// Zones is the number of requests per zone, e.g. NO1. The daily quota is
+	// per zone.
+	Zones map[string]int `firestore:"zones"`
+	// Endpoints is the number of requests per endpoint, e.g. prices
+	Endpoints map[string]int `firestore:"endpoints"`
+	// Rejected is the number of requests per zone that was denied because the
+	// quota was used up, they are not counted in Zones and Endpoints
+	Rejected map[string]int `firestore:"rejected"`
+}
+
+// DailyUsage is the usage of an API key on a date
+type DailyUsage struct {
+	Key   string
+	Date  string
+	Usage Usage
+}
+
+func (u *Usage) GetZoneCount(shortZone string) int {
+	return u.Zones[shortZone]
+}
+
+func (u *Usage) GetEndpointCount(endpoint string) int {
+	return u.Endpoints[endpoint]
+}
+
+func (u *Usage) GetRejectedCount(shortZone string) int {
+	return u.Rejected[shortZone]
+}
+
+func (u *Usage) add(endpoint, shortZone string, delta int) {
+	if u.Zones == nil {
+		u.Zones = map[string]int{}
+	}
+	if u.Endpoints == nil {
+		u.Endpoints = map[string]int{}
 	}
-	container := make(map[string]calculator.PricePoint)
-	err = document.DataTo(&container)
-	if err != nil {
-		return false, nil, err
+	u.Zones[shortZone] = max(u.Zones[shortZone]+delta, 0)
+	u.Endpoints[endpoint] = max(u.Endpoints[endpoint]+delta, 0)
+}
+
+// GetTotal is the number of requests in all zones
+func (u *Usage) GetTotal() int {
+	total := 0
+	for _, count := range u.Zones {
+		total += count
 	}
-	return true, container, nil
+	return total
 }
 
-func GetApiKey(ctx context.Context, key string) (ok bool, apiKey *ApiKey, err error) {
-	client, err := firestore.NewClient(ctx, gcpProject)
-	if err != nil {
-		return false, nil, err
+// consume increments the usage of the day and the month for the endpoint and
+// zone if they are below quota, otherwise it counts the request as rejected
+// in the day
+func consume(day, month *Usage, endpoint, shortZone string, quota Quota) (ok bool, remaining Remaining) {
+	remaining = Remaining{Daily: max(quota.Daily-day.GetZoneCount(shortZone), 0), Monthly: -1}
+	if quota.Monthly > 0 {
+		remaining.Monthly = max(quota.Monthly-month.GetTotal(), 0)
 	}
-	defer client.Close()
-	documentRef := client.Doc(fmt.Sprintf(
-		"%s/%s",
-		apiKeyStoragePath,
-		key,
-	))
-	document, err := documentRef.Get(ctx)
-	if err != nil {
-		if grpc.Code(err) == codes.NotFound {
-			return false, nil, nil
+	if remaining.Daily == 0 || remaining.Monthly == 0 {
+		if day.Rejected == nil {
+			day.Rejected = map[string]int{}
 		}
-		return false, nil, err
+		day.Rejected[shortZone]++
+		return false, remaining
 	}
-	err = document.DataTo(&apiKey)
-	if err != nil {
-		return false, nil, err
+	day.add(endpoint, shortZone, 1)
+	month.add(endpoint, shortZone, 1)
+	remaining.Daily--
+	if remaining.Monthly > 0 {
+		remaining.Monthly--
 	}
-	return true, apiKey, nil
+	return true, remaining
 }
 
-func GetKeyUsage(ctx context.Context, key string) (*ZoneUsage, error) {
-	date := time.Now().In(common.Loc).Format(common.StdDateFormat)
-	client, err := firestore.NewClient(ctx, gcpProject)
-	if err != nil {
-		return nil, err
-	}
-	defer client.Close()
-	documentRef := client.Doc(fmt.Sprintf(
-		"%s/%s/usage/%s",
-		apiKeyStoragePath,
-		key,
-		date,
-	))
-	usageDoc, err := documentRef.Get(ctx)
-	if err != nil {
-		if grpc.Code(err) == codes.NotFound {
-			return &ZoneUsage{}, nil
-		} else {
-			return nil, err
+// merge adds the counts in other to u
+func (u *Usage) merge(other Usage) {
+	for _, counts := range []struct {
+		to   *map[string]int
+		from map[string]int
+	}{{&u.Zones, other.Zones}, {&u.Endpoints, other.Endpoints}, {&u.Rejected, other.Rejected}} {
+		if len(counts.from) == 0 {
+			continue
+		}
+		if *counts.to == nil {
+			*counts.to = map[string]int{}
+		}
+		for name, count := range counts.from {
+			(*counts.to)[name] += count
 		}
 	}
-	var usage ZoneUsage
-	err = usageDoc.DataTo(&usage)
-	if err != nil {
-		return nil, err
-	}
-	return &usage, nil
 }
 
-func IncrementKeyUsage(ctx context.Context, key, shortZone string) error {
-	date := time.Now().In(common.Loc).Format(common.StdDateFormat)
-	client, err := firestore.NewClient(ctx, gcpProject)
-	if err != nil {
-		return err
+func (u Usage) clone() Usage {
+	return Usage{
+		Zones:     maps.Clone(u.Zones),
+		Endpoints: maps.Clone(u.Endpoints),
+		Rejected:  maps.Clone(u.Rejected),
 	}
-	defer client.Close()
-	documentRef := client.Doc(fmt.Sprintf(
-		"%s/%s/usage/%s",
-		apiKeyStoragePath,
-		key,
-		date,
-	))
-	_, err = documentRef.Create(ctx, newZoneUsage(shortZone))
-	if err != nil {
-		if grpc.Code(err) != codes.AlreadyExists {
-			return err
-		} else {
-			_, err = documentRef.Update(ctx, []firestore.Update{
-				{
-					Path:  strings.ToLower(shortZone) + "Counter",
-					Value: firestore.Increment(1),
-				},
-			})
-			if err != nil {
-				return err
-			}
-		}
+}
+
+// inLoc re-adds the timezone info to the prices, because that is lost in
+// firebase
+func (d *PriceDocument) inLoc() {
+	for key, pricePoint := range d.Prices {
+		pricePoint.From = pricePoint.From.In(common.Loc)
+		pricePoint.To = pricePoint.To.In(common.Loc)
+		d.Prices[key] = pricePoint
 	}
-	return nil
-}
-
-func newZoneUsage(shortZone string) ZoneUsage {
-	var zoneUsage ZoneUsage
-	switch shortZone {
-	case "NO1":
-		zoneUsage.No1Counter = 1
-	case "NO2":
-		zoneUsage.No2Counter = 1
-	case "NO3":
-		zoneUsage.No3Counter = 1
-	case "NO4":
-		zoneUsage.No4Counter = 1
-	case "NO5":
-		zoneUsage.No5Counter = 1
-	default:
-		panic("invalid zone sent to IncrementKeyUsage: " + shortZone)
+}
+
+func cacheKey(day time.Time, zone calculator.Zone) string {
+	return fmt.Sprintf("%s/%s", zone, day.Format(common.StdDateFormat))
+}
+
+func usageKey(key string) string {
+	return usageKeyOn(key, today())
+}
+
+func usageKeyOn(key, date string) string {
+	return fmt.Sprintf("%s/%s", key, date)
+}
+
+// splitUsageKey is the opposite of usageKey
+func splitUsageKey(usageKey string) (key, date string) {
+	i := strings.LastIndex(usageKey, "/")
+	return usageKey[:i], usageKey[i+1:]
+}
+
+// dateRange formats from and to so they can be compared with the dates in
+// the usage keys
+func dateRange(from, to time.Time) (fromDate, toDate string) {
+	return from.In(common.Loc).Format(common.StdDateFormat), to.In(common.Loc).Format(common.StdDateFormat)
+}
+
+// hasEmailPrefix is the same as the range query on email in Firestore, so
+// it is case sensitive
+func hasEmailPrefix(apiKey ApiKey, emailPrefix string) bool {
+	return strings.HasPrefix(apiKey.Email, emailPrefix)
+}
+
+func sortApiKeys(apiKeys []ApiKeyEntry) {
+	sort.Slice(apiKeys, func(i, j int) bool {
+		return apiKeys[i].ID < apiKeys[j].ID
+	})
+}
+
+func sortPlans(plans []Plan) {
+	sort.Slice(plans, func(i, j int) bool {
+		return plans[i].Name < plans[j].Name
+	})
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
 	}
-	return zoneUsage
+	sort.Strings(keys)
+	return keys
+}
+
+func sortDailyUsage(usages []DailyUsage) {
+	sort.Slice(usages, func(i, j int) bool {
+		if usages[i].Key != usages[j].Key {
+			return usages[i].Key < usages[j].Key
+		}
+		return usages[i].Date < usages[j].Date
+	})
+}
+
+func today() string {
+	return time.Now().In(common.Loc).Format(common.StdDateFormat)
+}
+
+// monthOf is the month of a date from today(), e.g. 2025-03
+func monthOf(date string) string {
+	return date[:len("2006-01")]
 }
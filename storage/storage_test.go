@@ -0,0 +1,404 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+)
+
+func testStores(t *testing.T) map[string]Store {
+	bolt, err := NewBolt(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	t.Cleanup(func() { bolt.Close() })
+	return map[string]Store{
+		BackendMemory: NewMemory(),
+		BackendBolt:   bolt,
+	}
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	day := time.Date(2025, 1, 22, 0, 0, 0, 0, common.Loc)
+	zone := calculator.Zones["NO2"]
+	document := PriceDocument{
+		Prices: map[string]calculator.PricePoint{
+			day.Format(time.RFC3339): {PriceMWhEUR: 47.14, From: day, To: day.Add(time.Hour)},
+		},
+		Revision: 2,
+	}
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ok, _, err := store.GetCache(ctx, day, zone)
+			if err != nil || ok {
+				t.Fatalf("expected empty cache, got ok=%t err=%v", ok, err)
+			}
+			if err = store.StoreCache(ctx, day, zone, document); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ok, cached, err := store.GetCache(ctx, day, zone)
+			if err != nil || !ok {
+				t.Fatalf("expected cached prices, got ok=%t err=%v", ok, err)
+			}
+			pricePoint := cached.Prices[day.Format(time.RFC3339)]
+			if pricePoint.PriceMWhEUR != 47.14 || !pricePoint.From.Equal(day) {
+				t.Errorf("expected cached price to be %v, was %v", document.Prices[day.Format(time.RFC3339)], pricePoint)
+			}
+			if pricePoint.From.Location() != common.Loc {
+				t.Errorf("expected cached price to be in %s, was in %s", common.Loc, pricePoint.From.Location())
+			}
+			if cached.Revision != 2 {
+				t.Errorf("expected revision 2, was %d", cached.Revision)
+			}
+		})
+	}
+}
+
+func TestApiKeysAndUsage(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			ok, _, err := store.GetApiKey(ctx, "key")
+			if err != nil || ok {
+				t.Fatalf("expected no key, got ok=%t err=%v", ok, err)
+			}
+			if err = store.PutApiKey(ctx, "key", ApiKey{Email: "test@example.com", Quota: 10}); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ok, apiKey, err := store.GetApiKey(ctx, "key")
+			if err != nil || !ok || apiKey.Quota != 10 {
+				t.Fatalf("expected key with quota 10, got ok=%t key=%v err=%v", ok, apiKey, err)
+			}
+			for _, expectedRemaining := range []int{1, 0} {
+				ok, remaining, err := store.ConsumeQuota(ctx, "key", "prices", "NO2", Quota{Daily: 2})
+				if err != nil || !ok || remaining != (Remaining{Daily: expectedRemaining, Monthly: -1}) {
+					t.Fatalf("expected quota to be consumed with %d remaining, got ok=%t remaining=%+v err=%v", expectedRemaining, ok, remaining, err)
+				}
+			}
+			if ok, _, _ := store.ConsumeQuota(ctx, "key", "prices", "NO2", Quota{Daily: 2}); ok {
+				t.Errorf("expected quota to be used up")
+			}
+			if err = store.RefundQuota(ctx, "key", "prices", "NO2"); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			usage, err := store.GetKeyUsage(ctx, "key")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if usage.GetZoneCount("NO2") != 1 || usage.GetZoneCount("NO1") != 0 {
+				t.Errorf("expected usage of 1 in NO2 and 0 in NO1, got %+v", usage)
+			}
+			if usage.GetEndpointCount("prices") != 1 {
+				t.Errorf("expected usage of 1 for the prices endpoint, got %+v", usage)
+			}
+			if usage.GetRejectedCount("NO2") != 1 {
+				t.Errorf("expected 1 rejected request in NO2, got %+v", usage)
+			}
+		})
+	}
+}
+
+func TestMonthlyQuota(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			quota := Quota{Daily: 10, Monthly: 3}
+			for i, zone := range []string{"NO1", "NO2", "NO3"} {
+				ok, remaining, err := store.ConsumeQuota(ctx, "key", "prices", zone, quota)
+				if err != nil || !ok || remaining != (Remaining{Daily: 9, Monthly: 2 - i}) {
+					t.Fatalf("expected quota to be consumed in %s, got ok=%t remaining=%+v err=%v", zone, ok, remaining, err)
+				}
+			}
+			ok, remaining, err := store.ConsumeQuota(ctx, "key", "prices", "NO4", quota)
+			if err != nil || ok || remaining != (Remaining{Daily: 10, Monthly: 0}) {
+				t.Fatalf("expected the monthly quota to be used up, got ok=%t remaining=%+v err=%v", ok, remaining, err)
+			}
+			if err = store.RefundQuota(ctx, "key", "prices", "NO1"); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			usage, err := store.GetMonthlyUsage(ctx, "key")
+			if err != nil || usage.GetTotal() != 2 || usage.GetEndpointCount("prices") != 2 {
+				t.Errorf("expected a monthly usage of 2, got %+v err=%v", usage, err)
+			}
+		})
+	}
+}
+
+func TestPlans(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for _, plan := range []Plan{
+				{Name: "hobby", DailyQuota: 1000, MonthlyQuota: 20000, Resolutions: []string{"PT15M", "PT60M"}},
+				{Name: "free", DailyQuota: 100, MonthlyQuota: 2000, Resolutions: []string{"PT60M"}, HistoryDays: 30},
+				{Name: "hobby", DailyQuota: 2000, MonthlyQuota: 20000},
+			} {
+				if err := store.PutPlan(ctx, plan); err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			plans, err := store.ListPlans(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(plans) != 2 || plans[0].Name != "free" || plans[1].Name != "hobby" {
+				t.Fatalf("expected the plans free and hobby, got %+v", plans)
+			}
+			if plans[0].HistoryDays != 30 || fmt.Sprint(plans[0].Resolutions) != "[PT60M]" {
+				t.Errorf("expected the free plan to be stored, got %+v", plans[0])
+			}
+			if plans[1].DailyQuota != 2000 || len(plans[1].Resolutions) != 0 {
+				t.Errorf("expected the hobby plan to be replaced, got %+v", plans[1])
+			}
+		})
+	}
+}
+
+func TestConsumeQuotaIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			var consumed atomic.Int32
+			for range 50 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					ok, _, err := store.ConsumeQuota(ctx, "key", "prices", "NO1", Quota{Daily: 10})
+					if err != nil {
+						t.Errorf("unexpected error %v", err)
+					}
+					if ok {
+						consumed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if consumed.Load() != 10 {
+				t.Errorf("expected 10 of 50 parallel requests to get quota, %d got it", consumed.Load())
+			}
+		})
+	}
+}
+
+// putUsage stores usage for another day than today
+func putUsage(t *testing.T, store Store, key, date string, usage Usage) {
+	t.Helper()
+	switch store := store.(type) {
+	case *Memory:
+		store.usage[key+"/"+date] = usage
+	case *Bolt:
+		if err := store.put(usageBucket, key+"/"+date, usage); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+	default:
+		t.Fatalf("can't put usage in %T", store)
+	}
+}
+
+func TestListUsage(t *testing.T) {
+	ctx := context.Background()
+	from := time.Date(2025, 1, 2, 0, 0, 0, 0, common.Loc)
+	to := time.Date(2025, 1, 3, 0, 0, 0, 0, common.Loc)
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			putUsage(t, store, "b", "2025-01-02", Usage{Zones: map[string]int{"NO1": 1}})
+			putUsage(t, store, "a", "2025-01-03", Usage{Zones: map[string]int{"NO1": 3}})
+			putUsage(t, store, "a", "2025-01-02", Usage{Zones: map[string]int{"NO1": 2}})
+			putUsage(t, store, "a", "2025-01-01", Usage{Zones: map[string]int{"NO1": 1}})
+			putUsage(t, store, "a", "2025-01-04", Usage{Zones: map[string]int{"NO1": 4}})
+
+			usages, err := store.ListUsage(ctx, "", from, to)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			var listed []string
+			for _, usage := range usages {
+				listed = append(listed, fmt.Sprintf("%s/%s=%d", usage.Key, usage.Date, usage.Usage.GetZoneCount("NO1")))
+			}
+			expected := "[a/2025-01-02=2 a/2025-01-03=3 b/2025-01-02=1]"
+			if fmt.Sprint(listed) != expected {
+				t.Errorf("expected %s, got %s", expected, listed)
+			}
+
+			usages, err = store.ListUsage(ctx, "b", from, to)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(usages) != 1 || usages[0].Key != "b" {
+				t.Errorf("expected only the usage of b, got %+v", usages)
+			}
+		})
+	}
+}
+
+func TestListApiKeys(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store.PutApiKey(ctx, "b", ApiKey{Email: "ola@example.com"})
+			store.PutApiKey(ctx, "a", ApiKey{Email: "ola@example.com"})
+			store.PutApiKey(ctx, "c", ApiKey{Email: "kari@example.com"})
+			apiKeys, err := store.ListApiKeys(ctx, "")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(apiKeys) != 3 || apiKeys[0].ID != "a" || apiKeys[2].ID != "c" {
+				t.Errorf("expected keys a, b and c, got %+v", apiKeys)
+			}
+			apiKeys, err = store.ListApiKeys(ctx, "ola@")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(apiKeys) != 2 || apiKeys[0].ID != "a" || apiKeys[1].ID != "b" {
+				t.Errorf("expected keys a and b, got %+v", apiKeys)
+			}
+		})
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			if ok, _, err := store.GetAccount(ctx, "a"); ok || err != nil {
+				t.Fatalf("expected no account, got ok=%t err=%v", ok, err)
+			}
+			store.PutAccount(ctx, "a", Account{Email: "ola@example.com", Quota: 10})
+			ok, account, err := store.GetAccount(ctx, "a")
+			if !ok || err != nil || account.Quota != 10 {
+				t.Errorf("expected the account, got %+v ok=%t err=%v", account, ok, err)
+			}
+			store.PutApiKey(ctx, "b", ApiKey{Account: "a"})
+			store.PutApiKey(ctx, "a", ApiKey{Account: "a"})
+			store.PutApiKey(ctx, "c", ApiKey{Account: "other"})
+			store.PutApiKey(ctx, "d", ApiKey{})
+			apiKeys, err := store.ListAccountApiKeys(ctx, "a")
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(apiKeys) != 2 || apiKeys[0].ID != "a" || apiKeys[1].ID != "b" {
+				t.Errorf("expected keys a and b, got %+v", apiKeys)
+			}
+		})
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i, action := range []string{"create", "block", "unblock"} {
+				entry := AuditLogEntry{
+					Time:    time.Date(2025, 1, 1, 0, i, 0, 0, time.UTC),
+					Action:  action,
+					Key:     "a",
+					Details: map[string]string{"reason": "test"},
+				}
+				if err := store.AddAuditLogEntry(ctx, entry); err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+			}
+			store.AddAuditLogEntry(ctx, AuditLogEntry{Action: "create", Key: "b"})
+
+			entries, err := store.ListAuditLog(ctx, "a", 2)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(entries) != 2 || entries[0].Action != "unblock" || entries[1].Action != "block" {
+				t.Errorf("expected the 2 newest entries for a, got %+v", entries)
+			}
+			if entries[0].Details["reason"] != "test" {
+				t.Errorf("expected the details to be stored, got %+v", entries[0])
+			}
+			if entries, _ = store.ListAuditLog(ctx, "", 10); len(entries) != 4 || entries[0].Key != "b" {
+				t.Errorf("expected all 4 entries with b first, got %+v", entries)
+			}
+		})
+	}
+}
+
+func TestSignup(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			signup := Signup{Email: "ola@example.com", Name: "Ola", Expires: time.Now().Add(time.Hour).Round(0)}
+			if err := store.PutSignup(ctx, "token", signup); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			ok, taken, err := store.TakeSignup(ctx, "token")
+			if err != nil || !ok {
+				t.Fatalf("expected the signup, got ok=%t err=%v", ok, err)
+			}
+			if taken.Email != signup.Email || !taken.Expires.Equal(signup.Expires) {
+				t.Errorf("expected %+v, got %+v", signup, taken)
+			}
+			if ok, _, err := store.TakeSignup(ctx, "token"); ok || err != nil {
+				t.Errorf("expected the signup to only be taken once, got ok=%t err=%v", ok, err)
+			}
+		})
+	}
+}
+
+func TestMigrateApiKey(t *testing.T) {
+	ctx := context.Background()
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			store.PutApiKey(ctx, "legacy", ApiKey{Email: "ola@example.com", Quota: 10})
+			store.PutApiKey(ctx, "hashed", ApiKey{Email: "kari@example.com", Prefix: "abcdefgh"})
+			store.ConsumeQuota(ctx, "legacy", "prices", "NO1", Quota{Daily: 10})
+			putUsage(t, store, "legacy", "2025-01-01", Usage{Zones: map[string]int{"NO1": 2}})
+
+			legacy, err := store.ListLegacyApiKeys(ctx)
+			if err != nil || fmt.Sprint(legacy) != "[legacy]" {
+				t.Fatalf("expected legacy to be the only legacy key, got %v err=%v", legacy, err)
+			}
+			ok, err := store.MigrateApiKey(ctx, "legacy", "hashed-legacy", "lega…")
+			if err != nil || !ok {
+				t.Fatalf("expected the key to be migrated, got ok=%t err=%v", ok, err)
+			}
+			if ok, _, _ := store.GetApiKey(ctx, "legacy"); ok {
+				t.Errorf("expected the legacy key to be deleted")
+			}
+			ok, apiKey, _ := store.GetApiKey(ctx, "hashed-legacy")
+			if !ok || apiKey.Email != "ola@example.com" || apiKey.Prefix != "lega…" {
+				t.Errorf("expected the key to be stored with the prefix, got %+v", apiKey)
+			}
+			if usage, _ := store.GetKeyUsage(ctx, "hashed-legacy"); usage.GetZoneCount("NO1") != 1 {
+				t.Errorf("expected today's usage to be migrated, got %+v", usage)
+			}
+			putUsage(t, store, "hashed-legacy", "2025-01-01", Usage{Zones: map[string]int{"NO1": 1}})
+			// the old usage is still there
+			if legacy, _ = store.ListLegacyApiKeys(ctx); fmt.Sprint(legacy) != "[legacy]" {
+				t.Errorf("expected legacy to have usage left, got %v", legacy)
+			}
+
+			if err = store.MigrateUsage(ctx, "legacy", "hashed-legacy"); err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			usages, _ := store.ListUsage(ctx, "", time.Date(2025, 1, 1, 0, 0, 0, 0, common.Loc), time.Now())
+			var listed []string
+			for _, usage := range usages {
+				listed = append(listed, fmt.Sprintf("%s/%s=%d", usage.Key, usage.Date, usage.Usage.GetZoneCount("NO1")))
+			}
+			expected := fmt.Sprintf("[hashed-legacy/2025-01-01=3 hashed-legacy/%s=1]", today())
+			if fmt.Sprint(listed) != expected {
+				t.Errorf("expected %s, got %s", expected, listed)
+			}
+			if legacy, _ = store.ListLegacyApiKeys(ctx); len(legacy) != 0 {
+				t.Errorf("expected no legacy keys, got %v", legacy)
+			}
+			if ok, _ := store.MigrateApiKey(ctx, "legacy", "hashed-legacy", "lega…"); ok {
+				t.Errorf("expected nothing to migrate the second time")
+			}
+		})
+	}
+}
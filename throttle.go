@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/karl-gustav/power_price/ratelimit"
+)
+
+// Requests without a valid API key are cheap for a scanner but cost us a
+// Firestore read and a log entry each, so they are throttled per IP. An IP
+// that fails more often than AUTH_FAILURES_PER_MINUTE is banned for
+// AUTH_BAN_DURATION, and keys that wasn't found are remembered for
+// UNKNOWN_KEY_CACHE_TTL so they aren't looked up again.
+var (
+	authFailuresPerIP = ratelimit.NewKeyed(
+		getEnvInt("AUTH_FAILURES_PER_MINUTE", 10),
+		getEnvInt("AUTH_FAILURES_BURST", 20),
+	)
+	// authBanDuration of 0 disables the bans
+	authBanDuration = getEnvDuration("AUTH_BAN_DURATION", 15*time.Minute)
+	bannedIPs       = newExpiringSet(getEnvInt("AUTH_MAX_BANNED_IPS", 10000))
+	// unknownKeyTTL of 0 disables the cache of unknown keys
+	unknownKeyTTL = getEnvDuration("UNKNOWN_KEY_CACHE_TTL", 5*time.Minute)
+	unknownKeys   = newExpiringSet(getEnvInt("UNKNOWN_KEY_CACHE_ENTRIES", 10000))
+)
+
+var (
+	authMetrics           = expvar.NewMap("auth")
+	authFailures          = new(expvar.Int)
+	authBans              = new(expvar.Int)
+	authBannedRequests    = new(expvar.Int)
+	unknownKeyCacheHits   = new(expvar.Int)
+	unknownKeyCacheMisses = new(expvar.Int)
+)
+
+func init() {
+	authMetrics.Set("failures", authFailures)
+	authMetrics.Set("bans", authBans)
+	authMetrics.Set("banned_requests", authBannedRequests)
+	authMetrics.Set("unknown_key_cache_hits", unknownKeyCacheHits)
+	authMetrics.Set("unknown_key_cache_misses", unknownKeyCacheMisses)
+	authMetrics.Set("banned_ips", expvar.Func(func() any { return bannedIPs.len() }))
+	authMetrics.Set("unknown_keys", expvar.Func(func() any { return unknownKeys.len() }))
+}
+
+// authFailed counts a request without a valid API key, and bans the IP if it
+// has failed too often
+func authFailed(ctx context.Context, ip string) {
+	authFailures.Add(1)
+	if authBanDuration <= 0 || authFailuresPerIP.Allow(ip).Allowed {
+		return
+	}
+	bannedIPs.add(ip, authBanDuration)
+	authBans.Add(1)
+	slog.WarnContext(ctx, fmt.Sprintf("banned %s for %s because of too many requests without a valid API key", ip, authBanDuration))
+}
+
+// rememberUnknownKey is called when a key isn't found. New keys are random,
+// so a key that wasn't found doesn't have to be forgotten when keys are
+// created.
+func rememberUnknownKey(id string) {
+	if unknownKeyTTL > 0 {
+		unknownKeys.add(id, unknownKeyTTL)
+	}
+}
+
+// forgetUnknownKey is called when a key that might have been looked up before
+// is stored, e.g. when a key stored in plain text is migrated
+func forgetUnknownKey(id string) {
+	unknownKeys.remove(id)
+}
+
+// isUnknownKey is true if the key wasn't found the last UNKNOWN_KEY_CACHE_TTL
+func isUnknownKey(id string) bool {
+	if _, ok := unknownKeys.expiresIn(id); ok {
+		unknownKeyCacheHits.Add(1)
+		return true
+	}
+	unknownKeyCacheMisses.Add(1)
+	return false
+}
+
+// expiringSet is a set where each key is forgotten after a while. It never
+// has more than maxEntries keys, the keys that expire first are forgotten
+// to make room for new keys.
+type expiringSet struct {
+	maxEntries int
+
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	lastSweep time.Time
+}
+
+func newExpiringSet(maxEntries int) *expiringSet {
+	return &expiringSet{maxEntries: maxEntries, expires: map[string]time.Time{}, lastSweep: time.Now()}
+}
+
+func (s *expiringSet) add(key string, ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.sweep(now, false)
+	if _, ok := s.expires[key]; !ok && len(s.expires) >= s.maxEntries {
+		s.sweep(now, true)
+		if len(s.expires) >= s.maxEntries {
+			s.evictFirstToExpire()
+		}
+	}
+	s.expires[key] = now.Add(ttl)
+}
+
+// expiresIn returns how long until the key is forgotten, ok is false if it
+// isn't in the set
+func (s *expiringSet) expiresIn(key string) (d time.Duration, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expires, ok := s.expires[key]
+	if !ok {
+		return 0, false
+	}
+	if d = time.Until(expires); d <= 0 {
+		delete(s.expires, key)
+		return 0, false
+	}
+	return d, true
+}
+
+func (s *expiringSet) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.expires, key)
+}
+
+func (s *expiringSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(time.Now(), false)
+	return len(s.expires)
+}
+
+// sweep forgets the expired keys, at most once a minute unless force is set.
+// It must be called with the lock held.
+func (s *expiringSet) sweep(now time.Time, force bool) {
+	if !force && now.Sub(s.lastSweep) < time.Minute {
+		return
+	}
+	s.lastSweep = now
+	for key, expires := range s.expires {
+		if !now.Before(expires) {
+			delete(s.expires, key)
+		}
+	}
+}
+
+// evictFirstToExpire must be called with the lock held
+func (s *expiringSet) evictFirstToExpire() {
+	first := ""
+	for key, expires := range s.expires {
+		if first == "" || expires.Before(s.expires[first]) {
+			first = key
+		}
+	}
+	delete(s.expires, first)
+}
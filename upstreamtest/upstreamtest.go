@@ -0,0 +1,269 @@
+// Package upstreamtest is a stand-in for the ENTSO-E and Norges Bank APIs that
+// serves the documents in testdata, so the service can be run and tested
+// without internet access.
+//
+// ENTSO-E is served under /entsoe/api and Norges Bank under /norges-bank/api/data.
+// Dates without a fixture gets an Acknowledgement_MarketDocument from ENTSO-E
+// and a 404 from Norges Bank, the same as the real APIs. The security token
+// "invalid" gets a 401 from ENTSO-E.
+package upstreamtest
+
+import (
+	"embed"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EntsoePath      = "/entsoe/api"
+	NorgesBankPath  = "/norges-bank/api/data"
+	InvalidToken    = "invalid"
+	entsoeTimestamp = "200601021504"
+	stdDateFormat   = "2006-01-02"
+)
+
+//go:embed testdata
+var testdata embed.FS
+
+var (
+	observationRegexp = regexp.MustCompile(`(?s)\s*<generic:Obs>.*?</generic:Obs>`)
+	obsDateRegexp     = regexp.MustCompile(`<generic:ObsDimension value="([0-9-]+)"`)
+)
+
+// Handler serves the ENTSO-E and Norges Bank stand-ins.
+type Handler struct {
+	// price documents by the start of their period, in ENTSO-E's timestamp format
+	prices map[string][]byte
+	// exchange rate documents by currency pair, e.g. EUR-NOK
+	exchangeRates map[string][]byte
+
+	mu       sync.Mutex
+	failing  map[string]bool
+	held     map[string]chan struct{}
+	requests map[string]int
+}
+
+func NewHandler() (*Handler, error) {
+	h := &Handler{
+		prices:        map[string][]byte{},
+		exchangeRates: map[string][]byte{},
+		failing:       map[string]bool{},
+		held:          map[string]chan struct{}{},
+		requests:      map[string]int{},
+	}
+	priceFiles, err := testdata.ReadDir("testdata/entsoe")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range priceFiles {
+		body, err := testdata.ReadFile(path.Join("testdata/entsoe", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var document struct {
+			Start string `xml:"period.timeInterval>start"`
+		}
+		if err = xml.Unmarshal(body, &document); err != nil {
+			return nil, fmt.Errorf("error unmarshaling %s: %w", file.Name(), err)
+		}
+		start, err := time.Parse("2006-01-02T15:04Z", document.Start)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing period start in %s: %w", file.Name(), err)
+		}
+		h.prices[start.Format(entsoeTimestamp)] = body
+	}
+	rateFiles, err := testdata.ReadDir("testdata/norges-bank")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range rateFiles {
+		body, err := testdata.ReadFile(path.Join("testdata/norges-bank", file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		h.exchangeRates[strings.TrimSuffix(file.Name(), ".xml")] = body
+	}
+	return h, nil
+}
+
+// SetFailing makes the stand-in for ENTSO-E (EntsoePath) or Norges Bank
+// (NorgesBankPath) respond with 503 to all requests.
+func (h *Handler) SetFailing(upstreamPath string, failing bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failing[upstreamPath] = failing
+}
+
+// Hold makes requests to ENTSO-E (EntsoePath) or Norges Bank (NorgesBankPath)
+// wait until release is called, e.g. to have concurrent requests in flight at
+// the same time. The requests are counted before they wait.
+func (h *Handler) Hold(upstreamPath string) (release func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	held := make(chan struct{})
+	h.held[upstreamPath] = held
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			delete(h.held, upstreamPath)
+			close(held)
+		})
+	}
+}
+
+// Requests returns how many requests have been made to ENTSO-E
+// (EntsoePath) or Norges Bank (NorgesBankPath).
+func (h *Handler) Requests(upstreamPath string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.requests[upstreamPath]
+}
+
+func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	switch {
+	case req.URL.Path == EntsoePath:
+		if h.countAndCheckFailing(EntsoePath) {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.serveEntsoe(res, req)
+	case strings.HasPrefix(req.URL.Path, NorgesBankPath+"/"):
+		if h.countAndCheckFailing(NorgesBankPath) {
+			http.Error(res, "Service Unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		h.serveNorgesBank(res, req)
+	default:
+		http.NotFound(res, req)
+	}
+}
+
+func (h *Handler) countAndCheckFailing(upstreamPath string) bool {
+	h.mu.Lock()
+	h.requests[upstreamPath]++
+	failing, held := h.failing[upstreamPath], h.held[upstreamPath]
+	h.mu.Unlock()
+	if held != nil {
+		<-held
+	}
+	return failing
+}
+
+func (h *Handler) serveEntsoe(res http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if token := query.Get("securityToken"); token == "" || token == InvalidToken {
+		http.Error(res, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	res.Header().Set("Content-Type", "text/xml")
+	if query.Get("documentType") != "A44" {
+		res.WriteHeader(http.StatusBadRequest)
+		writeAcknowledgement(res, "999", "The only supported documentType in the stand-in is A44")
+		return
+	}
+	periodStart := query.Get("periodStart")
+	body, ok := h.prices[periodStart]
+	if !ok {
+		writeAcknowledgement(res, "999", fmt.Sprintf(
+			"No matching data found for Data item Day-ahead Prices [12.1.D] (%s, %s) and interval %s/%s.",
+			query.Get("in_Domain"),
+			query.Get("out_Domain"),
+			periodStart,
+			query.Get("periodEnd"),
+		))
+		return
+	}
+	res.Write(body)
+}
+
+func writeAcknowledgement(res http.ResponseWriter, code, text string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	fmt.Fprintf(res, `<?xml version="1.0" encoding="UTF-8"?>
+<Acknowledgement_MarketDocument xmlns="urn:iec62325.351:tc57wg16:451-1:acknowledgementdocument:7:0">
+	<mRID>standin</mRID>
+	<createdDateTime>%s</createdDateTime>
+	<sender_MarketParticipant.mRID codingScheme="A01">10X1001A1001A450</sender_MarketParticipant.mRID>
+	<sender_MarketParticipant.marketRole.type>A32</sender_MarketParticipant.marketRole.type>
+	<receiver_MarketParticipant.mRID codingScheme="A01">10X1001A1001A39I</receiver_MarketParticipant.mRID>
+	<receiver_MarketParticipant.marketRole.type>A39</receiver_MarketParticipant.marketRole.type>
+	<received_MarketDocument.createdDateTime>%s</received_MarketDocument.createdDateTime>
+	<Reason>
+		<code>%s</code>
+		<text>%s</text>
+	</Reason>
+</Acknowledgement_MarketDocument>
+`, now, now, code, text)
+}
+
+// serveNorgesBank serves /EXR/B.<from>.<to>.SP with the observations between
+// startPeriod and endPeriod.
+func (h *Handler) serveNorgesBank(res http.ResponseWriter, req *http.Request) {
+	series := strings.Split(strings.TrimPrefix(req.URL.Path, NorgesBankPath+"/EXR/"), ".")
+	if len(series) != 4 {
+		http.Error(res, "No Results Found", http.StatusNotFound)
+		return
+	}
+	document, ok := h.exchangeRates[series[1]+"-"+series[2]]
+	if !ok {
+		http.Error(res, "No Results Found", http.StatusNotFound)
+		return
+	}
+	startPeriod := req.URL.Query().Get("startPeriod")
+	endPeriod := req.URL.Query().Get("endPeriod")
+	if _, err := time.Parse(stdDateFormat, startPeriod); err != nil {
+		http.Error(res, "Invalid startPeriod: "+startPeriod, http.StatusBadRequest)
+		return
+	}
+	if _, err := time.Parse(stdDateFormat, endPeriod); err != nil {
+		http.Error(res, "Invalid endPeriod: "+endPeriod, http.StatusBadRequest)
+		return
+	}
+
+	found := false
+	filtered := observationRegexp.ReplaceAllFunc(document, func(observation []byte) []byte {
+		date := string(obsDateRegexp.FindSubmatch(observation)[1])
+		if date < startPeriod || date > endPeriod {
+			return nil
+		}
+		found = true
+		return observation
+	})
+	if !found {
+		http.Error(res, "No Results Found", http.StatusNotFound)
+		return
+	}
+	res.Header().Set("Content-Type", "application/xml")
+	res.Write(filtered)
+}
+
+// Server is a running stand-in for ENTSO-E and Norges Bank.
+type Server struct {
+	*httptest.Server
+	*Handler
+	EntsoeURL     string
+	NorgesBankURL string
+}
+
+// NewServer starts a stand-in server, it must be closed with Close.
+func NewServer() *Server {
+	handler, err := NewHandler()
+	if err != nil {
+		panic(err)
+	}
+	server := httptest.NewServer(handler)
+	return &Server{
+		Server:        server,
+		Handler:       handler,
+		EntsoeURL:     server.URL + EntsoePath,
+		NorgesBankURL: server.URL + NorgesBankPath,
+	}
+}
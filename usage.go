@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+	"github.com/karl-gustav/power_price/ratelimit"
+	"github.com/karl-gustav/power_price/storage"
+)
+
+type usageResponse struct {
+	Date string `json:"date"`
+	// Plan is empty for accounts with a quota of their own
+	Plan      string               `json:"plan,omitempty"`
+	Quota     int                  `json:"quota"`
+	Reset     time.Time            `json:"reset"`
+	Zones     map[string]zoneUsage `json:"zones"`
+	Endpoints map[string]int       `json:"endpoints"`
+	Month     *monthlyUsage        `json:"month,omitempty"`
+}
+
+// monthlyUsage is the usage in all zones this month, it is only set for plans
+// with a monthly quota
+type monthlyUsage struct {
+	Month     string    `json:"month"`
+	Quota     int       `json:"quota"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+}
+
+type zoneUsage struct {
+	Used      int `json:"used"`
+	Remaining int `json:"remaining"`
+}
+
+// usageHandler returns todays usage of the account in all zones, it doesn't
+// count towards the quota
+func usageHandler(res http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	c := callerFrom(ctx)
+	usage, err := store.GetKeyUsage(ctx, c.accountID)
+	if err != nil {
+		slog.ErrorContext(ctx, fmt.Sprintf("got error when getting usage for key %s: %v", c.prefix, err))
+		writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when getting usage for api key: "+c.prefix))
+		return
+	}
+	now := time.Now().In(common.Loc)
+	response := usageResponse{
+		Date:      now.Format(common.StdDateFormat),
+		Plan:      c.plan.Name,
+		Quota:     c.plan.DailyQuota,
+		Reset:     quotaReset(now),
+		Zones:     map[string]zoneUsage{},
+		Endpoints: map[string]int{},
+	}
+	for zone := range calculator.Zones {
+		used := usage.GetZoneCount(zone)
+		response.Zones[zone] = zoneUsage{Used: used, Remaining: max(c.plan.DailyQuota-used, 0)}
+	}
+	for endpoint, count := range usage.Endpoints {
+		response.Endpoints[endpoint] = count
+	}
+	if c.plan.MonthlyQuota > 0 {
+		month, err := store.GetMonthlyUsage(ctx, c.accountID)
+		if err != nil {
+			slog.ErrorContext(ctx, fmt.Sprintf("got error when getting monthly usage for key %s: %v", c.prefix, err))
+			writeProblem(res, req, newProblem(http.StatusInternalServerError, codeInternalError, "error when getting usage for api key: "+c.prefix))
+			return
+		}
+		response.Month = &monthlyUsage{
+			Month:     now.Format(monthFormat),
+			Quota:     c.plan.MonthlyQuota,
+			Used:      month.GetTotal(),
+			Remaining: max(c.plan.MonthlyQuota-month.GetTotal(), 0),
+			Reset:     monthlyQuotaReset(now),
+		}
+	}
+	writeJSON(res, req, http.StatusOK, response)
+}
+
+// setQuotaHeaders sets the RateLimit-* headers for the quota that runs out
+// first, the daily quota in a zone or the monthly quota. RateLimit-Policy has
+// all the quotas and the per minute rate limit of the key.
+func setQuotaHeaders(header http.Header, quota storage.Quota, remaining storage.Remaining, rateLimit ratelimit.Result) {
+	now := time.Now()
+	limit, left, reset := quota.Daily, remaining.Daily, secondsUntilQuotaReset(now)
+	policy := fmt.Sprintf("%d;w=86400", quota.Daily)
+	if quota.Monthly > 0 {
+		// the window of the monthly quota is 30 days in the policy
+		policy += fmt.Sprintf(", %d;w=2592000", quota.Monthly)
+		if remaining.Monthly >= 0 && remaining.Monthly < remaining.Daily {
+			limit, left, reset = quota.Monthly, remaining.Monthly, secondsUntilMonthlyQuotaReset(now)
+		}
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(max(left, 0)))
+	header.Set("RateLimit-Reset", strconv.Itoa(reset))
+	header.Set("RateLimit-Policy", fmt.Sprintf(
+		"%s, %d;w=60;burst=%d",
+		policy,
+		rateLimit.RequestsPerMinute,
+		rateLimit.Burst,
+	))
+}
+
+// quotaReset is when the daily quota is reset, at midnight in Norway
+func quotaReset(now time.Time) time.Time {
+	return getStartOfDay(now.In(common.Loc)).AddDate(0, 0, 1)
+}
+
+func secondsUntilQuotaReset(now time.Time) int {
+	return int(quotaReset(now).Sub(now).Round(time.Second).Seconds())
+}
+
+// monthFormat is the format of the months in the monthly usage
+const monthFormat = "2006-01"
+
+// monthlyQuotaReset is when the monthly quota is reset, at midnight the first
+// day of the month in Norway
+func monthlyQuotaReset(now time.Time) time.Time {
+	year, month, _ := now.In(common.Loc).Date()
+	return time.Date(year, month+1, 1, 0, 0, 0, 0, common.Loc)
+}
+
+func secondsUntilMonthlyQuotaReset(now time.Time) int {
+	return int(monthlyQuotaReset(now).Sub(now).Round(time.Second).Seconds())
+}
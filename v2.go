@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/karl-gustav/power_price/calculator"
+	"github.com/karl-gustav/power_price/common"
+)
+
+// pricesResponse is the response of /v2/prices, the prices are a list
+// ordered by time so a missing interval can be seen
+type pricesResponse struct {
+	Zone       string          `json:"zone"`
+	Date       string          `json:"date"`
+	Currency   string          `json:"currency"`
+	Unit       string          `json:"unit"`
+	Resolution string          `json:"resolution"`
+	Metadata   pricesMetadata  `json:"metadata"`
+	Prices     []priceInterval `json:"prices"`
+}
+
+type pricesMetadata struct {
+	// Revision and Created are from the ENTSO-E document, Revision is 0 for
+	// prices cached before we started storing it
+	Revision         int        `json:"revision"`
+	Created          *time.Time `json:"created,omitempty"`
+	ExchangeRate     float64    `json:"exchange_rate"`
+	ExchangeRateDate string     `json:"exchange_rate_date"`
+	Provisional      bool       `json:"provisional"`
+	// Cache is hit, miss or synthetic (in the playground)
+	Cache string `json:"cache"`
+}
+
+type priceInterval struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Price       float64   `json:"price"`
+	PriceMWhEUR float64   `json:"EUR_per_MWh"`
+}
+
+// writePriceList is the format of /v2/prices
+func writePriceList(res http.ResponseWriter, query priceQuery, forecast *priceForecast, prices map[string]calculator.PricePoint, resolution string) error {
+	response := pricesResponse{
+		Zone:       query.shortZone,
+		Date:       query.date.Format(common.StdDateFormat),
+		Currency:   "NOK",
+		Unit:       "kWh",
+		Resolution: resolution,
+		Metadata: pricesMetadata{
+			Revision:    forecast.Revision,
+			Provisional: forecast.Provisional,
+			Cache:       forecast.Cache,
+		},
+		Prices: make([]priceInterval, 0, len(prices)),
+	}
+	if forecast.Revision > 0 {
+		response.Metadata.Created = &forecast.Created
+	}
+	for _, price := range sortedPrices(prices) {
+		response.Metadata.ExchangeRate, response.Metadata.ExchangeRateDate = price.ExchangeRate, price.ExchangeRateDate
+		response.Prices = append(response.Prices, priceInterval{
+			Start:       price.From,
+			End:         price.To,
+			Price:       math.Round(price.PriceKWhNOK*10000) / 10000,
+			PriceMWhEUR: price.PriceMWhEUR,
+		})
+	}
+	res.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(res).Encode(response)
+}
+
+// sortedPrices returns the prices ordered by the start of the interval
+func sortedPrices(prices map[string]calculator.PricePoint) []calculator.PricePoint {
+	sorted := make([]calculator.PricePoint, 0, len(prices))
+	for _, price := range prices {
+		sorted = append(sorted, price)
+	}
+	slices.SortFunc(sorted, func(a, b calculator.PricePoint) int {
+		return a.From.Compare(b.From)
+	})
+	return sorted
+}